@@ -1,5 +1,5 @@
 #!/usr/bin/env bash
 
-go build -o client src/client/main.go
+go build -o client ./src/client
 
-go build -o worker src/worker/main.go
\ No newline at end of file
+go build -o worker ./src/worker
\ No newline at end of file
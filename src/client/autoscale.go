@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"wordcounter/src/utils"
+)
+
+// autoscaleCommand sizes the worker fleet after the depth of the job queues
+// until it is interrupted. When the jobs are routed by queue, it also moves
+// the jobs left in the queues of the dead workers to the job queue.
+func autoscaleCommand(args []string) {
+	flags := flag.NewFlagSet("autoscale", flag.ExitOnError)
+	cfgPath := flags.String("config", "config/config.json", "path of the JSON config file")
+	logLevel := flags.String("log-level", "info", "lowest level of the records logged to stderr: debug, info, warn or error")
+	queue := flags.String("queue", "", "queue whose depth sizes the fleet (default the job, sub-job and worker queues)")
+	role := flags.String("role", utils.RoleWorker, "value of the "+utils.RoleTag+" tag of the instances of the fleet")
+	var policy utils.ScalingPolicy
+	flags.IntVar(&policy.MinWorkers, "min", 0, "least number of workers running")
+	flags.IntVar(&policy.MaxWorkers, "max", 4, "largest number of workers running")
+	flags.IntVar(&policy.JobsPerWorker, "jobs-per-worker", 4, "number of jobs, waiting or in progress, per worker")
+	flags.DurationVar(&policy.MaxBacklogAge, "max-age", 5*time.Minute, "add a worker when jobs wait for longer (0 disables it)")
+	flags.DurationVar(&policy.ScaleOutCooldown, "scale-out-cooldown", 3*time.Minute, "least time between two scale outs")
+	flags.DurationVar(&policy.ScaleInCooldown, "scale-in-cooldown", 10*time.Minute, "least time between a scaling and a scale in")
+	interval := flags.Duration("interval", 30*time.Second, "time between two checks of the queue")
+	once := flags.Bool("once", false, "check the queue and scale the fleet once, then exit")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s autoscale [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := policy.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "the interval must be positive")
+		os.Exit(2)
+	}
+
+	myCfg, services, log := setup(*cfgPath, *logLevel)
+	sqsClient, ok := services.SQS.(utils.WorkerQueueSweepAPI)
+	if services.EC2 == nil || !ok {
+		log.Error("the backend has no instances to scale", "backend", myCfg.Backend)
+		os.Exit(2)
+	}
+
+	// Stop on SIGTERM or Ctrl-C
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		log.Info("received signal, stopping", "signal", sig.String())
+		stop()
+	}()
+
+	launch, err := launchTemplate(myCfg).RunInput(0)
+	if err != nil {
+		log.Error("invalid config", utils.LogKeyError, err)
+		os.Exit(2)
+	}
+	scaler := &utils.Autoscaler{
+		Policy: policy,
+		EC2:    services.EC2,
+		SQS:    sqsClient,
+		Role:   *role,
+		Launch: launch,
+	}
+	queues := []string{*queue}
+	if *queue == "" {
+		queues = []string{myCfg.JobQueueName}
+		if myCfg.SubJobQueueName != "" {
+			queues = append(queues, myCfg.SubJobQueueName)
+		}
+		if myCfg.Routing == utils.RoutingQueue {
+			scaler.Leases, scaler.LeaseBucket = services.S3, myCfg.ResultBucketName
+		}
+	}
+	for _, name := range queues {
+		queueURL, err := utils.GetQueueURLSimple(ctx, services.SQS, name)
+		if err != nil {
+			log.Error("failed to get queue URL", utils.LogKeyQueue, name, utils.LogKeyError, err)
+			os.Exit(1)
+		}
+		scaler.QueueURLs = append(scaler.QueueURLs, queueURL)
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		action, err := scaler.Step(ctx)
+		logAction(log, action)
+		if err != nil && ctx.Err() == nil {
+			log.Error("failed to scale the fleet", utils.LogKeyError, err)
+			if *once {
+				os.Exit(1)
+			}
+		}
+		if myCfg.Routing == utils.RoutingQueue {
+			if _, err := utils.SweepWorkerQueues(ctx, sqsClient, services.S3, myCfg, time.Now()); err != nil && ctx.Err() == nil {
+				log.Warn("failed to sweep the queues of the workers", utils.LogKeyError, err)
+			}
+		}
+		if *once {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// logAction logs what a step of the autoscaler saw and did.
+func logAction(log *utils.JSONLogger, action utils.ScalingAction) {
+	args := []interface{}{
+		"waiting", action.Depth.Waiting,
+		"in_flight", action.Depth.InFlight,
+		"backlog_age", action.Depth.Age.String(),
+		"workers", action.Current,
+		"desired", action.Desired,
+	}
+	switch {
+	case len(action.Started)+len(action.Launched)+len(action.Stopped) > 0:
+		args = append(args, "started", action.Started, "launched", action.Launched, "stopped", action.Stopped)
+		log.Info("scaled the fleet", args...)
+	case action.Cooldown > 0:
+		args = append(args, "cooldown", action.Cooldown.String())
+		log.Info("fleet scaling in cooldown", args...)
+	default:
+		log.Debug("fleet checked", args...)
+	}
+}
+
+// launchTemplate returns the template of the worker instances of cfg, with
+// the bucket of their bootstrap in the region of cfg by default.
+func launchTemplate(cfg utils.Config) utils.LaunchConfig {
+	launch := cfg.Launch
+	if launch.Bootstrap != nil && launch.Bootstrap.Region == "" {
+		bootstrap := *launch.Bootstrap
+		bootstrap.Region = cfg.Region
+		launch.Bootstrap = &bootstrap
+	}
+	return launch
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"wordcounter/src/utils"
+)
+
+// stateCheckInterval is how often the client checks the state of the jobs it
+// waits for, to stop waiting for those cancelled meanwhile.
+const stateCheckInterval = 30 * time.Second
+
+// cancelCommand cancels jobs. The workers drop them, and their partial outputs,
+// when they next check for the cancellation.
+func cancelCommand(args []string) {
+	flags := flag.NewFlagSet("cancel", flag.ExitOnError)
+	cfgPath := flags.String("config", "config/config.json", "path of the JSON config file")
+	logLevel := flags.String("log-level", "warn", "lowest level of the records logged to stderr: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s cancel [flags] jobId...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	ids := parseInterspersed(flags, args)
+	if len(ids) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	myCfg, services, log := setup(*cfgPath, *logLevel)
+	ctx := context.Background()
+	failed := false
+	for _, arg := range ids {
+		id, err := utils.ParseJobID(arg)
+		if err != nil {
+			log.Error("invalid job id", utils.LogKeyJobID, arg, utils.LogKeyError, err)
+			failed = true
+			continue
+		}
+		state, err := utils.CancelJob(ctx, services.S3, myCfg.ResultBucketName, id, time.Now())
+		if err != nil {
+			log.Error("failed to cancel job", utils.LogKeyJobID, id, utils.LogKeyError, err)
+			failed = true
+			continue
+		}
+		if state.Status != utils.StatusCancelled {
+			fmt.Printf("Job %s already %s\n", id, state.Status)
+			failed = true
+			continue
+		}
+		fmt.Printf("Cancelled job %s\n", id)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// dropCancelled removes from pending the jobs that were cancelled, and returns
+// how many it removed.
+func dropCancelled(ctx context.Context, client utils.S3API, bucket string, pending map[utils.JobID]string) int {
+	dropped := 0
+	for id, key := range pending {
+		state, err := utils.LoadJobState(ctx, client, bucket, id)
+		if err != nil {
+			utils.Log().Warn("failed to load job state", utils.LogKeyJobID, id, utils.LogKeyError, err)
+			continue
+		}
+		if state != nil && state.Status == utils.StatusCancelled {
+			utils.Log().Error("job cancelled", utils.LogKeyJobID, id, utils.LogKeyKey, key)
+			delete(pending, id)
+			dropped++
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"wordcounter/src/utils"
+)
+
+// dlqHide is how long the dead-lettered messages are hidden from the other
+// clients while they are listed or redriven.
+const dlqHide = 60 * time.Second
+
+// dlqCommand lists the jobs of the dead-letter queue, or redrives some of them
+// to the queue they were taken from.
+func dlqCommand(args []string) {
+	flags := flag.NewFlagSet("dlq", flag.ExitOnError)
+	cfgPath := flags.String("config", "config/config.json", "path of the JSON config file")
+	all := flags.Bool("all", false, "redrive all the dead-lettered jobs")
+	logLevel := flags.String("log-level", "warn", "lowest level of the records logged to stderr: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s dlq [flags] list\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s dlq [flags] redrive -all | jobId...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	// The flags can come before or after the action
+	var action string
+	ids := parseInterspersed(flags, args)
+	if len(ids) > 0 {
+		action, ids = ids[0], ids[1:]
+	}
+	if action != "list" && (action != "redrive" || *all == (len(ids) > 0)) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	myCfg, services, log := setup(*cfgPath, *logLevel)
+	if myCfg.DeadLetterQueueName == "" {
+		log.Error("no DeadLetterQueueName in the config")
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	dlqURL, err := utils.GetQueueURLSimple(ctx, services.SQS, myCfg.DeadLetterQueueName)
+	if err != nil {
+		log.Error("failed to get queue URL", utils.LogKeyQueue, myCfg.DeadLetterQueueName, utils.LogKeyError, err)
+		os.Exit(1)
+	}
+	letters, err := utils.ReceiveDeadLetters(ctx, services.SQS, dlqURL, dlqHide)
+	if err != nil {
+		log.Error("failed to receive the dead-lettered jobs", utils.LogKeyError, err)
+		// Release the ones received so far
+	}
+
+	selected := make(map[utils.JobID]bool, len(ids))
+	for _, id := range ids {
+		selected[utils.JobID(id)] = true
+	}
+	found := make(map[utils.JobID]bool, len(ids))
+	failed := err != nil
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if action == "list" {
+		fmt.Fprintln(out, "JOB ID\tSOURCE\tRECEIVES\tREASON")
+	}
+	for _, letter := range letters {
+		if action == "list" {
+			fmt.Fprintf(out, "%s\t%s\t%d\t%s\n", orDash(string(letter.JobID)), letter.SourceQueue, letter.ReceiveCount, oneLine(letter.Reason))
+		}
+		if action == "redrive" && (*all || selected[letter.JobID]) {
+			// Sub-jobs share the ID of their job, redrive them all
+			found[letter.JobID] = true
+			if err := utils.RedriveDeadLetter(ctx, services.SQS, dlqURL, letter); err != nil {
+				log.Error("failed to redrive job", utils.LogKeyJobID, letter.JobID, utils.LogKeyError, err)
+				failed = true
+			} else {
+				fmt.Fprintf(out, "Redrove job '%s' to '%s'\n", orDash(string(letter.JobID)), letter.SourceQueue)
+				if letter.JobID != "" && letter.SourceQueue == myCfg.JobQueueName {
+					job := utils.JobMessage{JobID: letter.JobID}
+					recordStatus(ctx, services.S3, myCfg.ResultBucketName, job, utils.StatusQueued, "redriven from the dead-letter queue", nil)
+				}
+			}
+			continue
+		}
+		if err := utils.ReleaseDeadLetter(ctx, services.SQS, dlqURL, letter); err != nil {
+			log.Warn("failed to release job", utils.LogKeyJobID, letter.JobID, utils.LogKeyError, err)
+		}
+	}
+	out.Flush()
+	for _, id := range ids {
+		if found[utils.JobID(id)] {
+			continue
+		}
+		log.Error("job not found in the dead-letter queue", utils.LogKeyJobID, id)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// oneLine replaces the line breaks of s with spaces.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// orDash returns s, or "-" if it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
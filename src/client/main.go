@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"wordcounter/src/counter"
+	"wordcounter/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dlq":
+			dlqCommand(os.Args[2:])
+			return
+		case "status":
+			statusCommand(os.Args[2:])
+			return
+		case "cancel":
+			cancelCommand(os.Args[2:])
+			return
+		case "autoscale":
+			autoscaleCommand(os.Args[2:])
+			return
+		case "userdata":
+			userDataCommand(os.Args[2:])
+			return
+		case "sweep":
+			sweepCommand(os.Args[2:])
+			return
+		}
+	}
+
+	cfgPath := flag.String("config", "config/config.json", "path of the JSON config file")
+	top := flag.Int("top", 0, "only print the N most frequent words (0 prints all)")
+	waitTime := flag.Int("wait", 20, "long polling wait time in seconds")
+	timeout := flag.Duration("timeout", 0, "give up on the jobs not done this long after their submission (0 waits forever)")
+	partial := flag.Bool("partial", false, "print the counts of the jobs done when the timeout expires")
+	var opts counter.Options
+	flag.BoolVar(&opts.CaseSensitive, "case-sensitive", false, "count words with different cases separately")
+	flag.BoolVar(&opts.SplitHyphens, "split-hyphens", false, "count the parts of hyphenated words separately")
+	flag.BoolVar(&opts.IgnoreNumbers, "ignore-numbers", false, "do not count numbers as words")
+	flag.IntVar(&opts.MinLength, "min-length", 0, "skip words shorter than this many characters")
+	logLevel := flag.String("log-level", "info", "lowest level of the records logged to stderr: debug, info, warn or error")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s dlq [flags] list|redrive [jobId...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s status [flags] jobId...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s cancel [flags] jobId...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s autoscale [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s userdata [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s sweep [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *timeout != 0 && *timeout <= utils.SubmitDelay {
+		fmt.Fprintf(os.Stderr, "the timeout must be longer than the %v the jobs wait before the workers see them\n", utils.SubmitDelay)
+		os.Exit(2)
+	}
+	myCfg, services, log := setup(*cfgPath, *logLevel)
+	if _, err := utils.RoutingMode(myCfg); err != nil {
+		log.Error("invalid config", utils.LogKeyError, err)
+		os.Exit(2)
+	}
+	sqsClient := services.SQS
+	s3Client := services.S3
+	ctx := context.Background()
+
+	// Upload the input files to the data bucket, each under the ID of its job
+	jobIDs := make([]utils.JobID, 0, flag.NArg())
+	fileKeys := make([]string, 0, flag.NArg())
+	for _, path := range flag.Args() {
+		jobID := utils.NewJobID()
+		key, err := uploadFile(ctx, s3Client, myCfg.DataBucketName, jobID, path)
+		if err != nil {
+			log.Error("failed to upload file", "path", path, utils.LogKeyError, err)
+			os.Exit(1)
+		}
+		log.Info("uploaded file", "path", path, utils.LogKeyBucket, myCfg.DataBucketName, utils.LogKeyKey, key)
+		jobIDs = append(jobIDs, jobID)
+		fileKeys = append(fileKeys, key)
+	}
+
+	// Hand the jobs to the running workers in turn
+	var instances []utils.InstanceInfo
+	if services.EC2 != nil {
+		var err error
+		if instances, err = utils.ListEC2Instances(ctx, services.EC2, utils.WorkerFilter); err != nil {
+			log.Warn("failed to list the workers", utils.LogKeyError, err)
+		}
+		log.Info("listed running workers", "count", len(instances))
+	}
+	if len(instances) == 0 {
+		log.Info("no running worker found, jobs will be taken by any worker")
+		instances = []utils.InstanceInfo{{}}
+	}
+	submitter, _ := os.Hostname()
+	var deadline *time.Time
+	if *timeout > 0 {
+		d := time.Now().Add(*timeout)
+		deadline = &d
+	}
+	pending := make(map[utils.JobID]string, len(fileKeys))
+	for i, key := range fileKeys {
+		job := utils.JobMessage{
+			JobID:     jobIDs[i],
+			Bucket:    myCfg.DataBucketName,
+			Key:       key,
+			Options:   opts,
+			ReplyTo:   myCfg.ResultQueueName,
+			Submitter: submitter,
+			Tenant:    myCfg.Tenant,
+			Deadline:  deadline,
+		}
+		recordStatus(ctx, s3Client, myCfg.ResultBucketName, job, utils.StatusSubmitted, "", nil)
+		instance := instances[i%len(instances)]
+		queueName, err := utils.JobQueueFor(ctx, sqsClient, s3Client, myCfg, instance)
+		if err != nil {
+			log.Error("failed to find the queue of the worker", utils.LogKeyWorkerID, instance.Id, utils.LogKeyError, err)
+			recordStatus(ctx, s3Client, myCfg.ResultBucketName, job, utils.StatusFailed, err.Error(), nil)
+			os.Exit(1)
+		}
+		jobID, err := utils.SubmitJob(ctx, sqsClient, queueName, instance, job)
+		if err != nil {
+			log.Error("failed to submit job", utils.LogKeyKey, key, utils.LogKeyError, err)
+			recordStatus(ctx, s3Client, myCfg.ResultBucketName, job, utils.StatusFailed, err.Error(), nil)
+			os.Exit(1)
+		}
+		// Unless a worker took the job already
+		recordStatus(ctx, s3Client, myCfg.ResultBucketName, job, utils.StatusQueued, "", func(state utils.JobState) bool {
+			return state.Status == utils.StatusSubmitted
+		})
+		log.Info("submitted job", utils.LogKeyJobID, jobID, utils.LogKeyKey, key)
+		pending[jobID] = key
+	}
+
+	// Collect the results
+	resultQueueURL, err := utils.GetQueueURLSimple(ctx, sqsClient, myCfg.ResultQueueName)
+	if err != nil {
+		log.Error("failed to get queue URL", utils.LogKeyQueue, myCfg.ResultQueueName, utils.LogKeyError, err)
+		os.Exit(1)
+	}
+	total := make(map[string]int)
+	done := make(map[utils.JobID]bool, len(pending))
+	cancelled := 0
+	lastCheck := time.Now()
+	for len(pending) > 0 {
+		if time.Since(lastCheck) >= stateCheckInterval {
+			cancelled += dropCancelled(ctx, s3Client, myCfg.ResultBucketName, pending)
+			lastCheck = time.Now()
+		}
+		wait := *waitTime
+		if deadline != nil {
+			left := time.Until(*deadline)
+			if left <= 0 {
+				break
+			}
+			// Do not wait past the deadline
+			if left < time.Duration(wait)*time.Second {
+				wait = int((left + time.Second - 1) / time.Second)
+			}
+		}
+		// A batch, so that the results released for the other clients do
+		// not keep those of the client from it
+		resp, err := utils.GetLPMessagesByURL(ctx, sqsClient, resultQueueURL, 10, wait)
+		if err != nil {
+			log.Warn("failed to receive messages", utils.LogKeyQueue, myCfg.ResultQueueName, utils.LogKeyError, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, msg := range resp.Messages {
+			result, err := utils.DecodeResult(aws.ToString(msg.Body))
+			if err == nil && done[result.JobID] {
+				// Report of a job delivered more than once, its counts are added already
+				log.Debug("dropped duplicate result", utils.LogKeyJobID, result.JobID)
+				if err := utils.RemoveMessageSimple(ctx, sqsClient, resultQueueURL, *msg.ReceiptHandle); err != nil {
+					log.Error("failed to delete message", utils.LogKeyQueue, myCfg.ResultQueueName, utils.LogKeyError, err)
+				}
+				continue
+			}
+			if err != nil {
+				// It becomes visible again once its visibility timeout expires
+				log.Warn("dropped malformed result", utils.LogKeyQueue, myCfg.ResultQueueName, utils.LogKeyError, err)
+				continue
+			}
+			if pending[result.JobID] == "" {
+				// Result of another client, it is made visible again for
+				// that client to receive it now
+				if err := utils.ChangeVisibilitySimple(ctx, sqsClient, resultQueueURL, *msg.ReceiptHandle, 0); err != nil {
+					log.Warn("failed to release message", utils.LogKeyJobID, result.JobID, utils.LogKeyQueue, myCfg.ResultQueueName, utils.LogKeyError, err)
+				}
+				continue
+			}
+			counts, err := utils.FetchCounts(ctx, s3Client, result)
+			if err != nil {
+				log.Error("failed to fetch result", utils.LogKeyJobID, result.JobID, utils.LogKeyError, err)
+				continue
+			}
+			counter.Merge(total, counts)
+			delete(pending, result.JobID)
+			done[result.JobID] = true
+			log.Info("got job result", utils.LogKeyJobID, result.JobID, utils.LogKeyKey, result.Key, utils.LogKeyWorkerID, result.WorkerID, "left", len(pending))
+			if err := utils.RemoveMessageSimple(ctx, sqsClient, resultQueueURL, *msg.ReceiptHandle); err != nil {
+				log.Error("failed to delete message", utils.LogKeyQueue, myCfg.ResultQueueName, utils.LogKeyError, err)
+			}
+		}
+	}
+
+	utils.LogRetryMetrics(log)
+	if len(pending) > 0 {
+		reportMissing(ctx, s3Client, myCfg.ResultBucketName, pending)
+		if !*partial {
+			os.Exit(1)
+		}
+	}
+	printCounts(total, *top)
+	if cancelled > 0 || len(pending) > 0 {
+		os.Exit(1)
+	}
+}
+
+// setup makes the utils functions log at logLevel to stderr, and returns the
+// config read from cfgPath, the clients of its backend and the logger. It exits
+// if any of them fails.
+func setup(cfgPath string, logLevel string) (utils.Config, utils.Services, *utils.JSONLogger) {
+	level, err := utils.ParseLevel(logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	log := utils.NewJSONLogger(os.Stderr, level)
+	utils.SetLogger(log)
+
+	myCfg, err := utils.LoadConfig(cfgPath)
+	if err != nil {
+		log.Error("failed to load config", utils.LogKeyError, err)
+		os.Exit(1)
+	}
+	services, err := utils.NewServices(myCfg)
+	if err != nil {
+		log.Error("failed to create service clients", utils.LogKeyError, err)
+		os.Exit(1)
+	}
+	return myCfg, services, log
+}
+
+// uploadFile puts the local file at path into bucket under the ID of its job
+// jobID, so that the files of the same name do not overwrite each other, and
+// returns its object key.
+func uploadFile(ctx context.Context, client utils.S3PutObjectAPI, bucket string, jobID utils.JobID, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open '%s': %v", path, err)
+	}
+	defer file.Close()
+
+	key := jobID.String() + "/" + filepath.Base(path)
+	_, err = utils.PutFile(ctx, client, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   file,
+	})
+	if err != nil {
+		return "", utils.WrapError("PutObject", utils.ObjectName(bucket, key), err)
+	}
+	return key, nil
+}
+
+// printCounts prints the words by descending count, then alphabetically.
+func printCounts(counts map[string]int, top int) {
+	words := make([]string, 0, len(counts))
+	for word := range counts {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if counts[words[i]] != counts[words[j]] {
+			return counts[words[i]] > counts[words[j]]
+		}
+		return words[i] < words[j]
+	})
+	if top > 0 && top < len(words) {
+		words = words[:top]
+	}
+	for _, word := range words {
+		fmt.Printf("%-20s %d\n", word, counts[word])
+	}
+}
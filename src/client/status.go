@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"wordcounter/src/utils"
+)
+
+// statusCommand prints the state of jobs.
+func statusCommand(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	cfgPath := flags.String("config", "config/config.json", "path of the JSON config file")
+	logLevel := flags.String("log-level", "warn", "lowest level of the records logged to stderr: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s status [flags] jobId...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	ids := parseInterspersed(flags, args)
+	if len(ids) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	myCfg, services, log := setup(*cfgPath, *logLevel)
+	ctx := context.Background()
+	failed := false
+	for i, arg := range ids {
+		id, err := utils.ParseJobID(arg)
+		if err != nil {
+			log.Error("invalid job id", utils.LogKeyJobID, arg, utils.LogKeyError, err)
+			failed = true
+			continue
+		}
+		state, err := utils.LoadJobState(ctx, services.S3, myCfg.ResultBucketName, id)
+		if err != nil {
+			log.Error("failed to load job state", utils.LogKeyJobID, id, utils.LogKeyError, err)
+			failed = true
+			continue
+		}
+		if state == nil {
+			log.Error("job not found", utils.LogKeyJobID, id)
+			failed = true
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		printState(os.Stdout, *state)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// parseInterspersed parses the flags of args, which may come before or after
+// the other arguments, and returns the other arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var rest []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return rest
+		}
+		rest = append(rest, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// printState writes the state of a job and its history.
+func printState(w io.Writer, state utils.JobState) {
+	out := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(out, "Job:\t%s\n", state.JobID)
+	fmt.Fprintf(out, "Status:\t%s\n", state.Status)
+	if state.Key != "" {
+		fmt.Fprintf(out, "Object:\t%s\n", utils.ObjectName(state.Bucket, state.Key))
+	}
+	if state.WorkerID != "" {
+		fmt.Fprintf(out, "Worker:\t%s\n", state.WorkerID)
+	}
+	if i := state.Instance; i != nil {
+		fmt.Fprintf(out, "Instance:\t%s %s in %s, IPs %s %s\n", orDash(i.InstanceID), orDash(i.InstanceType),
+			orDash(i.AvailabilityZone), orDash(i.PrivateIP), orDash(i.PublicIP))
+	}
+	if state.SubJobs != nil {
+		fmt.Fprintf(out, "Sub-jobs:\t%d/%d done\n", state.SubJobs.Done, state.SubJobs.Total)
+	}
+	if state.Reason != "" {
+		fmt.Fprintf(out, "Reason:\t%s\n", oneLine(state.Reason))
+	}
+	if state.ResultKey != "" {
+		fmt.Fprintf(out, "Result:\t%s\n", state.ResultKey)
+	}
+	fmt.Fprintf(out, "Updated:\t%s\n", state.Updated.Format(time.RFC3339))
+	out.Flush()
+
+	fmt.Fprintln(w, "History:")
+	out = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, change := range state.History {
+		fmt.Fprintf(out, "  %s\t%s\t%s", change.Time.Format(time.RFC3339), change.Status, orDash(change.WorkerID))
+		if change.Reason != "" {
+			fmt.Fprintf(out, "\t%s", oneLine(change.Reason))
+		}
+		fmt.Fprintln(out)
+	}
+	out.Flush()
+}
+
+// reportMissing logs the jobs of pending, with the progress of their
+// sub-jobs and the byte ranges of those missing, when the client gives up on
+// them at their deadline.
+func reportMissing(ctx context.Context, client utils.S3GetObjectAPI, bucket string, pending map[utils.JobID]string) {
+	for id, key := range pending {
+		args := []interface{}{utils.LogKeyJobID, id, utils.LogKeyKey, key}
+		state, err := utils.LoadJobState(ctx, client, bucket, id)
+		if err != nil {
+			utils.Log().Warn("failed to load job state", utils.LogKeyJobID, id, utils.LogKeyError, err)
+		}
+		if state != nil {
+			args = append(args, "status", state.Status)
+			if state.SubJobs != nil {
+				args = append(args, "sub_jobs_done", state.SubJobs.Done, "sub_jobs", state.SubJobs.Total)
+				if len(state.SubJobs.Pending) > 0 {
+					missing := make([]string, 0, len(state.SubJobs.Pending))
+					for _, rng := range state.SubJobs.Pending {
+						missing = append(missing, rng.String())
+					}
+					args = append(args, "missing_ranges", missing)
+				}
+			}
+		}
+		utils.Log().Error("job not done by the deadline", args...)
+	}
+}
+
+// recordStatus sets the status of a job in its persistent state if allow, when
+// not nil, accepts its current state. The failures are only logged, the state
+// is informative.
+func recordStatus(ctx context.Context, client utils.S3API, bucket string, job utils.JobMessage, status utils.JobStatus, reason string, allow func(utils.JobState) bool) {
+	_, err := utils.UpdateJobState(ctx, client, bucket, job.JobID, func(state *utils.JobState) bool {
+		if allow != nil && !allow(*state) {
+			return false
+		}
+		if !state.Set(status, "", reason, time.Now()) {
+			return false
+		}
+		if state.Bucket == "" {
+			state.Bucket, state.Key = job.Bucket, job.Key
+		}
+		return true
+	})
+	if err != nil {
+		utils.Log().Warn("failed to save job state", utils.LogKeyJobID, job.JobID, "status", status, utils.LogKeyError, err)
+	}
+}
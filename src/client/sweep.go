@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"wordcounter/src/utils"
+)
+
+// sweepCommand moves the jobs left in the queues of the dead workers to the
+// job queue once. The autoscaler does it at each of its checks.
+func sweepCommand(args []string) {
+	flags := flag.NewFlagSet("sweep", flag.ExitOnError)
+	cfgPath := flags.String("config", "config/config.json", "path of the JSON config file")
+	logLevel := flags.String("log-level", "info", "lowest level of the records logged to stderr: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s sweep [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	myCfg, services, log := setup(*cfgPath, *logLevel)
+	sqsClient, ok := services.SQS.(utils.WorkerQueueSweepAPI)
+	if !ok {
+		log.Error("the backend has no queue attributes", "backend", myCfg.Backend)
+		os.Exit(2)
+	}
+	if myCfg.Routing != utils.RoutingQueue {
+		log.Info("the jobs are not routed by queue, there is nothing to sweep")
+		return
+	}
+	moved, err := utils.SweepWorkerQueues(context.Background(), sqsClient, services.S3, myCfg, time.Now())
+	if err != nil {
+		log.Error("failed to sweep the queues of the workers", "jobs", moved, utils.LogKeyError, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Moved %d jobs to %s\n", moved, myCfg.JobQueueName)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"wordcounter/src/utils"
+)
+
+// userDataCommand prints the user data script of the worker instances.
+func userDataCommand(args []string) {
+	flags := flag.NewFlagSet("userdata", flag.ExitOnError)
+	cfgPath := flags.String("config", "config/config.json", "path of the JSON config file")
+	encode := flags.Bool("base64", false, "print the script base64 encoded, as RunInstances expects it")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s userdata [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	myCfg, err := utils.LoadConfig(*cfgPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	bootstrap := launchTemplate(myCfg).Bootstrap
+	if bootstrap == nil {
+		fmt.Fprintln(os.Stderr, "the config has no Launch.Bootstrap")
+		os.Exit(1)
+	}
+	script, err := bootstrap.Script()
+	if *encode && err == nil {
+		script, err = bootstrap.UserData()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(script)
+	if *encode {
+		fmt.Println()
+	}
+}
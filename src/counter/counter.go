@@ -0,0 +1,273 @@
+// Package counter implements the streaming word counting engine shared by
+// every worker, so that all deployments split text into words the same way.
+package counter
+
+import (
+	"io"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultMaxWordBytes is the longest word kept when Options.MaxWordBytes is zero.
+const DefaultMaxWordBytes = 256
+
+// Options configures how text is split into words.
+// The zero value gives the default rules used by the golden fixture:
+//   - words are runs of letters and digits, folded to lower case;
+//   - an apostrophe between two word characters belongs to the word (don't, Alice's),
+//     any other apostrophe or backtick is a quote and is dropped (`Oh dear!');
+//   - a single hyphen between two word characters joins them (Rabbit-Hole),
+//     also when the line breaks right after it (WAISTCOAT-\nPOCKET),
+//     while a double hyphen separates words (dear--);
+//   - everything else separates words.
+type Options struct {
+	// CaseSensitive keeps the case of the text instead of folding to lower case.
+	CaseSensitive bool `json:"caseSensitive,omitempty"`
+	// SplitHyphens counts the parts of hyphenated words separately.
+	SplitHyphens bool `json:"splitHyphens,omitempty"`
+	// IgnoreNumbers only treats letters as word characters.
+	IgnoreNumbers bool `json:"ignoreNumbers,omitempty"`
+	// MinLength skips words shorter than this many characters.
+	MinLength int `json:"minLength,omitempty"`
+	// MaxWordBytes skips words longer than this many bytes, bounding the memory
+	// used by a single word. Zero means DefaultMaxWordBytes.
+	MaxWordBytes int `json:"maxWordBytes,omitempty"`
+}
+
+type state int
+
+const (
+	stateSpace      state = iota // between words
+	stateWord                    // inside a word
+	stateApostrophe              // inside a word, right after an apostrophe
+	stateHyphen                  // inside a word, right after a hyphen
+	stateLineBreak               // inside a word, after a hyphen and a line break
+)
+
+// Counter counts the words written to it. The text may be written in chunks of
+// any size, words and UTF-8 sequences split between two writes are handled.
+type Counter struct {
+	opts   Options
+	counts map[string]int
+
+	state   state
+	word    []byte
+	runes   int
+	tooLong bool
+	partial []byte
+
+	offset     int64 // bytes fed to the state machine so far
+	wordOffset int64 // offset where the current word started
+}
+
+// New returns an empty Counter using opts.
+func New(opts Options) *Counter {
+	if opts.MaxWordBytes <= 0 {
+		opts.MaxWordBytes = DefaultMaxWordBytes
+	}
+	return &Counter{
+		opts:   opts,
+		counts: make(map[string]int),
+		word:   make([]byte, 0, 32),
+	}
+}
+
+// Count reads r until EOF and returns the number of occurrences of every word.
+func Count(r io.Reader, opts Options) (map[string]int, error) {
+	c := New(opts)
+	if _, err := io.Copy(c, r); err != nil {
+		return nil, err
+	}
+	c.Flush()
+	return c.Counts(), nil
+}
+
+// Merge adds the counts of src to dst.
+func Merge(dst map[string]int, src map[string]int) {
+	for word, n := range src {
+		dst[word] += n
+	}
+}
+
+// NextBoundary returns the first offset of p where the text can be cut in two
+// parts counted separately without changing the counts, whatever the Options,
+// or -1 if there is none in p. The cut is placed at the start of a word, after
+// some ASCII white space not preceded by a hyphen, which could join the words
+// around a line break. ASCII bytes never occur inside UTF-8 sequences, so the
+// cut never splits a character either.
+func NextBoundary(p []byte) int {
+	last := byte(0) // last non-space byte seen, 0 if none yet
+	for i := 0; i < len(p); i++ {
+		if isSpace(p[i]) {
+			continue
+		}
+		if i > 0 && isSpace(p[i-1]) && last != 0 && last != '-' {
+			return i
+		}
+		last = p[i]
+	}
+	return -1
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f' || b == '\v'
+}
+
+// Write counts the words of p. It never returns an error.
+func (c *Counter) Write(p []byte) (int, error) {
+	n := len(p)
+	if k := len(c.partial); k > 0 {
+		// Finish the rune left over by the previous write
+		head := p
+		if len(head) > utf8.UTFMax {
+			head = head[:utf8.UTFMax]
+		}
+		head = append(c.partial, head...)
+		i := 0
+		for i < k {
+			if !utf8.FullRune(head[i:]) {
+				c.partial = append([]byte(nil), head[i:]...)
+				return n, nil
+			}
+			r, size := utf8.DecodeRune(head[i:])
+			c.step(r, size)
+			i += size
+		}
+		c.partial = c.partial[:0]
+		p = p[i-k:]
+	}
+	for len(p) > 0 {
+		if !utf8.FullRune(p) {
+			c.partial = append(c.partial[:0], p...)
+			break
+		}
+		r, size := utf8.DecodeRune(p)
+		c.step(r, size)
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// Flush ends the word in progress, as at the end of the text.
+func (c *Counter) Flush() {
+	if len(c.partial) > 0 {
+		// A truncated UTF-8 sequence separates words like any invalid byte
+		c.step(utf8.RuneError, len(c.partial))
+		c.partial = c.partial[:0]
+	}
+	c.emit()
+	c.state = stateSpace
+}
+
+// Counts returns the counts of the words ended so far. The map is owned by the
+// Counter and changes with further writes.
+func (c *Counter) Counts() map[string]int {
+	return c.counts
+}
+
+// Offset returns the number of bytes written so far.
+func (c *Counter) Offset() int64 {
+	return c.offset + int64(len(c.partial))
+}
+
+// Boundary returns the offset up to which the text has been fully counted.
+// The bytes after it belong to a word in progress which is not in Counts yet,
+// so counting can resume from Boundary with a copy of Counts.
+func (c *Counter) Boundary() int64 {
+	if c.state != stateSpace {
+		return c.wordOffset
+	}
+	return c.offset
+}
+
+// step feeds the rune r, encoded in size bytes, to the state machine.
+func (c *Counter) step(r rune, size int) {
+	switch c.state {
+	case stateWord:
+		switch {
+		case c.isWordRune(r):
+			c.appendRune(r)
+		case isApostrophe(r):
+			c.state = stateApostrophe
+		case r == '-' && !c.opts.SplitHyphens:
+			c.state = stateHyphen
+		default:
+			c.emit()
+			c.state = stateSpace
+		}
+	case stateApostrophe:
+		if c.isWordRune(r) {
+			c.appendRune('\'')
+			c.appendRune(r)
+			c.state = stateWord
+		} else {
+			c.emit()
+			c.state = stateSpace
+			c.step(r, size)
+			return
+		}
+	case stateHyphen, stateLineBreak:
+		switch {
+		case c.isWordRune(r):
+			c.appendRune('-')
+			c.appendRune(r)
+			c.state = stateWord
+		case c.state == stateHyphen && r == '\r':
+			// Wait for the '\n' of a "\r\n" line break
+		case c.state == stateHyphen && r == '\n':
+			c.state = stateLineBreak
+		case c.state == stateLineBreak && (r == ' ' || r == '\t'):
+			// Indentation of the continued line
+		default:
+			c.emit()
+			c.state = stateSpace
+			c.step(r, size)
+			return
+		}
+	default:
+		if c.isWordRune(r) {
+			c.wordOffset = c.offset
+			c.appendRune(r)
+			c.state = stateWord
+		}
+	}
+	c.offset += int64(size)
+}
+
+func (c *Counter) isWordRune(r rune) bool {
+	if unicode.IsLetter(r) {
+		return true
+	}
+	return !c.opts.IgnoreNumbers && unicode.IsDigit(r)
+}
+
+func isApostrophe(r rune) bool {
+	return r == '\'' || r == '’'
+}
+
+func (c *Counter) appendRune(r rune) {
+	c.runes++
+	if c.tooLong {
+		return
+	}
+	if !c.opts.CaseSensitive {
+		r = unicode.ToLower(r)
+	}
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	if len(c.word)+n > c.opts.MaxWordBytes {
+		c.tooLong = true
+		return
+	}
+	c.word = append(c.word, buf[:n]...)
+}
+
+// emit counts the word in progress, if any, and starts a new one.
+func (c *Counter) emit() {
+	if len(c.word) > 0 && !c.tooLong && c.runes >= c.opts.MinLength {
+		c.counts[string(c.word)]++
+	}
+	c.word = c.word[:0]
+	c.runes = 0
+	c.tooLong = false
+}
@@ -0,0 +1,251 @@
+package counter
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const (
+	corpusPath = "../../alice30.txt"
+	goldenPath = "testdata/alice30.golden"
+)
+
+func TestCount(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		opts Options
+		want map[string]int
+	}{
+		{
+			name: "QuotesAreDropped",
+			text: "`Oh dear!  Oh dear!  I shall be late!'",
+			want: map[string]int{"oh": 2, "dear": 2, "i": 1, "shall": 1, "be": 1, "late": 1},
+		},
+		{
+			name: "ApostrophesInsideWords",
+			text: "`I don't know,' said Alice's sister, `it's the Queens' croquet.'",
+			want: map[string]int{"i": 1, "don't": 1, "know": 1, "said": 1, "alice's": 1, "sister": 1, "it's": 1, "the": 1, "queens": 1, "croquet": 1},
+		},
+		{
+			name: "HyphenatedWords",
+			text: "Down the Rabbit-Hole, not the rabbit-hole--or a hole-",
+			want: map[string]int{"down": 1, "the": 2, "rabbit-hole": 2, "not": 1, "or": 1, "a": 1, "hole": 1},
+		},
+		{
+			name: "HyphenAtLineBreak",
+			text: "TOOK A WATCH OUT OF ITS WAISTCOAT-\r\n  POCKET, and looked at it-\n\nthen",
+			want: map[string]int{"took": 1, "a": 1, "watch": 1, "out": 1, "of": 1, "its": 1, "waistcoat-pocket": 1, "and": 1, "looked": 1, "at": 1, "it": 1, "then": 1},
+		},
+		{
+			name: "SplitHyphens",
+			text: "Down the Rabbit-Hole, WAISTCOAT-\nPOCKET",
+			opts: Options{SplitHyphens: true},
+			want: map[string]int{"down": 1, "the": 1, "rabbit": 1, "hole": 1, "waistcoat": 1, "pocket": 1},
+		},
+		{
+			name: "CaseSensitive",
+			text: "Alice ALICE alice",
+			opts: Options{CaseSensitive: true},
+			want: map[string]int{"Alice": 1, "ALICE": 1, "alice": 1},
+		},
+		{
+			name: "Numbers",
+			text: "EDITION 3.0 CHAPTER 12",
+			want: map[string]int{"edition": 1, "3": 1, "0": 1, "chapter": 1, "12": 1},
+		},
+		{
+			name: "IgnoreNumbers",
+			text: "EDITION 3.0 CHAPTER 12",
+			opts: Options{IgnoreNumbers: true},
+			want: map[string]int{"edition": 1, "chapter": 1},
+		},
+		{
+			name: "MinLength",
+			text: "I shall be late",
+			opts: Options{MinLength: 3},
+			want: map[string]int{"shall": 1, "late": 1},
+		},
+		{
+			name: "MaxWordBytes",
+			text: "a " + strings.Repeat("x", 20) + " b",
+			opts: Options{MaxWordBytes: 10},
+			want: map[string]int{"a": 1, "b": 1},
+		},
+		{
+			name: "Unicode",
+			text: "Ça m’étonne, ÉTÉ été",
+			want: map[string]int{"ça": 1, "m'étonne": 1, "été": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Count(strings.NewReader(tt.text), tt.opts)
+			if err != nil {
+				t.Fatalf("Count() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Count() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterChunks(t *testing.T) {
+	text := []byte("`Ça m’étonne,' said the Rabbit-Hole's WAISTCOAT-\n   POCKET--yes! ")
+	want, _ := Count(bytes.NewReader(text), Options{})
+	for size := 1; size < 8; size++ {
+		c := New(Options{})
+		for i := 0; i < len(text); i += size {
+			end := i + size
+			if end > len(text) {
+				end = len(text)
+			}
+			c.Write(text[i:end])
+		}
+		c.Flush()
+		if !reflect.DeepEqual(c.Counts(), want) {
+			t.Errorf("chunks of %d: Counts() = %v, want %v", size, c.Counts(), want)
+		}
+		if c.Offset() != int64(len(text)) {
+			t.Errorf("chunks of %d: Offset() = %d, want %d", size, c.Offset(), len(text))
+		}
+	}
+}
+
+func TestCounterBoundary(t *testing.T) {
+	text, err := ioutil.ReadFile(corpusPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := Count(bytes.NewReader(text), Options{})
+	for _, stop := range []int{1, 1000, 1803, 20001, 77777} {
+		// Count up to stop, then resume from the boundary with a copy of the counts
+		c := New(Options{})
+		c.Write(text[:stop])
+		boundary := c.Boundary()
+		got := make(map[string]int)
+		Merge(got, c.Counts())
+
+		rest, _ := Count(bytes.NewReader(text[boundary:]), Options{})
+		Merge(got, rest)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("resume at %d from boundary %d: counts differ", stop, boundary)
+		}
+	}
+}
+
+func TestNextBoundary(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"hello world", 6},
+		{"  world", -1},
+		{"lo  \n  world", 7},
+		{"WAISTCOAT-\n   POCKET, and", 22},
+		{"dear--\nOh", -1},
+		{"word", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		if got := NextBoundary([]byte(tt.text)); got != tt.want {
+			t.Errorf("NextBoundary(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+
+	// Counting the corpus in pieces cut at boundaries gives the same counts
+	text, err := ioutil.ReadFile(corpusPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []Options{{}, {SplitHyphens: true}, {CaseSensitive: true}} {
+		want, _ := Count(bytes.NewReader(text), opts)
+		got := make(map[string]int)
+		start := 0
+		for start < len(text) {
+			end := len(text)
+			if next := start + 997; next < len(text) {
+				if i := NextBoundary(text[next:]); i >= 0 {
+					end = next + i
+				}
+			}
+			part, _ := Count(bytes.NewReader(text[start:end]), opts)
+			Merge(got, part)
+			start = end
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("counts of pieces with %+v differ from the whole text", opts)
+		}
+	}
+}
+
+func TestGoldenCounts(t *testing.T) {
+	text, err := ioutil.ReadFile(corpusPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Count(bytes.NewReader(text), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := ioutil.WriteFile(goldenPath, formatCounts(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			t.Fatalf("malformed golden line '%s'", scanner.Text())
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[fields[0]] = n
+	}
+	if !reflect.DeepEqual(got, want) {
+		for word, n := range want {
+			if got[word] != n {
+				t.Errorf("count of '%s' = %d, want %d", word, got[word], n)
+			}
+		}
+		for word, n := range got {
+			if _, ok := want[word]; !ok {
+				t.Errorf("unexpected word '%s' counted %d times", word, n)
+			}
+		}
+	}
+}
+
+// formatCounts writes one "word count" line per word, sorted by word.
+func formatCounts(counts map[string]int) []byte {
+	words := make([]string, 0, len(counts))
+	for word := range counts {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	var buf bytes.Buffer
+	for _, word := range words {
+		fmt.Fprintf(&buf, "%s %d\n", word, counts[word])
+	}
+	return buf.Bytes()
+}
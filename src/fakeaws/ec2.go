@@ -0,0 +1,358 @@
+package fakeaws
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+// State codes of the instances
+var stateCodes = map[types.InstanceStateName]int32{
+	types.InstanceStateNamePending:      0,
+	types.InstanceStateNameRunning:      16,
+	types.InstanceStateNameShuttingDown: 32,
+	types.InstanceStateNameTerminated:   48,
+	types.InstanceStateNameStopping:     64,
+	types.InstanceStateNameStopped:      80,
+}
+
+// EC2 is an in-memory Amazon EC2 service. State changes take effect at once,
+// started instances are running and stopped instances are stopped.
+// Requests with DryRun set fail with a DryRunOperation error, as they do
+// when the caller has the required permissions.
+type EC2 struct {
+	Faults
+
+	mu        sync.Mutex
+	instances []types.Instance
+	seq       int
+}
+
+// NewEC2 returns a service with instances.
+func NewEC2(instances ...types.Instance) *EC2 {
+	return &EC2{
+		Faults:    Faults{service: "EC2"},
+		instances: append([]types.Instance(nil), instances...),
+	}
+}
+
+// NewInstance returns an instance in state with a Name tag and IP addresses.
+func NewInstance(id, name string, state types.InstanceStateName, publicIP, privateIP string) types.Instance {
+	i := types.Instance{
+		InstanceId: aws.String(id),
+		State:      &types.InstanceState{Code: stateCodes[state], Name: state},
+		Tags:       []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+	}
+	if publicIP != "" {
+		i.PublicIpAddress = aws.String(publicIP)
+	}
+	if privateIP != "" {
+		i.PrivateIpAddress = aws.String(privateIP)
+	}
+	return i
+}
+
+// DryRunError returns the error of a request with DryRun set that would have succeeded.
+func DryRunError() error {
+	return &smithy.GenericAPIError{Code: "DryRunOperation", Message: "Request would have succeeded, but DryRun flag is set."}
+}
+
+// Instances returns a copy of the instances.
+func (e *EC2) Instances() []types.Instance {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]types.Instance(nil), e.instances...)
+}
+
+// DescribeInstances returns the instances matching InstanceIds and Filters,
+// MaxResults at a time. The filters instance-id, instance-state-name,
+// tag-key and tag:<key> are supported.
+func (e *EC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	if err := e.call(ctx, "DescribeInstances"); err != nil {
+		return nil, err
+	}
+	if params.DryRun {
+		return nil, e.wrap("DescribeInstances", DryRunError())
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var matching []types.Instance
+	for _, i := range e.instances {
+		if len(params.InstanceIds) > 0 && !contains(params.InstanceIds, aws.ToString(i.InstanceId)) {
+			continue
+		}
+		if matchFilters(i, params.Filters) {
+			matching = append(matching, i)
+		}
+	}
+	start := 0
+	if params.NextToken != nil {
+		n, err := strconv.Atoi(*params.NextToken)
+		if err != nil || n < 0 || n > len(matching) {
+			return nil, e.wrap("DescribeInstances", &smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "invalid NextToken"})
+		}
+		start = n
+	}
+	end := len(matching)
+	out := &ec2.DescribeInstancesOutput{}
+	if params.MaxResults > 0 && start+int(params.MaxResults) < end {
+		end = start + int(params.MaxResults)
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	// One reservation per instance, as for instances launched one by one
+	for _, i := range matching[start:end] {
+		out.Reservations = append(out.Reservations, types.Reservation{
+			ReservationId: aws.String("r-" + strings.TrimPrefix(aws.ToString(i.InstanceId), "i-")),
+			Instances:     []types.Instance{i},
+		})
+	}
+	return out, nil
+}
+
+// RunInstances launches MinCount running instances with the tags of TagSpecifications.
+func (e *EC2) RunInstances(ctx context.Context, params *ec2.RunInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RunInstancesOutput, error) {
+	if err := e.call(ctx, "RunInstances"); err != nil {
+		return nil, err
+	}
+	if params.DryRun {
+		return nil, e.wrap("RunInstances", DryRunError())
+	}
+	if params.MinCount < 1 || params.MaxCount < params.MinCount {
+		return nil, e.wrap("RunInstances", &smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "invalid instance count"})
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var tags []types.Tag
+	for _, spec := range params.TagSpecifications {
+		if spec.ResourceType == types.ResourceTypeInstance {
+			tags = append(tags, spec.Tags...)
+		}
+	}
+	out := &ec2.RunInstancesOutput{ReservationId: aws.String(fmt.Sprintf("r-%08d", e.seq+1))}
+	for n := int32(0); n < params.MinCount; n++ {
+		e.seq++
+		i := types.Instance{
+			InstanceId:       aws.String(fmt.Sprintf("i-%08d", e.seq)),
+			ImageId:          params.ImageId,
+			InstanceType:     params.InstanceType,
+			LaunchTime:       aws.Time(time.Now()),
+			PrivateIpAddress: aws.String(fmt.Sprintf("10.0.%d.%d", e.seq/256, e.seq%256)),
+			State:            &types.InstanceState{Code: stateCodes[types.InstanceStateNameRunning], Name: types.InstanceStateNameRunning},
+			Tags:             append([]types.Tag(nil), tags...),
+		}
+		e.instances = append(e.instances, i)
+		out.Instances = append(out.Instances, i)
+	}
+	return out, nil
+}
+
+// CreateTags adds or replaces tags of instances.
+func (e *EC2) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	if err := e.call(ctx, "CreateTags"); err != nil {
+		return nil, err
+	}
+	if params.DryRun {
+		return nil, e.wrap("CreateTags", DryRunError())
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	indexes, err := e.find("CreateTags", params.Resources)
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range indexes {
+		i := &e.instances[idx]
+		for _, tag := range params.Tags {
+			replaced := false
+			for t := range i.Tags {
+				if aws.ToString(i.Tags[t].Key) == aws.ToString(tag.Key) {
+					i.Tags[t].Value = tag.Value
+					replaced = true
+				}
+			}
+			if !replaced {
+				i.Tags = append(i.Tags, tag)
+			}
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// StartInstances starts instances.
+func (e *EC2) StartInstances(ctx context.Context, params *ec2.StartInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StartInstancesOutput, error) {
+	changes, err := e.changeState(ctx, "StartInstances", params.InstanceIds, params.DryRun, types.InstanceStateNameRunning)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StartInstancesOutput{StartingInstances: changes}, nil
+}
+
+// StopInstances stops instances.
+func (e *EC2) StopInstances(ctx context.Context, params *ec2.StopInstancesInput, optFns ...func(*ec2.Options)) (*ec2.StopInstancesOutput, error) {
+	changes, err := e.changeState(ctx, "StopInstances", params.InstanceIds, params.DryRun, types.InstanceStateNameStopped)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StopInstancesOutput{StoppingInstances: changes}, nil
+}
+
+// TerminateInstances terminates instances.
+func (e *EC2) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	changes, err := e.changeState(ctx, "TerminateInstances", params.InstanceIds, params.DryRun, types.InstanceStateNameTerminated)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.TerminateInstancesOutput{TerminatingInstances: changes}, nil
+}
+
+// RebootInstances reboots instances, which stay running.
+func (e *EC2) RebootInstances(ctx context.Context, params *ec2.RebootInstancesInput, optFns ...func(*ec2.Options)) (*ec2.RebootInstancesOutput, error) {
+	if _, err := e.changeState(ctx, "RebootInstances", params.InstanceIds, params.DryRun, ""); err != nil {
+		return nil, err
+	}
+	return &ec2.RebootInstancesOutput{}, nil
+}
+
+// MonitorInstances enables the detailed monitoring of instances.
+func (e *EC2) MonitorInstances(ctx context.Context, params *ec2.MonitorInstancesInput, optFns ...func(*ec2.Options)) (*ec2.MonitorInstancesOutput, error) {
+	monitorings, err := e.monitor(ctx, "MonitorInstances", params.InstanceIds, params.DryRun, types.MonitoringStateEnabled)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.MonitorInstancesOutput{InstanceMonitorings: monitorings}, nil
+}
+
+// UnmonitorInstances disables the detailed monitoring of instances.
+func (e *EC2) UnmonitorInstances(ctx context.Context, params *ec2.UnmonitorInstancesInput, optFns ...func(*ec2.Options)) (*ec2.UnmonitorInstancesOutput, error) {
+	monitorings, err := e.monitor(ctx, "UnmonitorInstances", params.InstanceIds, params.DryRun, types.MonitoringStateDisabled)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.UnmonitorInstancesOutput{InstanceMonitorings: monitorings}, nil
+}
+
+// changeState moves instances to state, an empty state leaves them unchanged.
+func (e *EC2) changeState(ctx context.Context, op string, ids []string, dryRun bool, state types.InstanceStateName) ([]types.InstanceStateChange, error) {
+	if err := e.call(ctx, op); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return nil, e.wrap(op, DryRunError())
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	indexes, err := e.find(op, ids)
+	if err != nil {
+		return nil, err
+	}
+	var changes []types.InstanceStateChange
+	for _, idx := range indexes {
+		i := &e.instances[idx]
+		previous := *i.State
+		if state != "" {
+			i.State = &types.InstanceState{Code: stateCodes[state], Name: state}
+		}
+		current := *i.State
+		changes = append(changes, types.InstanceStateChange{
+			InstanceId:    i.InstanceId,
+			PreviousState: &previous,
+			CurrentState:  &current,
+		})
+	}
+	return changes, nil
+}
+
+func (e *EC2) monitor(ctx context.Context, op string, ids []string, dryRun bool, state types.MonitoringState) ([]types.InstanceMonitoring, error) {
+	if err := e.call(ctx, op); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return nil, e.wrap(op, DryRunError())
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	indexes, err := e.find(op, ids)
+	if err != nil {
+		return nil, err
+	}
+	var monitorings []types.InstanceMonitoring
+	for _, idx := range indexes {
+		i := &e.instances[idx]
+		i.Monitoring = &types.Monitoring{State: state}
+		monitorings = append(monitorings, types.InstanceMonitoring{InstanceId: i.InstanceId, Monitoring: i.Monitoring})
+	}
+	return monitorings, nil
+}
+
+// find returns the indexes of the instances with ids.
+func (e *EC2) find(op string, ids []string) ([]int, error) {
+	var indexes []int
+	for _, id := range ids {
+		found := false
+		for idx, i := range e.instances {
+			if aws.ToString(i.InstanceId) == id {
+				indexes = append(indexes, idx)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, e.wrap(op, &smithy.GenericAPIError{Code: "InvalidInstanceID.NotFound", Message: "the instance ID '" + id + "' does not exist"})
+		}
+	}
+	return indexes, nil
+}
+
+// matchFilters reports whether the instance matches all the filters.
+func matchFilters(i types.Instance, filters []types.Filter) bool {
+	for _, f := range filters {
+		name := aws.ToString(f.Name)
+		switch {
+		case name == "instance-id":
+			if !contains(f.Values, aws.ToString(i.InstanceId)) {
+				return false
+			}
+		case name == "instance-state-name":
+			if i.State == nil || !contains(f.Values, string(i.State.Name)) {
+				return false
+			}
+		case name == "tag-key":
+			found := false
+			for _, t := range i.Tags {
+				found = found || contains(f.Values, aws.ToString(t.Key))
+			}
+			if !found {
+				return false
+			}
+		case strings.HasPrefix(name, "tag:"):
+			found := false
+			for _, t := range i.Tags {
+				found = found || (aws.ToString(t.Key) == name[len("tag:"):] && contains(f.Values, aws.ToString(t.Value)))
+			}
+			if !found {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
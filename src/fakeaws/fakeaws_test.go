@@ -0,0 +1,267 @@
+package fakeaws
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+)
+
+func TestFaults(t *testing.T) {
+	s := NewSQS("jobs")
+	s.Inject("GetQueueUrl", Throttle(SQSThrottlingCode, 2))
+	s.Inject("GetQueueUrl", Fail(&types.QueueDoesNotExist{}, 1))
+	input := &sqs.GetQueueUrlInput{QueueName: aws.String("jobs")}
+
+	for n := 0; n < 2; n++ {
+		_, err := s.GetQueueUrl(context.TODO(), input)
+		var apiErr smithy.APIError
+		if !errors.As(err, &apiErr) || apiErr.ErrorCode() != SQSThrottlingCode {
+			t.Fatalf("call %d error = %v, want %s", n, err, SQSThrottlingCode)
+		}
+		var opErr *smithy.OperationError
+		if !errors.As(err, &opErr) || opErr.Operation() != "GetQueueUrl" || opErr.Service() != "SQS" {
+			t.Errorf("call %d error = %v, want an SQS GetQueueUrl operation error", n, err)
+		}
+	}
+	var notExist *types.QueueDoesNotExist
+	if _, err := s.GetQueueUrl(context.TODO(), input); !errors.As(err, &notExist) {
+		t.Errorf("third call error = %v, want QueueDoesNotExist", err)
+	}
+	if _, err := s.GetQueueUrl(context.TODO(), input); err != nil {
+		t.Errorf("call after the faults error = %v", err)
+	}
+	if calls := s.Calls("GetQueueUrl"); calls != 4 {
+		t.Errorf("Calls() = %d, want 4", calls)
+	}
+
+	// A fault without Times applies until Clear
+	s.Inject("GetQueueUrl", Fail(errors.New("broken"), 0))
+	for n := 0; n < 3; n++ {
+		if _, err := s.GetQueueUrl(context.TODO(), input); err == nil {
+			t.Fatalf("call %d with a permanent fault succeeded", n)
+		}
+	}
+	s.Clear()
+	if _, err := s.GetQueueUrl(context.TODO(), input); err != nil {
+		t.Errorf("call after Clear() error = %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	s := NewS3("data")
+	s.Inject("HeadObject", Timeout(time.Hour, 1))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := s.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("data"), Key: aws.String("k")})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("HeadObject() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	s.Inject("HeadObject", Timeout(time.Millisecond, 1))
+	_, err = s.HeadObject(context.TODO(), &s3.HeadObjectInput{Bucket: aws.String("data"), Key: aws.String("k")})
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("HeadObject() error = %v, want a TimeoutError", err)
+	}
+}
+
+func TestSQSDuplicateDelivery(t *testing.T) {
+	s := NewSQS("jobs")
+	ctx := context.TODO()
+	url := aws.String(QueueURL("jobs"))
+	if _, err := s.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: url, MessageBody: aws.String("job")}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	s.DuplicateNext(1)
+
+	var handles []string
+	for n := 0; n < 2; n++ {
+		out, err := s.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{QueueUrl: url})
+		if err != nil || len(out.Messages) != 1 {
+			t.Fatalf("receive %d = %v, %v, want the message", n, out, err)
+		}
+		handles = append(handles, *out.Messages[0].ReceiptHandle)
+	}
+	if out, _ := s.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{QueueUrl: url}); len(out.Messages) != 0 {
+		t.Errorf("third receive got %d messages, want none", len(out.Messages))
+	}
+	for _, handle := range handles {
+		if _, err := s.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: url, ReceiptHandle: aws.String(handle)}); err != nil {
+			t.Errorf("DeleteMessage(%s) error = %v", handle, err)
+		}
+	}
+	if msgs := s.Messages("jobs"); len(msgs) != 0 {
+		t.Errorf("Messages() = %v, want none", msgs)
+	}
+}
+
+func TestSQSLongPoll(t *testing.T) {
+	s := NewSQS("jobs")
+	url := aws.String(QueueURL("jobs"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.SendMessage(context.TODO(), &sqs.SendMessageInput{QueueUrl: url, MessageBody: aws.String("late")})
+	}()
+	out, err := s.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{QueueUrl: url, WaitTimeSeconds: 5})
+	if err != nil || len(out.Messages) != 1 || *out.Messages[0].Body != "late" {
+		t.Errorf("ReceiveMessage() = %v, %v, want the late message", out, err)
+	}
+}
+
+func TestS3(t *testing.T) {
+	s := NewS3("data")
+	ctx := context.TODO()
+	for _, key := range []string{"b", "a", "c", "other"} {
+		_, err := s.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("data"), Key: aws.String(key), Body: strings.NewReader("0123456789")})
+		if err != nil {
+			t.Fatalf("PutObject(%s) error = %v", key, err)
+		}
+	}
+	out, err := s.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("data"), Key: aws.String("a"), Range: aws.String("bytes=3-5")})
+	if err != nil {
+		t.Fatalf("GetObject() error = %v", err)
+	}
+	body, _ := ioutil.ReadAll(out.Body)
+	if string(body) != "345" || out.ContentLength != 3 {
+		t.Errorf("GetObject() = %q (%d bytes), want %q", body, out.ContentLength, "345")
+	}
+
+	var keys []string
+	input := &s3.ListObjectsV2Input{Bucket: aws.String("data"), MaxKeys: 2}
+	for {
+		list, err := s.ListObjectsV2(ctx, input)
+		if err != nil {
+			t.Fatalf("ListObjectsV2() error = %v", err)
+		}
+		for _, obj := range list.Contents {
+			keys = append(keys, *obj.Key)
+		}
+		if !list.IsTruncated {
+			break
+		}
+		input.ContinuationToken = list.NextContinuationToken
+	}
+	if strings.Join(keys, ",") != "a,b,c,other" {
+		t.Errorf("ListObjectsV2() keys = %v", keys)
+	}
+}
+
+func TestEC2(t *testing.T) {
+	e := NewEC2(
+		NewInstance("i-1", "worker1", ec2types.InstanceStateNameRunning, "1.2.3.4", "10.0.0.1"),
+		NewInstance("i-2", "worker2", ec2types.InstanceStateNameStopped, "", "10.0.0.2"),
+		NewInstance("i-3", "client", ec2types.InstanceStateNameRunning, "1.2.3.5", "10.0.0.3"),
+	)
+	ctx := context.TODO()
+	_, err := e.DescribeInstances(ctx, &ec2.DescribeInstancesInput{DryRun: true})
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "DryRunOperation" {
+		t.Errorf("DescribeInstances() with DryRun error = %v, want DryRunOperation", err)
+	}
+
+	out, err := e.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("instance-state-name"), Values: []string{"running"}},
+			{Name: aws.String("tag:Name"), Values: []string{"worker1", "worker2"}},
+		},
+	})
+	if err != nil || len(out.Reservations) != 1 || *out.Reservations[0].Instances[0].InstanceId != "i-1" {
+		t.Errorf("DescribeInstances() with filters = %v, %v, want i-1", out, err)
+	}
+
+	var ids []string
+	input := &ec2.DescribeInstancesInput{MaxResults: 2}
+	for {
+		out, err := e.DescribeInstances(ctx, input)
+		if err != nil {
+			t.Fatalf("DescribeInstances() error = %v", err)
+		}
+		for _, r := range out.Reservations {
+			for _, i := range r.Instances {
+				ids = append(ids, *i.InstanceId)
+			}
+		}
+		if out.NextToken == nil {
+			break
+		}
+		input.NextToken = out.NextToken
+	}
+	if strings.Join(ids, ",") != "i-1,i-2,i-3" {
+		t.Errorf("DescribeInstances() pages = %v", ids)
+	}
+
+	run, err := e.RunInstances(ctx, &ec2.RunInstancesInput{MinCount: 2, MaxCount: 2, ImageId: aws.String("ami-1")})
+	if err != nil || len(run.Instances) != 2 {
+		t.Fatalf("RunInstances() = %v, %v, want 2 instances", run, err)
+	}
+	if _, err := e.StopInstances(ctx, &ec2.StopInstancesInput{InstanceIds: []string{"i-1", "missing"}}); err == nil {
+		t.Errorf("StopInstances() of a missing instance succeeded")
+	}
+	if len(e.Instances()) != 5 {
+		t.Errorf("Instances() = %d instances, want 5", len(e.Instances()))
+	}
+}
+
+func TestSQSFIFO(t *testing.T) {
+	s := NewSQS("jobs.fifo")
+	ctx := context.TODO()
+	url := aws.String(QueueURL("jobs.fifo"))
+	send := func(dedupID string, group string, body string) error {
+		_, err := s.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: url, MessageBody: aws.String(body),
+			MessageDeduplicationId: aws.String(dedupID), MessageGroupId: aws.String(group)})
+		return err
+	}
+	if _, err := s.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: url, MessageBody: aws.String("a")}); err == nil {
+		t.Error("SendMessage() without a message group succeeded")
+	}
+	if _, err := s.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: url, MessageBody: aws.String("a"), DelaySeconds: 10,
+		MessageDeduplicationId: aws.String("a"), MessageGroupId: aws.String("g")}); err == nil {
+		t.Error("SendMessage() with a delay succeeded")
+	}
+	for _, m := range [][3]string{{"1", "g1", "a"}, {"1", "g1", "a again"}, {"2", "g1", "b"}, {"3", "g2", "c"}} {
+		if err := send(m[0], m[1], m[2]); err != nil {
+			t.Fatalf("SendMessage(%s) error = %v", m[2], err)
+		}
+	}
+	if msgs := s.Messages("jobs.fifo"); len(msgs) != 3 {
+		t.Errorf("Messages() = %d messages, want 3 without the duplicate", len(msgs))
+	}
+
+	receive := func() []string {
+		out, err := s.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{QueueUrl: url, MaxNumberOfMessages: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bodies []string
+		for _, m := range out.Messages {
+			bodies = append(bodies, *m.Body)
+			s.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: url, ReceiptHandle: m.ReceiptHandle})
+		}
+		return bodies
+	}
+	if got := receive(); strings.Join(got, ",") != "a,b,c" {
+		t.Errorf("first receive = %v, want a,b,c", got)
+	}
+
+	// A message in flight holds back the rest of its group
+	send("4", "g1", "d")
+	send("5", "g1", "e")
+	out, _ := s.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{QueueUrl: url})
+	if len(out.Messages) != 1 || *out.Messages[0].Body != "d" {
+		t.Fatalf("ReceiveMessage() = %v, want d", out.Messages)
+	}
+	if got := receive(); len(got) != 0 {
+		t.Errorf("receive with d in flight = %v, want none", got)
+	}
+}
@@ -0,0 +1,144 @@
+// Package fakeaws provides in-memory implementations of the Amazon SQS,
+// Amazon S3 and Amazon EC2 interfaces of the utils package, and an EC2
+// instance metadata service, for tests.
+// Every fake records its calls and can be scripted to fail, for example to
+// throttle or time out the next requests of an operation.
+package fakeaws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// Error codes returned by the services when a request is throttled
+const (
+	SQSThrottlingCode = "RequestThrottled"
+	S3ThrottlingCode  = "SlowDown"
+	EC2ThrottlingCode = "RequestLimitExceeded"
+)
+
+// Fault is a scripted failure of an operation.
+type Fault struct {
+	// Err is returned by the operation, nil lets the operation run after Delay.
+	Err error
+	// Delay blocks the operation, it returns the error of its context if the
+	// context is done first.
+	Delay time.Duration
+	// Times is the number of calls the fault applies to, 0 means every call.
+	Times int
+}
+
+// Fail returns a fault making the next times calls return err.
+func Fail(err error, times int) Fault {
+	return Fault{Err: err, Times: times}
+}
+
+// Throttle returns a fault making the next times calls fail with the throttling error code.
+func Throttle(code string, times int) Fault {
+	return Fault{Err: ThrottlingError(code), Times: times}
+}
+
+// Timeout returns a fault making the next times calls hang for delay and then time out.
+func Timeout(delay time.Duration, times int) Fault {
+	return Fault{Err: &TimeoutError{}, Delay: delay, Times: times}
+}
+
+// ThrottlingError returns the error of a throttled request with the error code of a service.
+func ThrottlingError(code string) error {
+	return &smithy.GenericAPIError{Code: code, Message: "Rate exceeded", Fault: smithy.FaultClient}
+}
+
+// TimeoutError is the error of a request that timed out, like an HTTP client timeout.
+type TimeoutError struct{}
+
+func (e *TimeoutError) Error() string { return "request timed out" }
+
+// Timeout reports that the error is a timeout, as net.Error does.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Unwrap makes errors.Is(err, context.DeadlineExceeded) true.
+func (e *TimeoutError) Unwrap() error { return context.DeadlineExceeded }
+
+// Faults holds the scripted faults and the call counts of a fake service.
+// It is embedded in the fakes, its methods are safe for concurrent use.
+type Faults struct {
+	service string
+
+	mu     sync.Mutex
+	script map[string][]Fault
+	calls  map[string]int
+}
+
+// Inject adds a fault to the calls of operation op, such as "SendMessage".
+// Faults of the same operation apply one after the other.
+func (f *Faults) Inject(op string, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.script == nil {
+		f.script = make(map[string][]Fault)
+	}
+	f.script[op] = append(f.script[op], fault)
+}
+
+// Clear removes the faults of all operations.
+func (f *Faults) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = nil
+}
+
+// Calls returns the number of calls of operation op, including failed ones.
+func (f *Faults) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// call counts a call of op and applies its next fault, if any.
+func (f *Faults) call(ctx context.Context, op string) error {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[op]++
+	var fault *Fault
+	if faults := f.script[op]; len(faults) > 0 {
+		current := faults[0]
+		fault = &current
+		if faults[0].Times > 0 {
+			faults[0].Times--
+			if faults[0].Times == 0 {
+				f.script[op] = faults[1:]
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return f.wrap(op, err)
+	}
+	if fault == nil {
+		return nil
+	}
+	if fault.Delay > 0 {
+		timer := time.NewTimer(fault.Delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return f.wrap(op, ctx.Err())
+		case <-timer.C:
+		}
+	}
+	if fault.Err != nil {
+		return f.wrap(op, fault.Err)
+	}
+	return nil
+}
+
+// wrap returns err as the SDK clients do, in an OperationError naming the service and op.
+func (f *Faults) wrap(op string, err error) error {
+	return &smithy.OperationError{ServiceID: f.service, OperationName: op, Err: err}
+}
@@ -0,0 +1,96 @@
+package fakeaws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// MetadataServer is an EC2 instance metadata service (IMDSv2) on a local HTTP
+// server, its URL is the Endpoint of an imds client. Every GET must carry a
+// token obtained with a PUT to /latest/api/token, as on an instance.
+//
+// The operations of its faults are "GetToken" and the paths of the GET
+// requests, such as "meta-data/instance-id". A failed request is answered with
+// a 500 status.
+type MetadataServer struct {
+	Faults
+	*httptest.Server
+
+	mu     sync.Mutex
+	values map[string]string
+	tokens map[string]bool
+	seq    int
+}
+
+// NewMetadataServer starts a metadata service without any value, close it
+// with Close.
+func NewMetadataServer() *MetadataServer {
+	m := &MetadataServer{
+		Faults: Faults{service: "IMDS"},
+		values: make(map[string]string),
+		tokens: make(map[string]bool),
+	}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+	return m
+}
+
+// Set serves value at path, relative to /latest/, such as
+// "meta-data/spot/instance-action".
+func (m *MetadataServer) Set(path string, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[path] = value
+}
+
+// Delete stops serving path, which is then not found.
+func (m *MetadataServer) Delete(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, path)
+}
+
+func (m *MetadataServer) serve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/latest/")
+	if path == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	op := path
+	if path == "api/token" {
+		op = "GetToken"
+	}
+	if err := m.call(r.Context(), op); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case path == "api/token" && r.Method == http.MethodPut:
+		ttl := r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds")
+		if ttl == "" {
+			http.Error(w, "missing token TTL", http.StatusBadRequest)
+			return
+		}
+		m.seq++
+		token := fmt.Sprintf("token-%d", m.seq)
+		m.tokens[token] = true
+		w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", ttl)
+		fmt.Fprint(w, token)
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case !m.tokens[r.Header.Get("X-Aws-Ec2-Metadata-Token")]:
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	default:
+		value, ok := m.values[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, value)
+	}
+}
@@ -0,0 +1,302 @@
+package fakeaws
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3 is an in-memory Amazon S3 service.
+type S3 struct {
+	Faults
+
+	mu      sync.Mutex
+	buckets map[string]map[string]fakeObject
+}
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// NewS3 returns a service with the empty buckets named names.
+func NewS3(names ...string) *S3 {
+	s := &S3{
+		Faults:  Faults{service: "S3"},
+		buckets: make(map[string]map[string]fakeObject),
+	}
+	for _, name := range names {
+		s.buckets[name] = make(map[string]fakeObject)
+	}
+	return s
+}
+
+// Object returns the content of an object and whether it exists.
+func (s *S3) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.buckets[bucket][key]
+	return obj.data, ok
+}
+
+// Keys returns the sorted keys of the objects in bucket.
+func (s *S3) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CreateBucket creates an empty bucket, it fails if the bucket exists.
+func (s *S3) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	if err := s.call(ctx, "CreateBucket"); err != nil {
+		return nil, err
+	}
+	name := aws.ToString(params.Bucket)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[name] != nil {
+		return nil, s.wrap("CreateBucket", &types.BucketAlreadyOwnedByYou{Message: aws.String("bucket '" + name + "' already exists")})
+	}
+	s.buckets[name] = make(map[string]fakeObject)
+	return &s3.CreateBucketOutput{Location: aws.String("/" + name)}, nil
+}
+
+// ListBuckets returns the buckets sorted by name.
+func (s *S3) ListBuckets(ctx context.Context, params *s3.ListBucketsInput, optFns ...func(*s3.Options)) (*s3.ListBucketsOutput, error) {
+	if err := s.call(ctx, "ListBuckets"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := &s3.ListBucketsOutput{}
+	for _, name := range names {
+		out.Buckets = append(out.Buckets, types.Bucket{Name: aws.String(name)})
+	}
+	return out, nil
+}
+
+// PutObject stores an object, replacing any object with the same key.
+func (s *S3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := s.call(ctx, "PutObject"); err != nil {
+		return nil, err
+	}
+	var data []byte
+	if params.Body != nil {
+		var err error
+		if data, err = ioutil.ReadAll(params.Body); err != nil {
+			return nil, s.wrap("PutObject", err)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, err := s.bucket("PutObject", params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(data)
+	obj := fakeObject{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modified: time.Now()}
+	objects[aws.ToString(params.Key)] = obj
+	return &s3.PutObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+// GetObject returns an object, or the bytes of its Range such as "bytes=0-99".
+func (s *S3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := s.call(ctx, "GetObject"); err != nil {
+		return nil, err
+	}
+	obj, err := s.object("GetObject", params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(obj.data))
+	out := &s3.GetObjectOutput{ETag: aws.String(obj.etag), LastModified: aws.Time(obj.modified)}
+	start, end := int64(0), size-1
+	if params.Range != nil {
+		if start, end, err = parseRange(*params.Range, size); err != nil {
+			return nil, s.wrap("GetObject", err)
+		}
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	out.ContentLength = end - start + 1
+	out.Body = ioutil.NopCloser(bytes.NewReader(obj.data[start : end+1]))
+	return out, nil
+}
+
+// HeadObject returns the size and ETag of an object.
+func (s *S3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if err := s.call(ctx, "HeadObject"); err != nil {
+		return nil, err
+	}
+	obj, err := s.object("HeadObject", params.Bucket, params.Key)
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			// HEAD responses have no body, the SDK only sees the status code
+			return nil, s.wrap("HeadObject", &types.NotFound{Message: noKey.Message})
+		}
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: int64(len(obj.data)),
+		ETag:          aws.String(obj.etag),
+		LastModified:  aws.Time(obj.modified),
+	}, nil
+}
+
+// DeleteObject deletes an object, deleting a missing object is not an error.
+func (s *S3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if err := s.call(ctx, "DeleteObject"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, err := s.bucket("DeleteObject", params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	delete(objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// ListObjectsV2 returns up to MaxKeys objects whose key starts with Prefix, in key order.
+func (s *S3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if err := s.call(ctx, "ListObjectsV2"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, err := s.bucket("ListObjectsV2", params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	prefix := aws.ToString(params.Prefix)
+	after := aws.ToString(params.StartAfter)
+	if params.ContinuationToken != nil {
+		after = *params.ContinuationToken
+	}
+	max := int(params.MaxKeys)
+	if max <= 0 {
+		max = 1000
+	}
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{
+		Name:              params.Bucket,
+		Prefix:            params.Prefix,
+		MaxKeys:           int32(max),
+		ContinuationToken: params.ContinuationToken,
+	}
+	if len(keys) > max {
+		keys = keys[:max]
+		out.IsTruncated = true
+		out.NextContinuationToken = aws.String(keys[max-1])
+	}
+	for _, key := range keys {
+		obj := objects[key]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         int64(len(obj.data)),
+			ETag:         aws.String(obj.etag),
+			LastModified: aws.Time(obj.modified),
+		})
+	}
+	out.KeyCount = int32(len(out.Contents))
+	return out, nil
+}
+
+// bucket returns the objects of a bucket.
+func (s *S3) bucket(op string, name *string) (map[string]fakeObject, error) {
+	objects := s.buckets[aws.ToString(name)]
+	if objects == nil {
+		return nil, s.wrap(op, &types.NoSuchBucket{Message: aws.String("the bucket '" + aws.ToString(name) + "' does not exist")})
+	}
+	return objects, nil
+}
+
+// object returns an object of a bucket.
+func (s *S3) object(op string, bucket, key *string) (fakeObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, err := s.bucket(op, bucket)
+	if err != nil {
+		return fakeObject{}, err
+	}
+	obj, ok := objects[aws.ToString(key)]
+	if !ok {
+		return fakeObject{}, s.wrap(op, &types.NoSuchKey{Message: aws.String("the key '" + aws.ToString(key) + "' does not exist")})
+	}
+	return obj, nil
+}
+
+// parseRange returns the first and last byte of a range header such as
+// "bytes=0-99", "bytes=100-" or "bytes=-100", clamped to size.
+func parseRange(header string, size int64) (int64, int64, error) {
+	invalid := &smithy.GenericAPIError{Code: "InvalidRange", Message: "the requested range '" + header + "' is not satisfiable"}
+	spec := strings.TrimPrefix(header, "bytes=")
+	idx := strings.Index(spec, "-")
+	if spec == header || idx < 0 {
+		return 0, 0, invalid
+	}
+	first, last := spec[:idx], spec[idx+1:]
+	var start, end int64
+	var err error
+	switch {
+	case first == "":
+		n, perr := strconv.ParseInt(last, 10, 64)
+		if perr != nil || n <= 0 {
+			return 0, 0, invalid
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	default:
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+			return 0, 0, invalid
+		}
+		end = size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return 0, 0, invalid
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+	}
+	if start >= size || start > end {
+		return 0, 0, invalid
+	}
+	return start, end, nil
+}
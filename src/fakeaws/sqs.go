@@ -0,0 +1,452 @@
+package fakeaws
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+)
+
+// DefaultVisibilityTimeout is the visibility timeout of the queues, as in Amazon SQS.
+const DefaultVisibilityTimeout = 30 * time.Second
+
+// deduplicationInterval is how long a FIFO queue drops the messages sent with
+// the deduplication ID of a message.
+const deduplicationInterval = 5 * time.Minute
+
+// SQS is an in-memory Amazon SQS service.
+// Received messages are hidden for the visibility timeout and can only be
+// deleted with the receipt handle of their last receive.
+//
+// The queues whose names end with ".fifo" are FIFO queues: the messages need a
+// deduplication ID and a message group but no delay, and the messages of a
+// group are not received while one of them is in flight.
+type SQS struct {
+	Faults
+
+	// Now returns the current time, tests can replace it to expire the visibility timeouts.
+	Now func() time.Time
+
+	mu         sync.Mutex
+	queues     map[string]*fakeQueue
+	seq        int
+	duplicates int
+	sent       chan struct{}
+}
+
+type fakeQueue struct {
+	name       string
+	attributes map[string]string
+	created    time.Time
+	messages   []*fakeMessage
+	// sentIDs are the messages sent to a FIFO queue by deduplication ID.
+	sentIDs map[string]sentID
+}
+
+type sentID struct {
+	messageID string
+	sent      time.Time
+}
+
+type fakeMessage struct {
+	id           string
+	body         string
+	attributes   map[string]types.MessageAttributeValue
+	group        string
+	sent         time.Time
+	visibleAt    time.Time
+	receiveCount int
+	firstReceive time.Time
+	handle       string
+}
+
+// NewSQS returns a service with the queues named names.
+func NewSQS(names ...string) *SQS {
+	s := &SQS{
+		Faults: Faults{service: "SQS"},
+		Now:    time.Now,
+		queues: make(map[string]*fakeQueue),
+		sent:   make(chan struct{}),
+	}
+	for _, name := range names {
+		s.queues[name] = &fakeQueue{name: name, created: s.Now()}
+	}
+	return s
+}
+
+// QueueURL returns the URL of the queue named name.
+func QueueURL(name string) string {
+	return "https://sqs.us-east-1.amazonaws.com/000000000000/" + name
+}
+
+// DuplicateNext makes the next n received messages be delivered twice:
+// a copy stays in the queue, as Amazon SQS may do with standard queues.
+func (s *SQS) DuplicateNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.duplicates = n
+}
+
+// Messages returns the messages in the queue named name, in flight or not,
+// with their attributes, without receiving them.
+func (s *SQS) Messages(name string) []types.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queues[name]
+	if q == nil {
+		return nil
+	}
+	msgs := make([]types.Message, 0, len(q.messages))
+	for _, m := range q.messages {
+		msgs = append(msgs, m.message([]types.QueueAttributeName{types.QueueAttributeNameAll}, []string{"All"}))
+	}
+	return msgs
+}
+
+// CreateQueue creates a queue, or returns the URL of an existing one.
+func (s *SQS) CreateQueue(ctx context.Context, params *sqs.CreateQueueInput, optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error) {
+	if err := s.call(ctx, "CreateQueue"); err != nil {
+		return nil, err
+	}
+	name := aws.ToString(params.QueueName)
+	if name == "" {
+		return nil, s.wrap("CreateQueue", &types.InvalidAttributeName{Message: aws.String("missing queue name")})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queues[name] == nil {
+		s.queues[name] = &fakeQueue{name: name, attributes: params.Attributes, created: s.Now()}
+	}
+	return &sqs.CreateQueueOutput{QueueUrl: aws.String(QueueURL(name))}, nil
+}
+
+// GetQueueUrl returns the URL of a queue.
+func (s *SQS) GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	if err := s.call(ctx, "GetQueueUrl"); err != nil {
+		return nil, err
+	}
+	name := aws.ToString(params.QueueName)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queues[name] == nil {
+		return nil, s.wrap("GetQueueUrl", queueDoesNotExist(name))
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(QueueURL(name))}, nil
+}
+
+// ListQueues returns the URLs of the queues whose name starts with QueueNamePrefix.
+func (s *SQS) ListQueues(ctx context.Context, params *sqs.ListQueuesInput, optFns ...func(*sqs.Options)) (*sqs.ListQueuesOutput, error) {
+	if err := s.call(ctx, "ListQueues"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var urls []string
+	for name := range s.queues {
+		if strings.HasPrefix(name, aws.ToString(params.QueueNamePrefix)) {
+			urls = append(urls, QueueURL(name))
+		}
+	}
+	sort.Strings(urls)
+	return &sqs.ListQueuesOutput{QueueUrls: urls}, nil
+}
+
+// SendMessage adds a message to a queue, hidden for DelaySeconds.
+func (s *SQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	if err := s.call(ctx, "SendMessage"); err != nil {
+		return nil, err
+	}
+	if aws.ToString(params.MessageBody) == "" {
+		return nil, s.wrap("SendMessage", &types.InvalidMessageContents{Message: aws.String("empty message body")})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, err := s.queue("SendMessage", params.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	now := s.Now()
+	sum := md5.Sum([]byte(aws.ToString(params.MessageBody)))
+	fifo := strings.HasSuffix(q.name, ".fifo")
+	if fifo {
+		switch {
+		case params.MessageGroupId == nil:
+			return nil, s.wrap("SendMessage", &smithy.GenericAPIError{Code: "MissingParameter", Message: "The request must contain the parameter MessageGroupId."})
+		case params.MessageDeduplicationId == nil:
+			return nil, s.wrap("SendMessage", &smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "The queue should either have ContentBasedDeduplication enabled or MessageDeduplicationId provided explicitly"})
+		case params.DelaySeconds != 0:
+			return nil, s.wrap("SendMessage", &smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "Value for parameter DelaySeconds is invalid. Reason: The request include parameter that is not valid for this queue type."})
+		}
+		if sent, ok := q.sentIDs[*params.MessageDeduplicationId]; ok && now.Sub(sent.sent) < deduplicationInterval {
+			return &sqs.SendMessageOutput{MessageId: aws.String(sent.messageID), MD5OfMessageBody: aws.String(hex.EncodeToString(sum[:]))}, nil
+		}
+	}
+	s.seq++
+	m := &fakeMessage{
+		id:         fmt.Sprintf("msg-%d", s.seq),
+		body:       *params.MessageBody,
+		attributes: params.MessageAttributes,
+		group:      aws.ToString(params.MessageGroupId),
+		sent:       now,
+		visibleAt:  now.Add(time.Duration(params.DelaySeconds) * time.Second),
+	}
+	q.messages = append(q.messages, m)
+	if fifo {
+		if q.sentIDs == nil {
+			q.sentIDs = make(map[string]sentID)
+		}
+		q.sentIDs[*params.MessageDeduplicationId] = sentID{messageID: m.id, sent: now}
+	}
+
+	// Wake up the long polls
+	close(s.sent)
+	s.sent = make(chan struct{})
+	return &sqs.SendMessageOutput{MessageId: aws.String(m.id), MD5OfMessageBody: aws.String(hex.EncodeToString(sum[:]))}, nil
+}
+
+// ReceiveMessage receives up to MaxNumberOfMessages visible messages, waiting
+// up to WaitTimeSeconds for a message to be sent if there is none.
+func (s *SQS) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	if err := s.call(ctx, "ReceiveMessage"); err != nil {
+		return nil, err
+	}
+	max := int(params.MaxNumberOfMessages)
+	if max == 0 {
+		max = 1
+	}
+	if max < 1 || max > 10 {
+		return nil, s.wrap("ReceiveMessage", &types.OverLimit{Message: aws.String("MaxNumberOfMessages must be between 1 and 10")})
+	}
+	timer := time.NewTimer(time.Duration(params.WaitTimeSeconds) * time.Second)
+	defer timer.Stop()
+	for {
+		msgs, sent, err := s.receive(params, max)
+		if err != nil || len(msgs) > 0 || params.WaitTimeSeconds == 0 {
+			return &sqs.ReceiveMessageOutput{Messages: msgs}, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, s.wrap("ReceiveMessage", ctx.Err())
+		case <-timer.C:
+			return &sqs.ReceiveMessageOutput{}, nil
+		case <-sent:
+		}
+	}
+}
+
+// receive takes up to max visible messages, it also returns a channel closed by the next send.
+func (s *SQS) receive(params *sqs.ReceiveMessageInput, max int) ([]types.Message, chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, err := s.queue("ReceiveMessage", params.QueueUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	visibility := DefaultVisibilityTimeout
+	if v, err := strconv.Atoi(q.attributes[string(types.QueueAttributeNameVisibilityTimeout)]); err == nil {
+		visibility = time.Duration(v) * time.Second
+	}
+	if params.VisibilityTimeout > 0 {
+		visibility = time.Duration(params.VisibilityTimeout) * time.Second
+	}
+
+	var msgs []types.Message
+	now := s.Now()
+	fifo := strings.HasSuffix(q.name, ".fifo")
+	// The groups of a FIFO queue with a message in flight
+	blocked := make(map[string]bool)
+	for _, m := range q.messages {
+		if len(msgs) == max {
+			break
+		}
+		if fifo && blocked[m.group] {
+			continue
+		}
+		if m.visibleAt.After(now) {
+			blocked[m.group] = true
+			continue
+		}
+		if s.duplicates > 0 {
+			s.duplicates--
+			dup := *m
+			q.messages = append(q.messages, &dup)
+		}
+		m.receiveCount++
+		if m.firstReceive.IsZero() {
+			m.firstReceive = now
+		}
+		s.seq++
+		m.handle = fmt.Sprintf("%s#%d", m.id, s.seq)
+		m.visibleAt = now.Add(visibility)
+		msgs = append(msgs, m.message(params.AttributeNames, params.MessageAttributeNames))
+	}
+	return msgs, s.sent, nil
+}
+
+// DeleteMessage deletes a message using the receipt handle of its last receive.
+func (s *SQS) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	if err := s.call(ctx, "DeleteMessage"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, err := s.queue("DeleteMessage", params.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	i, err := s.find("DeleteMessage", q, params.ReceiptHandle)
+	if err != nil {
+		return nil, err
+	}
+	q.messages = append(q.messages[:i], q.messages[i+1:]...)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// ChangeMessageVisibility hides a message in flight for VisibilityTimeout seconds from now.
+func (s *SQS) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if err := s.call(ctx, "ChangeMessageVisibility"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, err := s.queue("ChangeMessageVisibility", params.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	i, err := s.find("ChangeMessageVisibility", q, params.ReceiptHandle)
+	if err != nil {
+		return nil, err
+	}
+	now := s.Now()
+	if !q.messages[i].visibleAt.After(now) {
+		return nil, s.wrap("ChangeMessageVisibility", &types.MessageNotInflight{Message: aws.String("message is not in flight")})
+	}
+	q.messages[i].visibleAt = now.Add(time.Duration(params.VisibilityTimeout) * time.Second)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// GetQueueAttributes returns the approximate numbers of messages of a queue and its attributes.
+func (s *SQS) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	if err := s.call(ctx, "GetQueueAttributes"); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, err := s.queue("GetQueueAttributes", params.QueueUrl)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]string{
+		string(types.QueueAttributeNameVisibilityTimeout): strconv.Itoa(int(DefaultVisibilityTimeout / time.Second)),
+		string(types.QueueAttributeNameCreatedTimestamp):  strconv.FormatInt(q.created.Unix(), 10),
+	}
+	for name, value := range q.attributes {
+		all[name] = value
+	}
+	var visible, inFlight, delayed int
+	now := s.Now()
+	for _, m := range q.messages {
+		switch {
+		case !m.visibleAt.After(now):
+			visible++
+		case m.receiveCount > 0:
+			inFlight++
+		default:
+			delayed++
+		}
+	}
+	all[string(types.QueueAttributeNameApproximateNumberOfMessages)] = strconv.Itoa(visible)
+	all[string(types.QueueAttributeNameApproximateNumberOfMessagesNotVisible)] = strconv.Itoa(inFlight)
+	all[string(types.QueueAttributeNameApproximateNumberOfMessagesDelayed)] = strconv.Itoa(delayed)
+
+	attrs := make(map[string]string)
+	for name, value := range all {
+		if wanted(params.AttributeNames, name) {
+			attrs[name] = value
+		}
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: attrs}, nil
+}
+
+// queue returns the queue of url.
+func (s *SQS) queue(op string, url *string) (*fakeQueue, error) {
+	u := aws.ToString(url)
+	name := u[strings.LastIndex(u, "/")+1:]
+	q := s.queues[name]
+	if q == nil || QueueURL(name) != u {
+		return nil, s.wrap(op, queueDoesNotExist(u))
+	}
+	return q, nil
+}
+
+// find returns the index of the message whose last receipt handle is handle.
+func (s *SQS) find(op string, q *fakeQueue, handle *string) (int, error) {
+	for i, m := range q.messages {
+		if m.handle != "" && m.handle == aws.ToString(handle) {
+			return i, nil
+		}
+	}
+	return 0, s.wrap(op, &types.ReceiptHandleIsInvalid{Message: aws.String("invalid receipt handle '" + aws.ToString(handle) + "'")})
+}
+
+func (m *fakeMessage) message(attributeNames []types.QueueAttributeName, messageAttributeNames []string) types.Message {
+	sum := md5.Sum([]byte(m.body))
+	msg := types.Message{
+		MessageId:     aws.String(m.id),
+		ReceiptHandle: aws.String(m.handle),
+		Body:          aws.String(m.body),
+		MD5OfBody:     aws.String(hex.EncodeToString(sum[:])),
+	}
+	system := map[string]string{
+		"SentTimestamp":           strconv.FormatInt(m.sent.UnixNano()/int64(time.Millisecond), 10),
+		"ApproximateReceiveCount": strconv.Itoa(m.receiveCount),
+	}
+	if !m.firstReceive.IsZero() {
+		system["ApproximateFirstReceiveTimestamp"] = strconv.FormatInt(m.firstReceive.UnixNano()/int64(time.Millisecond), 10)
+	}
+	for name, value := range system {
+		if wanted(attributeNames, name) {
+			if msg.Attributes == nil {
+				msg.Attributes = make(map[string]string)
+			}
+			msg.Attributes[name] = value
+		}
+	}
+	for name, value := range m.attributes {
+		for _, want := range messageAttributeNames {
+			if want == "All" || want == ".*" || want == name ||
+				(strings.HasSuffix(want, ".*") && strings.HasPrefix(name, strings.TrimSuffix(want, "*"))) {
+				if msg.MessageAttributes == nil {
+					msg.MessageAttributes = make(map[string]types.MessageAttributeValue)
+				}
+				msg.MessageAttributes[name] = value
+				break
+			}
+		}
+	}
+	return msg
+}
+
+// wanted reports whether the attribute name is requested by names.
+func wanted(names []types.QueueAttributeName, name string) bool {
+	for _, n := range names {
+		if n == types.QueueAttributeNameAll || string(n) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func queueDoesNotExist(queue string) error {
+	return &types.QueueDoesNotExist{Message: aws.String("the queue '" + queue + "' does not exist")}
+}
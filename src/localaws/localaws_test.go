@@ -0,0 +1,267 @@
+package localaws
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// newTestQueue creates a queue in a temporary directory whose clock is advanced by the returned function.
+func newTestQueue(t *testing.T) (*Queues, string, func(time.Duration)) {
+	dir, err := ioutil.TempDir("", "localaws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	q, err := NewQueues(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1617000000, 0)
+	q.Now = func() time.Time { return now }
+	out, err := q.CreateQueue(context.TODO(), &sqs.CreateQueueInput{
+		QueueName:  aws.String("jobs"),
+		Attributes: map[string]string{"VisibilityTimeout": "30"},
+	})
+	if err != nil {
+		t.Fatalf("CreateQueue() error = %v", err)
+	}
+	return q, *out.QueueUrl, func(d time.Duration) { now = now.Add(d) }
+}
+
+func receiveOne(t *testing.T, q *Queues, url string) *types.Message {
+	t.Helper()
+	out, err := q.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+		QueueUrl:       aws.String(url),
+		AttributeNames: []types.QueueAttributeName{"ApproximateReceiveCount"},
+	})
+	if err != nil {
+		t.Fatalf("ReceiveMessage() error = %v", err)
+	}
+	if len(out.Messages) == 0 {
+		return nil
+	}
+	return &out.Messages[0]
+}
+
+func TestQueueVisibility(t *testing.T) {
+	q, url, advance := newTestQueue(t)
+	ctx := context.TODO()
+
+	got, err := q.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String("jobs")})
+	if err != nil || *got.QueueUrl != url {
+		t.Fatalf("GetQueueUrl() = %v, %v, want %s", got, err, url)
+	}
+	if _, err := q.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String("missing")}); err == nil {
+		t.Errorf("GetQueueUrl() of a missing queue succeeded")
+	}
+
+	_, err = q.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(url),
+		MessageBody: aws.String("hello"),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"JobId": {DataType: aws.String("String"), StringValue: aws.String("1")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	first := receiveOne(t, q, url)
+	if first == nil || *first.Body != "hello" {
+		t.Fatalf("ReceiveMessage() = %v, want the sent message", first)
+	}
+	if first.Attributes["ApproximateReceiveCount"] != "1" {
+		t.Errorf("ApproximateReceiveCount = %q, want 1", first.Attributes["ApproximateReceiveCount"])
+	}
+	if first.MessageAttributes != nil {
+		t.Errorf("MessageAttributes = %v, want none without MessageAttributeNames", first.MessageAttributes)
+	}
+	if msg := receiveOne(t, q, url); msg != nil {
+		t.Fatalf("ReceiveMessage() during the visibility timeout = %v, want none", msg)
+	}
+
+	// The message reappears after the timeout, with a new receipt handle
+	advance(31 * time.Second)
+	second := receiveOne(t, q, url)
+	if second == nil || second.Attributes["ApproximateReceiveCount"] != "2" {
+		t.Fatalf("ReceiveMessage() after the visibility timeout = %v, want the message received twice", second)
+	}
+	_, err = q.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(url), ReceiptHandle: first.ReceiptHandle})
+	var invalid *types.ReceiptHandleIsInvalid
+	if !errors.As(err, &invalid) {
+		t.Errorf("DeleteMessage() with an expired handle error = %v, want ReceiptHandleIsInvalid", err)
+	}
+
+	// A visibility timeout of 0 releases the message at once
+	_, err = q.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:      aws.String(url),
+		ReceiptHandle: second.ReceiptHandle,
+	})
+	if err != nil {
+		t.Fatalf("ChangeMessageVisibility() error = %v", err)
+	}
+	third := receiveOne(t, q, url)
+	if third == nil {
+		t.Fatalf("ReceiveMessage() after releasing the message = nil")
+	}
+	if _, err := q.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(url), ReceiptHandle: third.ReceiptHandle}); err != nil {
+		t.Fatalf("DeleteMessage() error = %v", err)
+	}
+	advance(time.Hour)
+	if msg := receiveOne(t, q, url); msg != nil {
+		t.Errorf("ReceiveMessage() after DeleteMessage() = %v, want none", msg)
+	}
+}
+
+func TestQueueAttributes(t *testing.T) {
+	q, url, advance := newTestQueue(t)
+	ctx := context.TODO()
+	for _, body := range []string{"a", "b", "c"} {
+		advance(time.Millisecond)
+		if _, err := q.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: aws.String(url), MessageBody: aws.String(body)}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	if _, err := q.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: aws.String(url), MessageBody: aws.String("d"), DelaySeconds: 10}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if msg := receiveOne(t, q, url); msg == nil || *msg.Body != "a" {
+		t.Fatalf("ReceiveMessage() = %v, want the oldest message", msg)
+	}
+
+	out, err := q.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(url),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameAll},
+	})
+	if err != nil {
+		t.Fatalf("GetQueueAttributes() error = %v", err)
+	}
+	want := map[string]string{
+		"ApproximateNumberOfMessages":           "2",
+		"ApproximateNumberOfMessagesNotVisible": "1",
+		"ApproximateNumberOfMessagesDelayed":    "1",
+		"VisibilityTimeout":                     "30",
+	}
+	for name, value := range want {
+		if out.Attributes[name] != value {
+			t.Errorf("attribute %s = %q, want %q", name, out.Attributes[name], value)
+		}
+	}
+}
+
+func TestCreateQueueAttributes(t *testing.T) {
+	q, _, _ := newTestQueue(t)
+	tests := []struct {
+		name    string
+		queue   string
+		attrs   map[string]string
+		wantErr bool
+	}{
+		{"FIFO", "jobs-i-0001.fifo", map[string]string{"FifoQueue": "true", "ContentBasedDeduplication": "false"}, false},
+		{"Delay", "delayed", map[string]string{"DelaySeconds": "5"}, false},
+		{"Unsupported", "policy", map[string]string{"Policy": "{}"}, true},
+		{"InvalidValue", "visibility", map[string]string{"VisibilityTimeout": "-1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := q.CreateQueue(context.TODO(), &sqs.CreateQueueInput{QueueName: aws.String(tt.queue), Attributes: tt.attrs})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CreateQueue(%v) error = %v, wantErr %v", tt.attrs, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localaws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := NewBuckets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+	if _, err := b.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("data")}); err != nil {
+		t.Fatalf("CreateBucket() error = %v", err)
+	}
+	for _, key := range []string{"results/b.json", "results/a.json", "input.txt"} {
+		_, err := b.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String("data"),
+			Key:    aws.String(key),
+			Body:   strings.NewReader("0123456789"),
+		})
+		if err != nil {
+			t.Fatalf("PutObject(%s) error = %v", key, err)
+		}
+	}
+
+	ranges := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: "0123456789"},
+		{header: "bytes=2-4", want: "234"},
+		{header: "bytes=7-", want: "789"},
+		{header: "bytes=-2", want: "89"},
+		{header: "bytes=8-100", want: "89"},
+	}
+	for _, tt := range ranges {
+		input := &s3.GetObjectInput{Bucket: aws.String("data"), Key: aws.String("input.txt")}
+		if tt.header != "" {
+			input.Range = aws.String(tt.header)
+		}
+		out, err := b.GetObject(ctx, input)
+		if err != nil {
+			t.Fatalf("GetObject(%q) error = %v", tt.header, err)
+		}
+		body, _ := ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		if string(body) != tt.want || out.ContentLength != int64(len(tt.want)) {
+			t.Errorf("GetObject(%q) = %q (%d bytes), want %q", tt.header, body, out.ContentLength, tt.want)
+		}
+	}
+
+	head, err := b.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("data"), Key: aws.String("input.txt")})
+	if err != nil || head.ContentLength != 10 {
+		t.Errorf("HeadObject() = %v, %v, want 10 bytes", head, err)
+	}
+
+	list, err := b.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("data"), Prefix: aws.String("results/")})
+	if err != nil {
+		t.Fatalf("ListObjectsV2() error = %v", err)
+	}
+	var keys []string
+	for _, obj := range list.Contents {
+		keys = append(keys, *obj.Key)
+	}
+	if strings.Join(keys, ",") != "results/a.json,results/b.json" {
+		t.Errorf("ListObjectsV2() keys = %v, want the sorted results", keys)
+	}
+
+	if _, err := b.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("data"), Key: aws.String("input.txt")}); err != nil {
+		t.Fatalf("DeleteObject() error = %v", err)
+	}
+	_, err = b.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("data"), Key: aws.String("input.txt")})
+	var noKey *s3types.NoSuchKey
+	if !errors.As(err, &noKey) {
+		t.Errorf("GetObject() of a deleted object error = %v, want NoSuchKey", err)
+	}
+	_, err = b.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("missing"), Key: aws.String("input.txt")})
+	var noBucket *s3types.NoSuchBucket
+	if !errors.As(err, &noBucket) {
+		t.Errorf("GetObject() from a missing bucket error = %v, want NoSuchBucket", err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package localaws
+
+import "sync"
+
+var (
+	locksMu sync.Mutex
+	locks   = make(map[string]*sync.Mutex)
+)
+
+// lock takes an exclusive lock on path and returns the function releasing it.
+// Without flock the lock is only held within the process, so the directory
+// must not be shared by several processes on these systems.
+func lock(path string) (func(), error) {
+	locksMu.Lock()
+	mu, ok := locks[path]
+	if !ok {
+		mu = new(sync.Mutex)
+		locks[path] = mu
+	}
+	locksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock, nil
+}
@@ -0,0 +1,351 @@
+package localaws
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const tempPrefix = ".tmp-"
+
+// Buckets implements the Amazon S3 object operations of the utils package on
+// the buckets stored in a local directory, one sub-directory per bucket and one
+// file per object. Objects are written to a temporary file first and renamed
+// into place, readers see either the old or the new content.
+type Buckets struct {
+	dir string
+}
+
+// NewBuckets returns the buckets stored in dir, which is created if needed.
+func NewBuckets(dir string) (*Buckets, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	return &Buckets{dir: abs}, nil
+}
+
+// CreateBucket creates a bucket, it succeeds if the bucket already exists.
+func (b *Buckets) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	name := aws.ToString(params.Bucket)
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, invalidArgument("invalid bucket name '" + name + "'")
+	}
+	if err := os.MkdirAll(filepath.Join(b.dir, name), 0755); err != nil {
+		return nil, err
+	}
+	return &s3.CreateBucketOutput{Location: aws.String("/" + name)}, nil
+}
+
+// ListBuckets returns the buckets.
+func (b *Buckets) ListBuckets(ctx context.Context, params *s3.ListBucketsInput, optFns ...func(*s3.Options)) (*s3.ListBucketsOutput, error) {
+	entries, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	out := &s3.ListBucketsOutput{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			created := entry.ModTime()
+			out.Buckets = append(out.Buckets, types.Bucket{Name: aws.String(entry.Name()), CreationDate: &created})
+		}
+	}
+	return out, nil
+}
+
+// PutObject stores the Body of an object.
+func (b *Buckets) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	path, err := b.objectPath(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	body := params.Body
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	hash := md5.New()
+	if err := writeFile(path, io.TeeReader(body, hash)); err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(`"` + hex.EncodeToString(hash.Sum(nil)) + `"`)}, nil
+}
+
+// GetObject returns the content of an object, or of the part of it given by a
+// Range of the form "bytes=first-last", "bytes=first-" or "bytes=-length".
+func (b *Buckets) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	path, err := b.objectPath(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, b.objectError(params.Bucket, params.Key, err)
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return nil, b.objectError(params.Bucket, params.Key, os.ErrNotExist)
+	}
+
+	modified := info.ModTime()
+	out := &s3.GetObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: info.Size(),
+		LastModified:  &modified,
+	}
+	if params.Range == nil {
+		out.Body = file
+		return out, nil
+	}
+	first, last, err := parseRange(aws.ToString(params.Range), info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	out.ContentLength = last - first + 1
+	out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", first, last, info.Size()))
+	out.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, first, out.ContentLength), file}
+	return out, nil
+}
+
+// HeadObject returns the size and modification time of an object.
+func (b *Buckets) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	path, err := b.objectPath(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			if _, err := os.Stat(filepath.Join(b.dir, aws.ToString(params.Bucket))); err == nil {
+				return nil, &types.NotFound{Message: aws.String("object '" + aws.ToString(params.Key) + "' not found")}
+			}
+		}
+		return nil, b.objectError(params.Bucket, params.Key, err)
+	}
+	modified := info.ModTime()
+	return &s3.HeadObjectOutput{
+		AcceptRanges:  aws.String("bytes"),
+		ContentLength: info.Size(),
+		LastModified:  &modified,
+	}, nil
+}
+
+// DeleteObject deletes an object, it succeeds if the object does not exist.
+func (b *Buckets) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	path, err := b.objectPath(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	bucketDir := filepath.Join(b.dir, aws.ToString(params.Bucket))
+	if _, err := os.Stat(bucketDir); err != nil {
+		return nil, b.objectError(params.Bucket, params.Key, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Remove the directories left empty, as the key prefixes disappear in S3
+	for dir := filepath.Dir(path); dir != bucketDir; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// ListObjectsV2 returns the objects whose key starts with Prefix in key order,
+// MaxKeys at a time. Delimiter is not supported.
+func (b *Buckets) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	bucket := aws.ToString(params.Bucket)
+	bucketDir := filepath.Join(b.dir, bucket)
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) {
+		return nil, invalidArgument("invalid bucket name '" + bucket + "'")
+	}
+	if params.Delimiter != nil {
+		return nil, invalidArgument("delimiters are not supported")
+	}
+	if _, err := os.Stat(bucketDir); err != nil {
+		return nil, &types.NoSuchBucket{Message: aws.String("bucket '" + bucket + "' does not exist")}
+	}
+
+	prefix := aws.ToString(params.Prefix)
+	var objects []types.Object
+	err := filepath.Walk(bucketDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			modified := info.ModTime()
+			objects = append(objects, types.Object{Key: aws.String(key), Size: info.Size(), LastModified: &modified})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return *objects[i].Key < *objects[j].Key
+	})
+
+	after := aws.ToString(params.StartAfter)
+	if params.ContinuationToken != nil {
+		after = *params.ContinuationToken
+	}
+	start := sort.Search(len(objects), func(i int) bool {
+		return *objects[i].Key > after
+	})
+	objects = objects[start:]
+	maxKeys := int(params.MaxKeys)
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	out := &s3.ListObjectsV2Output{
+		Name:              params.Bucket,
+		Prefix:            params.Prefix,
+		MaxKeys:           int32(maxKeys),
+		ContinuationToken: params.ContinuationToken,
+		StartAfter:        params.StartAfter,
+	}
+	if len(objects) > maxKeys {
+		objects = objects[:maxKeys]
+		out.IsTruncated = true
+		out.NextContinuationToken = objects[maxKeys-1].Key
+	}
+	out.Contents = objects
+	out.KeyCount = int32(len(objects))
+	return out, nil
+}
+
+// objectPath returns the path of the file of an object.
+func (b *Buckets) objectPath(bucket *string, key *string) (string, error) {
+	name, k := aws.ToString(bucket), aws.ToString(key)
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", invalidArgument("invalid bucket name '" + name + "'")
+	}
+	if k == "" || strings.HasPrefix(k, "/") || strings.Contains(k, `\`) {
+		return "", invalidArgument("invalid key '" + k + "'")
+	}
+	for _, part := range strings.Split(k, "/") {
+		if part == "" || part == "." || part == ".." || strings.HasPrefix(part, tempPrefix) {
+			return "", invalidArgument("unsupported key '" + k + "'")
+		}
+	}
+	return filepath.Join(b.dir, name, filepath.FromSlash(k)), nil
+}
+
+// objectError converts the error of opening the file of an object to an S3 error.
+func (b *Buckets) objectError(bucket *string, key *string, err error) error {
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(b.dir, aws.ToString(bucket))); err != nil {
+		return &types.NoSuchBucket{Message: aws.String("bucket '" + aws.ToString(bucket) + "' does not exist")}
+	}
+	return &types.NoSuchKey{Message: aws.String("key '" + aws.ToString(key) + "' does not exist")}
+}
+
+// parseRange parses the value of a Range header for an object of size bytes
+// and returns the first and last byte offsets it covers.
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	idx := strings.Index(spec, "-")
+	if spec == header || idx < 0 || strings.Contains(spec, ",") {
+		return 0, 0, invalidArgument("unsupported range '" + header + "'")
+	}
+	var first, last int64
+	var err error
+	switch {
+	case idx == 0:
+		// Suffix range: the last bytes of the object
+		n, perr := strconv.ParseInt(spec[1:], 10, 64)
+		if perr != nil || n <= 0 {
+			return 0, 0, invalidArgument("unsupported range '" + header + "'")
+		}
+		first, last = size-n, size-1
+		if first < 0 {
+			first = 0
+		}
+	default:
+		first, err = strconv.ParseInt(spec[:idx], 10, 64)
+		if err != nil {
+			return 0, 0, invalidArgument("unsupported range '" + header + "'")
+		}
+		last = size - 1
+		if idx < len(spec)-1 {
+			if last, err = strconv.ParseInt(spec[idx+1:], 10, 64); err != nil || last < first {
+				return 0, 0, invalidArgument("unsupported range '" + header + "'")
+			}
+			if last >= size {
+				last = size - 1
+			}
+		}
+	}
+	if first >= size {
+		return 0, 0, &smithy.GenericAPIError{
+			Code:    "InvalidRange",
+			Message: fmt.Sprintf("range '%s' is not satisfiable for %d bytes", header, size),
+			Fault:   smithy.FaultClient,
+		}
+	}
+	return first, last, nil
+}
+
+func invalidArgument(msg string) error {
+	return &smithy.GenericAPIError{Code: "InvalidArgument", Message: msg, Fault: smithy.FaultClient}
+}
+
+// writeFile replaces the file at path with the content of r. The content is
+// written to a temporary file of the same directory which is then renamed.
+func writeFile(path string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,498 @@
+// Package localaws implements the Amazon SQS and Amazon S3 operations used by
+// the utils package on top of a local directory, so that the client and the
+// workers can run on one machine without an AWS account. Several processes
+// may share the same directory, every change is made under a file lock.
+package localaws
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// DefaultVisibilityTimeout is the visibility timeout of a queue created
+	// without a VisibilityTimeout attribute, as in Amazon SQS.
+	DefaultVisibilityTimeout = 30 * time.Second
+
+	attributesFile = "attributes.json"
+	lockFile       = ".lock"
+	messageExt     = ".msg"
+)
+
+// Queues implements the Amazon SQS operations of utils.SQSAPI on the queues
+// stored in a local directory, one sub-directory per queue and one file per
+// message. Received messages are hidden for the visibility timeout of the
+// queue and can only be deleted with the receipt handle of their last receive.
+type Queues struct {
+	dir string
+
+	// PollInterval is how often an empty queue is checked again during a long poll.
+	PollInterval time.Duration
+	// Now returns the current time, it can be replaced in tests.
+	Now func() time.Time
+}
+
+// queueAttributes are the attributes of a queue stored in its directory.
+type queueAttributes struct {
+	VisibilityTimeout int32
+	DelaySeconds      int32
+	CreatedTimestamp  int64
+}
+
+// storedMessage is a message stored in the directory of a queue.
+type storedMessage struct {
+	MessageID         string
+	Body              string
+	MessageAttributes map[string]types.MessageAttributeValue `json:",omitempty"`
+	// SentTimestamp and FirstReceiveTimestamp are in milliseconds since the epoch
+	SentTimestamp         int64
+	FirstReceiveTimestamp int64 `json:",omitempty"`
+	ReceiveCount          int
+	// VisibleAt is the time the message can be received, in nanoseconds since the epoch
+	VisibleAt     int64
+	ReceiptHandle string `json:",omitempty"`
+}
+
+// NewQueues returns the queues stored in dir, which is created if needed.
+func NewQueues(dir string) (*Queues, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	return &Queues{dir: abs, PollInterval: 100 * time.Millisecond, Now: time.Now}, nil
+}
+
+// CreateQueue creates a queue, or returns the URL of the existing queue of the same name.
+// The VisibilityTimeout and DelaySeconds attributes are supported, the
+// FifoQueue and ContentBasedDeduplication ones are accepted and ignored.
+func (q *Queues) CreateQueue(ctx context.Context, params *sqs.CreateQueueInput, optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error) {
+	name := aws.ToString(params.QueueName)
+	if base := strings.TrimSuffix(name, ".fifo"); base == "" || strings.ContainsAny(base, `/\.`) {
+		return nil, &types.InvalidAttributeName{Message: aws.String("invalid queue name '" + name + "'")}
+	}
+	attrs := queueAttributes{
+		VisibilityTimeout: int32(DefaultVisibilityTimeout / time.Second),
+		CreatedTimestamp:  q.Now().Unix(),
+	}
+	for key, val := range params.Attributes {
+		n, err := strconv.Atoi(val)
+		switch {
+		case key == string(types.QueueAttributeNameVisibilityTimeout) && err == nil && n >= 0:
+			attrs.VisibilityTimeout = int32(n)
+		case key == string(types.QueueAttributeNameDelaySeconds) && err == nil && n >= 0:
+			attrs.DelaySeconds = int32(n)
+		case key == string(types.QueueAttributeNameFifoQueue) || key == string(types.QueueAttributeNameContentBasedDeduplication):
+		default:
+			return nil, &types.InvalidAttributeName{Message: aws.String("unsupported attribute " + key + "=" + val)}
+		}
+	}
+
+	dir := filepath.Join(q.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	unlock, err := lock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if _, err := os.Stat(filepath.Join(dir, attributesFile)); os.IsNotExist(err) {
+		if err := writeJSON(filepath.Join(dir, attributesFile), attrs); err != nil {
+			return nil, err
+		}
+	}
+	return &sqs.CreateQueueOutput{QueueUrl: aws.String(q.url(name))}, nil
+}
+
+// GetQueueUrl returns the URL of a queue.
+func (q *Queues) GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	name := aws.ToString(params.QueueName)
+	if _, err := q.queueDir(q.url(name)); err != nil {
+		return nil, err
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(q.url(name))}, nil
+}
+
+// ListQueues returns the URLs of the queues whose name starts with QueueNamePrefix.
+func (q *Queues) ListQueues(ctx context.Context, params *sqs.ListQueuesInput, optFns ...func(*sqs.Options)) (*sqs.ListQueuesOutput, error) {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	out := &sqs.ListQueuesOutput{}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), aws.ToString(params.QueueNamePrefix)) {
+			out.QueueUrls = append(out.QueueUrls, q.url(entry.Name()))
+		}
+	}
+	return out, nil
+}
+
+// SendMessage adds a message to a queue.
+func (q *Queues) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	dir, err := q.queueDir(aws.ToString(params.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	if params.MessageBody == nil || *params.MessageBody == "" {
+		return nil, &types.InvalidMessageContents{Message: aws.String("empty message body")}
+	}
+	unlock, err := lock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var attrs queueAttributes
+	if err := readJSON(filepath.Join(dir, attributesFile), &attrs); err != nil {
+		return nil, err
+	}
+	delay := attrs.DelaySeconds
+	if params.DelaySeconds > 0 {
+		delay = params.DelaySeconds
+	}
+	now := q.Now()
+	msg := storedMessage{
+		MessageID:         newID(),
+		Body:              *params.MessageBody,
+		MessageAttributes: params.MessageAttributes,
+		SentTimestamp:     now.UnixNano() / int64(time.Millisecond),
+		VisibleAt:         now.Add(time.Duration(delay) * time.Second).UnixNano(),
+	}
+	// File names sort by sending time, so that older messages are received first
+	name := fmt.Sprintf("%020d-%s%s", now.UnixNano(), msg.MessageID, messageExt)
+	if err := writeJSON(filepath.Join(dir, name), msg); err != nil {
+		return nil, err
+	}
+	return &sqs.SendMessageOutput{MessageId: aws.String(msg.MessageID)}, nil
+}
+
+// ReceiveMessage receives up to MaxNumberOfMessages visible messages from a
+// queue, waiting up to WaitTimeSeconds for one to be available. The messages
+// are hidden for VisibilityTimeout seconds, or the timeout of the queue.
+func (q *Queues) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	dir, err := q.queueDir(aws.ToString(params.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	max := int(params.MaxNumberOfMessages)
+	if max <= 0 {
+		max = 1
+	}
+	if max > 10 {
+		return nil, &types.OverLimit{Message: aws.String("MaxNumberOfMessages must be between 1 and 10")}
+	}
+	deadline := q.Now().Add(time.Duration(params.WaitTimeSeconds) * time.Second)
+	for {
+		msgs, err := q.receive(dir, params, max)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 || !q.Now().Before(deadline) {
+			return &sqs.ReceiveMessageOutput{Messages: msgs}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(q.PollInterval):
+		}
+	}
+}
+
+// receive takes up to max visible messages from the queue stored in dir.
+func (q *Queues) receive(dir string, params *sqs.ReceiveMessageInput, max int) ([]types.Message, error) {
+	unlock, err := lock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var attrs queueAttributes
+	if err := readJSON(filepath.Join(dir, attributesFile), &attrs); err != nil {
+		return nil, err
+	}
+	visibility := time.Duration(attrs.VisibilityTimeout) * time.Second
+	if params.VisibilityTimeout > 0 {
+		visibility = time.Duration(params.VisibilityTimeout) * time.Second
+	}
+	names, err := messageFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []types.Message
+	now := q.Now()
+	for _, name := range names {
+		if len(msgs) == max {
+			break
+		}
+		var stored storedMessage
+		if err := readJSON(filepath.Join(dir, name), &stored); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if stored.VisibleAt > now.UnixNano() {
+			continue
+		}
+		stored.ReceiveCount++
+		if stored.FirstReceiveTimestamp == 0 {
+			stored.FirstReceiveTimestamp = now.UnixNano() / int64(time.Millisecond)
+		}
+		stored.VisibleAt = now.Add(visibility).UnixNano()
+		stored.ReceiptHandle = name + "#" + newID()
+		if err := writeJSON(filepath.Join(dir, name), stored); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, stored.message(params.AttributeNames, params.MessageAttributeNames))
+	}
+	return msgs, nil
+}
+
+// DeleteMessage deletes a message using the receipt handle of its last receive.
+func (q *Queues) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	dir, err := q.queueDir(aws.ToString(params.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	path, _, err := q.findMessage(dir, aws.ToString(params.ReceiptHandle))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// ChangeMessageVisibility hides a received message for VisibilityTimeout
+// seconds from now, a timeout of 0 makes it visible again at once.
+func (q *Queues) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	dir, err := q.queueDir(aws.ToString(params.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	path, stored, err := q.findMessage(dir, aws.ToString(params.ReceiptHandle))
+	if err != nil {
+		return nil, err
+	}
+	now := q.Now()
+	if stored.VisibleAt <= now.UnixNano() {
+		return nil, &types.MessageNotInflight{Message: aws.String("message is not in flight")}
+	}
+	stored.VisibleAt = now.Add(time.Duration(params.VisibilityTimeout) * time.Second).UnixNano()
+	if err := writeJSON(path, stored); err != nil {
+		return nil, err
+	}
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// GetQueueAttributes returns the approximate number of visible, in flight and
+// delayed messages of a queue, and its timeouts.
+func (q *Queues) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	dir, err := q.queueDir(aws.ToString(params.QueueUrl))
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var attrs queueAttributes
+	if err := readJSON(filepath.Join(dir, attributesFile), &attrs); err != nil {
+		return nil, err
+	}
+	names, err := messageFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var visible, inFlight, delayed int
+	now := q.Now().UnixNano()
+	for _, name := range names {
+		var stored storedMessage
+		if err := readJSON(filepath.Join(dir, name), &stored); err != nil {
+			continue
+		}
+		switch {
+		case stored.VisibleAt <= now:
+			visible++
+		case stored.ReceiveCount > 0:
+			inFlight++
+		default:
+			delayed++
+		}
+	}
+
+	all := map[types.QueueAttributeName]string{
+		types.QueueAttributeNameApproximateNumberOfMessages:           strconv.Itoa(visible),
+		types.QueueAttributeNameApproximateNumberOfMessagesNotVisible: strconv.Itoa(inFlight),
+		types.QueueAttributeNameApproximateNumberOfMessagesDelayed:    strconv.Itoa(delayed),
+		types.QueueAttributeNameVisibilityTimeout:                     strconv.Itoa(int(attrs.VisibilityTimeout)),
+		types.QueueAttributeNameDelaySeconds:                          strconv.Itoa(int(attrs.DelaySeconds)),
+		types.QueueAttributeNameCreatedTimestamp:                      strconv.FormatInt(attrs.CreatedTimestamp, 10),
+	}
+	out := &sqs.GetQueueAttributesOutput{Attributes: make(map[string]string)}
+	for name, val := range all {
+		if wanted(params.AttributeNames, name) {
+			out.Attributes[string(name)] = val
+		}
+	}
+	return out, nil
+}
+
+// message returns the stored message as received, with the system and message
+// attributes selected by attributeNames and messageAttributeNames.
+func (m storedMessage) message(attributeNames []types.QueueAttributeName, messageAttributeNames []string) types.Message {
+	msg := types.Message{
+		MessageId:     aws.String(m.MessageID),
+		Body:          aws.String(m.Body),
+		ReceiptHandle: aws.String(m.ReceiptHandle),
+	}
+	system := map[types.QueueAttributeName]string{
+		types.QueueAttributeName(types.MessageSystemAttributeNameSentTimestamp):                    strconv.FormatInt(m.SentTimestamp, 10),
+		types.QueueAttributeName(types.MessageSystemAttributeNameApproximateReceiveCount):          strconv.Itoa(m.ReceiveCount),
+		types.QueueAttributeName(types.MessageSystemAttributeNameApproximateFirstReceiveTimestamp): strconv.FormatInt(m.FirstReceiveTimestamp, 10),
+	}
+	for name, val := range system {
+		if wanted(attributeNames, name) {
+			if msg.Attributes == nil {
+				msg.Attributes = make(map[string]string)
+			}
+			msg.Attributes[string(name)] = val
+		}
+	}
+	for name, val := range m.MessageAttributes {
+		for _, wantedName := range messageAttributeNames {
+			if wantedName == "All" || wantedName == ".*" || wantedName == name ||
+				strings.HasSuffix(wantedName, ".*") && strings.HasPrefix(name, strings.TrimSuffix(wantedName, "*")) {
+				if msg.MessageAttributes == nil {
+					msg.MessageAttributes = make(map[string]types.MessageAttributeValue)
+				}
+				msg.MessageAttributes[name] = val
+				break
+			}
+		}
+	}
+	return msg
+}
+
+func wanted(names []types.QueueAttributeName, name types.QueueAttributeName) bool {
+	for _, n := range names {
+		if n == types.QueueAttributeNameAll || n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findMessage returns the path and content of the message whose last receipt handle is handle.
+func (q *Queues) findMessage(dir string, handle string) (string, storedMessage, error) {
+	var stored storedMessage
+	idx := strings.LastIndex(handle, "#")
+	if idx <= 0 || strings.ContainsAny(handle[:idx], `/\`) {
+		return "", stored, &types.ReceiptHandleIsInvalid{Message: aws.String("invalid receipt handle '" + handle + "'")}
+	}
+	path := filepath.Join(dir, handle[:idx])
+	if err := readJSON(path, &stored); err != nil {
+		if os.IsNotExist(err) {
+			return "", stored, &types.ReceiptHandleIsInvalid{Message: aws.String("message of receipt handle '" + handle + "' does not exist")}
+		}
+		return "", stored, err
+	}
+	if stored.ReceiptHandle != handle {
+		return "", stored, &types.ReceiptHandleIsInvalid{Message: aws.String("receipt handle '" + handle + "' has expired")}
+	}
+	return path, stored, nil
+}
+
+// url returns the URL of the queue named name.
+func (q *Queues) url(name string) string {
+	return "file://" + filepath.ToSlash(filepath.Join(q.dir, name))
+}
+
+// queueDir returns the directory of the queue of a URL returned by GetQueueUrl.
+func (q *Queues) queueDir(url string) (string, error) {
+	dir := filepath.FromSlash(strings.TrimPrefix(url, "file://"))
+	if !strings.HasPrefix(url, "file://") || filepath.Dir(dir) != q.dir {
+		return "", &types.QueueDoesNotExist{Message: aws.String("unknown queue URL '" + url + "'")}
+	}
+	if _, err := os.Stat(filepath.Join(dir, attributesFile)); err != nil {
+		return "", &types.QueueDoesNotExist{Message: aws.String("queue '" + filepath.Base(dir) + "' does not exist")}
+	}
+	return dir, nil
+}
+
+// messageFiles returns the names of the message files of the queue stored in dir, oldest first.
+func messageFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), messageExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("failed to generate id: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON replaces the file at path with the JSON encoding of v. The file is
+// renamed into place, readers never see a partly written file.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, bytes.NewReader(data))
+}
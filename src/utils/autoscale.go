@@ -0,0 +1,349 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Tags of the instances of the worker fleet
+const (
+	// RoleTag is the key of the tag naming the role of an instance.
+	RoleTag = "Role"
+	// RoleWorker is the RoleTag value of the worker instances.
+	RoleWorker = "worker"
+)
+
+// ScalingPolicy sizes the worker fleet after the jobs of a queue.
+type ScalingPolicy struct {
+	MinWorkers int
+	MaxWorkers int
+	// JobsPerWorker is the number of jobs, waiting or in progress, a worker
+	// is counted for.
+	JobsPerWorker int
+	// MaxBacklogAge adds a worker when jobs have been waiting in the queue for
+	// longer, whatever their number. 0 disables it.
+	MaxBacklogAge time.Duration
+	// ScaleOutCooldown is the least time between two scale outs.
+	ScaleOutCooldown time.Duration
+	// ScaleInCooldown is the least time between a scaling and a scale in.
+	ScaleInCooldown time.Duration
+}
+
+// Validate checks the fields of a policy.
+func (p ScalingPolicy) Validate() error {
+	switch {
+	case p.MinWorkers < 0 || p.MaxWorkers < p.MinWorkers:
+		return fmt.Errorf("invalid scaling policy: the fleet size bounds must not be negative or decreasing")
+	case p.JobsPerWorker < 1:
+		return fmt.Errorf("invalid scaling policy: JobsPerWorker must be at least 1")
+	case p.MaxBacklogAge < 0 || p.ScaleOutCooldown < 0 || p.ScaleInCooldown < 0:
+		return fmt.Errorf("invalid scaling policy: durations must not be negative")
+	}
+	return nil
+}
+
+// QueueDepth is the load of the job queues.
+type QueueDepth struct {
+	// Waiting is the approximate number of jobs waiting, delayed ones included.
+	Waiting int
+	// InFlight is the approximate number of jobs in progress.
+	InFlight int
+	// Age is how long the queues have had jobs waiting. Amazon SQS only
+	// publishes the age of the oldest message to CloudWatch, which the
+	// autoscaler does not use, so it is measured from the first check of the
+	// autoscaler that found jobs waiting. It underestimates the age of the
+	// jobs that were waiting already when the autoscaler started.
+	Age time.Duration
+}
+
+// Desired returns the size of the fleet for depth, current workers running.
+func (p ScalingPolicy) Desired(current int, depth QueueDepth) int {
+	desired := (depth.Waiting + depth.InFlight + p.JobsPerWorker - 1) / p.JobsPerWorker
+	if depth.Waiting > 0 && p.MaxBacklogAge > 0 && depth.Age >= p.MaxBacklogAge && desired <= current {
+		desired = current + 1
+	}
+	if desired < p.MinWorkers {
+		desired = p.MinWorkers
+	}
+	if desired > p.MaxWorkers {
+		desired = p.MaxWorkers
+	}
+	return desired
+}
+
+// RunInput returns the input launching count instances of the template.
+func (l LaunchConfig) RunInput(count int) (ec2.RunInstancesInput, error) {
+	input := ec2.RunInstancesInput{
+		MinCount:         int32(count),
+		MaxCount:         int32(count),
+		InstanceType:     ec2types.InstanceType(l.InstanceType),
+		SecurityGroupIds: l.SecurityGroupIDs,
+	}
+	if l.ImageID != "" {
+		input.ImageId = aws.String(l.ImageID)
+	}
+	if l.KeyName != "" {
+		input.KeyName = aws.String(l.KeyName)
+	}
+	if l.SubnetID != "" {
+		input.SubnetId = aws.String(l.SubnetID)
+	}
+	if l.InstanceProfile != "" {
+		input.IamInstanceProfile = &ec2types.IamInstanceProfileSpecification{Name: aws.String(l.InstanceProfile)}
+	}
+	if l.Bootstrap != nil {
+		userData, err := l.Bootstrap.UserData()
+		if err != nil {
+			return input, err
+		}
+		input.UserData = aws.String(userData)
+	}
+	return input, nil
+}
+
+// Autoscaler grows and shrinks the fleet of the instances tagged with the
+// role Role after the depth of the job queues. It grows the fleet by starting
+// its stopped instances first, then by launching new ones, and shrinks it by
+// stopping the instances launched last, whose workers drain on shutdown.
+type Autoscaler struct {
+	Policy ScalingPolicy
+	EC2    EC2API
+	SQS    WorkerQueueSweepAPI
+	// QueueURLs are the URLs of the queues whose jobs size the fleet, such as
+	// the job and the sub-job queues.
+	QueueURLs []string
+	// Leases, when not nil, adds the jobs of the queues of the workers with a
+	// lease stored in LeaseBucket to the depth.
+	Leases      S3ListObjectsAPI
+	LeaseBucket string
+	// Role is the RoleTag value of the instances of the fleet, RoleWorker if empty.
+	Role string
+	// Launch is the template of the instances launched, the autoscaler sets
+	// their count and adds the role tag.
+	Launch ec2.RunInstancesInput
+	// Now returns the current time, tests can replace it.
+	Now func() time.Time
+
+	backlogSince time.Time
+	lastOut      time.Time
+	lastScaled   time.Time
+}
+
+// ScalingAction is what a step of an Autoscaler saw and did.
+type ScalingAction struct {
+	Depth   QueueDepth
+	Current int
+	Desired int
+	// Cooldown is the time left before the fleet can be scaled to Desired.
+	Cooldown time.Duration
+	// Started, Launched and Stopped are the IDs of the instances changed.
+	Started  []string
+	Launched []string
+	Stopped  []string
+}
+
+// Step checks the depth of the queues and the fleet once, and scales the fleet
+// unless it is in a cooldown. The returned action lists the instances changed
+// before any error.
+func (a *Autoscaler) Step(ctx context.Context) (ScalingAction, error) {
+	now := time.Now()
+	if a.Now != nil {
+		now = a.Now()
+	}
+	var action ScalingAction
+	depth, err := a.queueDepth(ctx, now)
+	if err != nil {
+		return action, err
+	}
+	running, stopped, err := a.fleet(ctx)
+	if err != nil {
+		return action, err
+	}
+	action.Depth, action.Current = depth, len(running)
+	action.Desired = a.Policy.Desired(len(running), depth)
+
+	switch {
+	case action.Desired > action.Current:
+		if left := a.cooldown(now, a.lastOut, a.Policy.ScaleOutCooldown); left > 0 {
+			action.Cooldown = left
+			return action, nil
+		}
+		n := action.Desired - action.Current
+		if n > len(stopped) {
+			action.Started = stopped
+		} else {
+			action.Started = stopped[:n]
+		}
+		if len(action.Started) > 0 {
+			a.lastOut, a.lastScaled = now, now
+			_, err := StartInstance(ctx, a.EC2, &ec2.StartInstancesInput{InstanceIds: action.Started})
+			if err != nil {
+				action.Started = nil
+				return action, WrapError("StartInstances", "", err)
+			}
+		}
+		if n -= len(action.Started); n > 0 {
+			a.lastOut, a.lastScaled = now, now
+			action.Launched, err = a.launch(ctx, n)
+			if err != nil {
+				return action, err
+			}
+		}
+	case action.Desired < action.Current:
+		if left := a.cooldown(now, a.lastScaled, a.Policy.ScaleInCooldown); left > 0 {
+			action.Cooldown = left
+			return action, nil
+		}
+		// The instances launched last go first
+		sort.SliceStable(running, func(i, j int) bool {
+			return running[i].LaunchTime.After(running[j].LaunchTime)
+		})
+		for _, i := range running[:action.Current-action.Desired] {
+			action.Stopped = append(action.Stopped, i.Id)
+		}
+		a.lastScaled = now
+		_, err := StopInstance(ctx, a.EC2, &ec2.StopInstancesInput{InstanceIds: action.Stopped})
+		if err != nil {
+			action.Stopped = nil
+			return action, WrapError("StopInstances", "", err)
+		}
+	}
+	return action, nil
+}
+
+// cooldown returns the time left at now of the cooldown d started at last.
+func (a *Autoscaler) cooldown(now time.Time, last time.Time, d time.Duration) time.Duration {
+	if last.IsZero() {
+		return 0
+	}
+	if left := last.Add(d).Sub(now); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// queueDepth returns the depth of the queues at now.
+func (a *Autoscaler) queueDepth(ctx context.Context, now time.Time) (QueueDepth, error) {
+	urls := append([]string(nil), a.QueueURLs...)
+	if a.Leases != nil {
+		queues, err := ListWorkerLeases(ctx, a.Leases, a.LeaseBucket)
+		if err != nil {
+			return QueueDepth{}, err
+		}
+		for _, name := range queues {
+			url, err := GetQueueURLSimple(ctx, a.SQS, name)
+			if errors.Is(err, ErrQueueNotFound) {
+				continue
+			}
+			if err != nil {
+				return QueueDepth{}, err
+			}
+			urls = append(urls, url)
+		}
+	}
+	var depth QueueDepth
+	for _, url := range urls {
+		d, err := queueLoad(ctx, a.SQS, url)
+		if err != nil {
+			return QueueDepth{}, err
+		}
+		depth.Waiting += d.Waiting
+		depth.InFlight += d.InFlight
+	}
+	if depth.Waiting == 0 {
+		a.backlogSince = time.Time{}
+	} else {
+		if a.backlogSince.IsZero() {
+			a.backlogSince = now
+		}
+		depth.Age = now.Sub(a.backlogSince)
+	}
+	return depth, nil
+}
+
+// queueLoad returns the approximate numbers of messages waiting and in flight
+// in the queue queueURL, without their age.
+func queueLoad(ctx context.Context, client SQSGetQueueAttributesAPI, queueURL string) (QueueDepth, error) {
+	out, err := GetQueueAttrs(ctx, client, &sqs.GetQueueAttributesInput{
+		QueueUrl: &queueURL,
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+		},
+	})
+	if err != nil {
+		return QueueDepth{}, WrapError("GetQueueAttributes", queueURL, err)
+	}
+	count := func(name types.QueueAttributeName) int {
+		n, _ := strconv.Atoi(out.Attributes[string(name)])
+		return n
+	}
+	return QueueDepth{
+		Waiting:  count(types.QueueAttributeNameApproximateNumberOfMessages) + count(types.QueueAttributeNameApproximateNumberOfMessagesDelayed),
+		InFlight: count(types.QueueAttributeNameApproximateNumberOfMessagesNotVisible),
+	}, nil
+}
+
+// fleet returns the pending or running instances of the fleet, and the IDs of
+// its stopped instances.
+func (a *Autoscaler) fleet(ctx context.Context) ([]InstanceInfo, []string, error) {
+	role := a.Role
+	if role == "" {
+		role = RoleWorker
+	}
+	instances, err := ListEC2Instances(ctx, a.EC2, InstanceFilter{
+		Tags: map[string]string{RoleTag: role},
+		States: []ec2types.InstanceStateName{
+			ec2types.InstanceStateNamePending,
+			ec2types.InstanceStateNameRunning,
+			ec2types.InstanceStateNameStopped,
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var running []InstanceInfo
+	var stopped []string
+	for _, i := range instances {
+		if i.State == ec2types.InstanceStateNameStopped {
+			stopped = append(stopped, i.Id)
+		} else {
+			running = append(running, i)
+		}
+	}
+	return running, stopped, nil
+}
+
+// launch launches n instances of the fleet and returns their IDs.
+func (a *Autoscaler) launch(ctx context.Context, n int) ([]string, error) {
+	role := a.Role
+	if role == "" {
+		role = RoleWorker
+	}
+	input := a.Launch
+	input.MinCount, input.MaxCount = int32(n), int32(n)
+	input.TagSpecifications = append([]ec2types.TagSpecification{{
+		ResourceType: ec2types.ResourceTypeInstance,
+		Tags:         []ec2types.Tag{{Key: aws.String(RoleTag), Value: aws.String(role)}},
+	}}, input.TagSpecifications...)
+	out, err := MakeInstance(ctx, a.EC2, &input)
+	if err != nil {
+		return nil, WrapError("RunInstances", "", err)
+	}
+	ids := make([]string, 0, len(out.Instances))
+	for _, i := range out.Instances {
+		ids = append(ids, aws.ToString(i.InstanceId))
+	}
+	return ids, nil
+}
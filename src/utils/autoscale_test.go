@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"wordcounter/src/fakeaws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+func TestScalingPolicyDesired(t *testing.T) {
+	policy := ScalingPolicy{MinWorkers: 1, MaxWorkers: 4, JobsPerWorker: 2, MaxBacklogAge: time.Minute}
+	tests := []struct {
+		name    string
+		current int
+		depth   QueueDepth
+		want    int
+	}{
+		{"idle", 3, QueueDepth{}, 1},
+		{"waiting", 1, QueueDepth{Waiting: 3}, 2},
+		{"in flight", 3, QueueDepth{Waiting: 1, InFlight: 4}, 3},
+		{"capped", 2, QueueDepth{Waiting: 20}, 4},
+		{"young backlog", 2, QueueDepth{Waiting: 1, InFlight: 2, Age: time.Second}, 2},
+		{"old backlog", 2, QueueDepth{Waiting: 1, InFlight: 2, Age: time.Minute}, 3},
+		{"old backlog capped", 4, QueueDepth{Waiting: 1, Age: time.Hour}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Desired(tt.current, tt.depth); got != tt.want {
+				t.Errorf("Desired(%d, %+v) = %d, want %d", tt.current, tt.depth, got, tt.want)
+			}
+		})
+	}
+}
+
+// worker returns an instance of the worker fleet launched at launched.
+func worker(id string, state types.InstanceStateName, launched time.Time) types.Instance {
+	i := fakeaws.NewInstance(id, id, state, "", "")
+	i.Tags = append(i.Tags, types.Tag{Key: aws.String(RoleTag), Value: aws.String(RoleWorker)})
+	i.LaunchTime = aws.Time(launched)
+	return i
+}
+
+func TestAutoscalerStep(t *testing.T) {
+	ctx := context.TODO()
+	start := time.Now()
+	ec2Client := fakeaws.NewEC2(
+		worker("i-old", types.InstanceStateNameRunning, start.Add(-2*time.Hour)),
+		worker("i-new", types.InstanceStateNameRunning, start.Add(-time.Hour)),
+		worker("i-stopped", types.InstanceStateNameStopped, start.Add(-3*time.Hour)),
+		fakeaws.NewInstance("i-other", "other", types.InstanceStateNameStopped, "", ""),
+	)
+	sqsClient := fakeaws.NewSQS("jobs", "subjobs", "jobs-i-new")
+	s3Client := fakeaws.NewS3("results")
+	for _, queue := range []string{"jobs-i-new", "jobs-i-gone"} {
+		if err := SaveWorkerLease(ctx, s3Client, "results", WorkerLease{WorkerID: "i-new", Queue: queue}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := start
+	a := &Autoscaler{
+		Policy: ScalingPolicy{
+			MinWorkers: 1, MaxWorkers: 5, JobsPerWorker: 2,
+			ScaleOutCooldown: time.Minute, ScaleInCooldown: 5 * time.Minute,
+		},
+		EC2:         ec2Client,
+		SQS:         sqsClient,
+		QueueURLs:   []string{fakeaws.QueueURL("jobs"), fakeaws.QueueURL("subjobs")},
+		Leases:      s3Client,
+		LeaseBucket: "results",
+		Now:         func() time.Time { return now },
+	}
+	jobs := fakeaws.QueueURL("jobs")
+	send := func(url string, n int) {
+		for i := 0; i < n; i++ {
+			_, err := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: &url, MessageBody: aws.String(strconv.Itoa(i))})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	purge := func() {
+		for {
+			out, err := sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{QueueUrl: &jobs, MaxNumberOfMessages: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out.Messages) == 0 {
+				return
+			}
+			for _, m := range out.Messages {
+				sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: &jobs, ReceiptHandle: m.ReceiptHandle})
+			}
+		}
+	}
+
+	steps := []struct {
+		name    string
+		after   time.Duration
+		prepare func()
+		want    ScalingAction
+	}{
+		{
+			name:    "scale out starts the stopped instance, then launches",
+			prepare: func() { send(jobs, 9) },
+			want: ScalingAction{Depth: QueueDepth{Waiting: 9}, Current: 2, Desired: 5,
+				Started: []string{"i-stopped"}, Launched: []string{"i-00000001", "i-00000002"}},
+		},
+		{
+			name:  "scale in cooldown",
+			after: time.Minute,
+			prepare: func() {
+				purge()
+				send(jobs, 3)
+			},
+			want: ScalingAction{Depth: QueueDepth{Waiting: 3, Age: time.Minute}, Current: 5, Desired: 2, Cooldown: 4 * time.Minute},
+		},
+		{
+			name:  "scale in stops the instances launched last",
+			after: 4 * time.Minute,
+			want: ScalingAction{Depth: QueueDepth{Waiting: 3, Age: 5 * time.Minute}, Current: 5, Desired: 2,
+				Stopped: []string{"i-00000001", "i-00000002", "i-new"}},
+		},
+		{
+			name:    "scale out cooldown is over",
+			after:   time.Minute,
+			prepare: func() { send(jobs, 3) },
+			want: ScalingAction{Depth: QueueDepth{Waiting: 6, Age: 6 * time.Minute}, Current: 2, Desired: 3,
+				Started: []string{"i-new"}},
+		},
+		{
+			name:  "scale out cooldown",
+			after: 30 * time.Second,
+			prepare: func() {
+				purge()
+				send(jobs, 10)
+			},
+			want: ScalingAction{Depth: QueueDepth{Waiting: 10, Age: 6*time.Minute + 30*time.Second}, Current: 3, Desired: 5,
+				Cooldown: 30 * time.Second},
+		},
+		{
+			name:  "the sub-jobs and the jobs addressed to a worker count",
+			after: 30 * time.Second,
+			prepare: func() {
+				purge()
+				send(fakeaws.QueueURL("subjobs"), 2)
+				send(fakeaws.QueueURL("jobs-i-new"), 1)
+			},
+			want: ScalingAction{Depth: QueueDepth{Waiting: 3, Age: 7 * time.Minute}, Current: 3, Desired: 2,
+				Cooldown: 4 * time.Minute},
+		},
+	}
+	for _, step := range steps {
+		now = now.Add(step.after)
+		if step.prepare != nil {
+			step.prepare()
+		}
+		got, err := a.Step(ctx)
+		if err != nil {
+			t.Fatalf("%s: Step() error = %v", step.name, err)
+		}
+		// The instances launched in the same call may have the same launch time
+		sort.Strings(got.Stopped)
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: Step() = %+v, want %+v", step.name, got, step.want)
+		}
+	}
+
+	for _, i := range ec2Client.Instances() {
+		if aws.ToString(i.InstanceId) == "i-other" && i.State.Name != types.InstanceStateNameStopped {
+			t.Errorf("instance outside of the fleet is %s", i.State.Name)
+		}
+	}
+}
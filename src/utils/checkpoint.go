@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Checkpoint is the progress of a worker counting the object, or the byte
+// range of it, of a job. It is stored in the result bucket so that another
+// delivery of the job resumes the count instead of starting over.
+type Checkpoint struct {
+	JobID JobID `json:"jobId"`
+	// Range is the byte range of the job, nil for the whole object.
+	Range *ByteRange `json:"range,omitempty"`
+	// ETag is the entity tag of the object counted, the checkpoint is of no
+	// use for another version of the object.
+	ETag string `json:"etag"`
+	// Offset is the offset in the object of the word boundary up to which
+	// the text was counted into Counts.
+	Offset   int64          `json:"offset"`
+	Counts   map[string]int `json:"counts"`
+	WorkerID string         `json:"workerId,omitempty"`
+	// Instance is the instance the worker runs on, if known.
+	Instance *Identity `json:"instance,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// CheckpointKey returns the key of the checkpoint of the job jobID, or of its
+// byte range rng if not nil, in the result bucket.
+func CheckpointKey(jobID JobID, rng *ByteRange) string {
+	if rng == nil {
+		return "checkpoints/" + jobID.String() + ".json"
+	}
+	return PartialCheckpointPrefix(jobID) + rng.String() + ".json"
+}
+
+// PartialCheckpointPrefix returns the prefix of the keys of the checkpoints of
+// the byte ranges of the job jobID.
+func PartialCheckpointPrefix(jobID JobID) string {
+	return "checkpoints/" + jobID.String() + "/"
+}
+
+// SaveCheckpoint stores cp as key in bucket, replacing the previous one.
+func SaveCheckpoint(ctx context.Context, client S3PutObjectAPI, bucket string, key string, cp Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	_, err = PutFile(ctx, client, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return WrapError("PutObject", ObjectName(bucket, key), err)
+	}
+	Log().Debug("saved checkpoint", LogKeyJobID, cp.JobID, LogKeyKey, key, "offset", cp.Offset)
+	return nil
+}
+
+// LoadCheckpoint returns the checkpoint stored as key in bucket, or nil if
+// there is none.
+func LoadCheckpoint(ctx context.Context, client S3GetObjectAPI, bucket string, key string) (*Checkpoint, error) {
+	obj, err := GetObject(ctx, client, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		err = WrapError("GetObject", ObjectName(bucket, key), err)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	data, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint '%s': %v", key, err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint '%s': %v", key, err)
+	}
+	if cp.Counts == nil {
+		cp.Counts = make(map[string]int)
+	}
+	return &cp, nil
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"wordcounter/src/fakeaws"
+)
+
+func TestCheckpoint(t *testing.T) {
+	client := fakeaws.NewS3("results")
+	id := NewJobID()
+	key := CheckpointKey(id, &ByteRange{Start: 100, End: 200})
+	if want := "checkpoints/" + id.String() + "/100-200.json"; key != want {
+		t.Errorf("CheckpointKey() = %s, want %s", key, want)
+	}
+
+	if cp, err := LoadCheckpoint(context.TODO(), client, "results", key); cp != nil || err != nil {
+		t.Errorf("LoadCheckpoint() without checkpoint = %+v, %v, want nil, nil", cp, err)
+	}
+	want := Checkpoint{
+		JobID:  id,
+		Range:  &ByteRange{Start: 100, End: 200},
+		ETag:   `"abc"`,
+		Offset: 150,
+		Counts: map[string]int{"alice": 2},
+		Time:   time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	if err := SaveCheckpoint(context.TODO(), client, "results", key, want); err != nil {
+		t.Fatalf("SaveCheckpoint() error = %v", err)
+	}
+	got, err := LoadCheckpoint(context.TODO(), client, "results", key)
+	if err != nil || got == nil || !reflect.DeepEqual(*got, want) {
+		t.Errorf("LoadCheckpoint() = %+v, %v, want %+v", got, err, want)
+	}
+}
@@ -2,45 +2,62 @@ package utils
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 )
 
+// SubmitDelay is how long a job submitted with SubmitJob stays hidden in the
+// job queue before a worker can receive it.
+const SubmitDelay = 10 * time.Second
+
+// InstanceInfo is an Amazon EC2 instance, to which jobs can be addressed.
 type InstanceInfo struct {
-	Name      string
-	Id        string
-	PublicIP  string
-	PrivateIP string
+	Name             string
+	Id               string
+	PublicIP         string
+	PrivateIP        string
+	State            ec2types.InstanceStateName
+	InstanceType     string
+	AvailabilityZone string
+	LaunchTime       time.Time
 }
 
-func SubmitJob(client *sqs.Client, queueName string, instance InstanceInfo, fileKey string, s3bucket string) bool {
-	// Get URL of queue
-	queue := &queueName
-	gQInput := &sqs.GetQueueUrlInput{
-		QueueName: queue,
+// SubmitJob sends job to the queue named queueName, addressed to instance.
+// A new JobID is generated unless job already has one, and is returned with
+// any error of the encoding or of the calls to Amazon SQS. In a FIFO queue,
+// the job is neither delayed nor sent twice.
+func SubmitJob(ctx context.Context, client SQSAPI, queueName string, instance InstanceInfo, job JobMessage) (JobID, error) {
+	if job.JobID == "" {
+		job.JobID = NewJobID()
 	}
-
-	result, err := GetQueueURL(context.TODO(), client, gQInput)
+	body, err := EncodeJob(job)
 	if err != nil {
-		fmt.Println("Got an error getting the queue URL:")
-		fmt.Println(err)
-		return false
+		return job.JobID, err
 	}
 
-	queueURL := result.QueueUrl
+	// Get URL of queue
+	queueURL, err := GetQueueURLSimple(ctx, client, queueName)
+	if err != nil {
+		return job.JobID, err
+	}
 
 	sMInput := &sqs.SendMessageInput{
-		DelaySeconds: 10,
+		DelaySeconds: int32(SubmitDelay / time.Second),
 		MessageAttributes: map[string]types.MessageAttributeValue{
 			"JobId": {
-				DataType:    aws.String("Number"),
-				StringValue: aws.String(fmt.Sprint(time.Now().UnixNano() / int64(time.Millisecond))),
+				DataType:    aws.String("String"),
+				StringValue: aws.String(job.JobID.String()),
 			},
 			"WorkerId": {
 				DataType:    aws.String("String"),
@@ -55,121 +72,258 @@ func SubmitJob(client *sqs.Client, queueName string, instance InstanceInfo, file
 				StringValue: aws.String(instance.PrivateIP),
 			},
 		},
-		MessageBody: aws.String(fileKey + " " + s3bucket),
-		QueueUrl:    queueURL,
+		MessageBody: aws.String(body),
+		QueueUrl:    &queueURL,
 	}
+	SetFIFOParams(sMInput, DeduplicationID(job.JobID, job.Range), MessageGroupID(job))
 
-	resp, err := SendMsg(context.TODO(), client, sMInput)
+	resp, err := SendMsg(ctx, client, sMInput)
 	if err != nil {
-		fmt.Println("Got an error sending the message:")
-		fmt.Println(err)
-		return false
+		return job.JobID, WrapError("SendMessage", queueName, err)
 	}
 
-	fmt.Printf("Sent job msg with ID '%s' for instance '%s':'%s' to queue:'%s'\n", *resp.MessageId, instance.Id, instance.PublicIP, *queueURL)
-	return true
+	Log().Info("sent job", LogKeyJobID, job.JobID, "message_id", aws.ToString(resp.MessageId),
+		LogKeyQueue, queueName, LogKeyWorkerID, instance.Id, "worker_public_ip", instance.PublicIP)
+	return job.JobID, nil
 }
 
-func ListEC2Instances(client *ec2.Client) []InstanceInfo {
-	input := &ec2.DescribeInstancesInput{}
+// InstanceFilter selects the instances listed by ListEC2Instances.
+type InstanceFilter struct {
+	// Tags are the tags the instances must have, with their values.
+	Tags map[string]string
+	// States are the states the instances may be in, running if empty.
+	States []ec2types.InstanceStateName
+	// PageSize is the number of instances described per call, between 5 and
+	// 1000, or 0 to let Amazon EC2 decide.
+	PageSize int32
+}
 
-	result, err := GetInstances(context.TODO(), client, input)
-	if err != nil {
-		fmt.Println("Got an error retrieving information about your Amazon EC2 instances:")
-		fmt.Println(err)
-		return nil
+// WorkerFilter selects the running worker instances.
+var WorkerFilter = InstanceFilter{Tags: map[string]string{RoleTag: RoleWorker}}
+
+// input returns the DescribeInstances input of the filter.
+func (f InstanceFilter) input() *ec2.DescribeInstancesInput {
+	states := f.States
+	if len(states) == 0 {
+		states = []ec2types.InstanceStateName{ec2types.InstanceStateNameRunning}
+	}
+	stateFilter := ec2types.Filter{Name: aws.String("instance-state-name")}
+	for _, state := range states {
+		stateFilter.Values = append(stateFilter.Values, string(state))
+	}
+	input := &ec2.DescribeInstancesInput{Filters: []ec2types.Filter{stateFilter}, MaxResults: f.PageSize}
+	keys := make([]string, 0, len(f.Tags))
+	for key := range f.Tags {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		input.Filters = append(input.Filters, ec2types.Filter{Name: aws.String("tag:" + key), Values: []string{f.Tags[key]}})
+	}
+	return input
+}
+
+// retryingDescriber retries the DescribeInstances calls of a paginator.
+type retryingDescriber struct {
+	api EC2DescribeInstancesAPI
+}
+
+func (r retryingDescriber) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	return GetInstances(ctx, r.api, params)
+}
+
+// ListEC2Instances returns the Amazon EC2 instances selected by filter, from
+// all the pages of the results.
+func ListEC2Instances(ctx context.Context, client EC2DescribeInstancesAPI, filter InstanceFilter) ([]InstanceInfo, error) {
 	ret := make([]InstanceInfo, 0, 3)
-	for _, r := range result.Reservations {
-		// fmt.Println("Reservation ID: " + *r.ReservationId)
-		// fmt.Println("Running Instance IDs:")
-		for _, i := range r.Instances {
-			if i.State.Code == 16 {
-				// fmt.Println("   ", *i.InstanceId, *i.PublicIpAddress, *i.PrivateIpAddress)
-				tags := i.Tags
-				var name string
-				for _, val := range tags {
-					if *val.Key == "Name" {
-						name = *val.Value
-					}
-				}
-				ret = append(ret, InstanceInfo{
-					Name:      name,
-					Id:        *i.InstanceId,
-					PublicIP:  *i.PublicIpAddress,
-					PrivateIP: *i.PrivateIpAddress,
-				})
+	pages := ec2.NewDescribeInstancesPaginator(retryingDescriber{client}, filter.input())
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, WrapError("DescribeInstances", "", err)
+		}
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				ret = append(ret, NewInstanceInfo(i))
 			}
-
 		}
-		// fmt.Println("")
 	}
-	fmt.Println("Running Instance:")
-	fmt.Printf("   %10s %20s %15s %15s\n", "Name", "Id", "PublicIP", "PrivateIP")
 	for _, val := range ret {
-		fmt.Printf("   %10s %20s %15s %15s\n", val.Name, val.Id, val.PublicIP, val.PrivateIP)
+		Log().Debug("listed instance", "name", val.Name, LogKeyWorkerID, val.Id, "state", val.State,
+			"public_ip", val.PublicIP, "private_ip", val.PrivateIP)
 	}
-	return ret
+	Log().Debug("listed instances", "count", len(ret))
+	return ret, nil
 }
 
-func GetLPMessagesByURL(client *sqs.Client, queueURL string, msgNum int, waitTime int) (*sqs.ReceiveMessageOutput, error) {
+// NewInstanceInfo returns the InstanceInfo of an instance described by Amazon
+// EC2. The fields missing from the description, such as the public IP of an
+// instance without one, are left empty.
+func NewInstanceInfo(i ec2types.Instance) InstanceInfo {
+	info := InstanceInfo{
+		Id:           aws.ToString(i.InstanceId),
+		PublicIP:     aws.ToString(i.PublicIpAddress),
+		PrivateIP:    aws.ToString(i.PrivateIpAddress),
+		InstanceType: string(i.InstanceType),
+		LaunchTime:   aws.ToTime(i.LaunchTime),
+	}
+	for _, tag := range i.Tags {
+		if aws.ToString(tag.Key) == "Name" {
+			info.Name = aws.ToString(tag.Value)
+		}
+	}
+	if i.State != nil {
+		info.State = i.State.Name
+	}
+	if i.Placement != nil {
+		info.AvailabilityZone = aws.ToString(i.Placement.AvailabilityZone)
+	}
+	return info
+}
+
+// GetLPMessagesByURL long polls the queue at queueURL for up to waitTime
+// seconds and returns at most msgNum messages, with all their message
+// attributes and their SentTimestamp and ApproximateReceiveCount attributes.
+func GetLPMessagesByURL(ctx context.Context, client SQSAPI, queueURL string, msgNum int, waitTime int) (*sqs.ReceiveMessageOutput, error) {
 	mInput := &sqs.ReceiveMessageInput{
 		QueueUrl: &queueURL,
 		AttributeNames: []types.QueueAttributeName{
 			"SentTimestamp",
+			"ApproximateReceiveCount",
 		},
-		MaxNumberOfMessages: 1,
+		MaxNumberOfMessages: int32(msgNum),
 		MessageAttributeNames: []string{
 			"All",
 		},
 		WaitTimeSeconds: int32(waitTime),
 	}
 
-	return GetLPMessages(context.TODO(), client, mInput)
+	resp, err := GetLPMessages(ctx, client, mInput)
+	if err != nil {
+		return nil, WrapError("ReceiveMessage", queueURL, err)
+	}
+	return resp, nil
 }
 
-func GetQueueURLSimple(client *sqs.Client, queueName string) string {
+// GetQueueURLSimple returns the URL of the queue named queueName.
+func GetQueueURLSimple(ctx context.Context, client SQSAPI, queueName string) (string, error) {
 	qInput := &sqs.GetQueueUrlInput{
 		QueueName: &queueName,
 	}
 
-	result, err := GetQueueURL(context.TODO(), client, qInput)
+	result, err := GetQueueURL(ctx, client, qInput)
 	if err != nil {
-		fmt.Println("Got an error getting the queue URL:")
-		fmt.Println(err)
-		return ""
+		return "", WrapError("GetQueueUrl", queueName, err)
 	}
 
-	return *result.QueueUrl
+	return *result.QueueUrl, nil
 }
 
-func RemoveMessageSimple(client *sqs.Client, queueName string, handle string) {
+// RemoveMessageSimple deletes the message received with handle from the queue at queueURL.
+func RemoveMessageSimple(ctx context.Context, client SQSAPI, queueURL string, handle string) error {
 	dMInput := &sqs.DeleteMessageInput{
-		QueueUrl:      &queueName,
+		QueueUrl:      &queueURL,
 		ReceiptHandle: &handle,
 	}
 
-	_, err := RemoveMessage(context.TODO(), client, dMInput)
+	_, err := RemoveMessage(ctx, client, dMInput)
 	if err != nil {
-		fmt.Println("Got an error deleting the message:")
-		fmt.Println(err)
-		return
+		return WrapError("DeleteMessage", queueURL, err)
+	}
+	Log().Debug("deleted message", LogKeyQueue, queueURL)
+	return nil
+}
+
+// ChangeVisibilitySimple hides the message received with handle from the queue
+// at queueURL for timeout from now. A zero timeout makes it visible at once.
+func ChangeVisibilitySimple(ctx context.Context, client SQSAPI, queueURL string, handle string, timeout time.Duration) error {
+	cvInput := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &queueURL,
+		ReceiptHandle:     &handle,
+		VisibilityTimeout: int32(timeout / time.Second),
+	}
+
+	_, err := ChangeVisibility(ctx, client, cvInput)
+	if err != nil {
+		return WrapError("ChangeMessageVisibility", queueURL, err)
+	}
+	Log().Debug("changed message visibility", LogKeyQueue, queueURL, "timeout", timeout.String())
+	return nil
+}
+
+// ListObjectKeys returns the keys of the objects of bucket starting with prefix.
+func ListObjectKeys(ctx context.Context, client S3ListObjectsAPI, bucket string, prefix string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	}
+
+	var keys []string
+	for {
+		resp, err := GetObjects(ctx, client, input)
+		if err != nil {
+			return keys, WrapError("ListObjectsV2", ObjectName(bucket, prefix), err)
+		}
+		for _, obj := range resp.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+		if !resp.IsTruncated {
+			return keys, nil
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+// FetchCounts downloads the word counts named by the result message result.
+func FetchCounts(ctx context.Context, client S3GetObjectAPI, result ResultMessage) (map[string]int, error) {
+	key, bucket := result.ResultKey, result.ResultBucket
+	obj, err := GetObject(ctx, client, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, WrapError("GetObject", ObjectName(bucket, key), err)
+	}
+	defer obj.Body.Close()
+	data, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result '%s': %v", key, err)
+	}
+	counts := make(map[string]int)
+	if err = json.Unmarshal(data, &counts); err != nil {
+		return nil, fmt.Errorf("failed to parse result '%s': %v", key, err)
+	}
+	return counts, nil
+}
+
+// ObjectExists reports whether bucket has an object named objectKey.
+func ObjectExists(ctx context.Context, client S3HeadObjectAPI, objectKey string, bucket string) (bool, error) {
+	_, err := GetObjectInfo(ctx, client, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &objectKey,
+	})
+	if err != nil {
+		err = WrapError("HeadObject", ObjectName(bucket, objectKey), err)
+		if errors.Is(err, ErrObjectNotFound) {
+			return false, nil
+		}
+		return false, err
 	}
-	fmt.Println("Deleted message from queue with URL " + queueName)
+	return true, nil
 }
 
-func DeleteObjectSimple(client *s3.Client, objectKey string, bucket string) {
+// DeleteObjectSimple deletes the object objectKey from bucket.
+func DeleteObjectSimple(ctx context.Context, client S3DeleteObjectAPI, objectKey string, bucket string) error {
 	input := &s3.DeleteObjectInput{
 		Bucket: &bucket,
 		Key:    &objectKey,
 	}
 
-	_, err := DeleteItem(context.TODO(), client, input)
+	_, err := DeleteItem(ctx, client, input)
 	if err != nil {
-		fmt.Println("Got an error deleting item:")
-		fmt.Println(err)
-		return
+		return WrapError("DeleteObject", ObjectName(bucket, objectKey), err)
 	}
 
-	fmt.Println("Deleted " + objectKey + " from " + bucket)
+	Log().Debug("deleted object", LogKeyBucket, bucket, LogKeyKey, objectKey)
+	return nil
 }
@@ -2,117 +2,165 @@ package utils
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"errors"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"wordcounter/src/fakeaws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
 )
 
-type jsCfg struct {
-	AccessKeyID        string
-	SecretAccessKey    string
-	Region             string
-	DataBucketName     string
-	ResultBucketName   string
-	JobQueueName       string
-	ResultQueueName    string
-	SubJobQueueName    string
-	SubResultQueueName string
+// testRetryPolicy retries the failed calls of the tests quickly.
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:     3,
+	InitialInterval: time.Millisecond,
+	MaxInterval:     4 * time.Millisecond,
+	Multiplier:      2,
+	Jitter:          0.5,
+	MaxElapsed:      time.Second,
 }
 
-var myCfg jsCfg
+func TestMain(m *testing.M) {
+	// Keep the logs of the functions under test out of the test output
+	SetLogger(nil)
+	if err := SetRetryPolicy("*", testRetryPolicy); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
 
 func Test_listEC2Instances(t *testing.T) {
-	// Read cfg from jsonFile
-	testPath := "../../config/config.json"
-	data, err := ioutil.ReadFile(testPath)
-	if err != nil {
-		fmt.Printf("Failed to read config file '%s':%v", testPath, err)
-	}
-	err = json.Unmarshal(data, &myCfg)
-	if err != nil {
-		fmt.Printf("Failed to prase config file '%s':%v", testPath, err)
+	launched := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	worker1 := fakeaws.NewInstance("i-0001", "worker1", types.InstanceStateNameRunning, "1.2.3.4", "192.168.0.1")
+	worker1.Tags = append(worker1.Tags, types.Tag{Key: aws.String(RoleTag), Value: aws.String(RoleWorker)})
+	worker1.InstanceType = types.InstanceTypeT3Micro
+	worker1.Placement = &types.Placement{AvailabilityZone: aws.String("eu-west-1a")}
+	worker1.LaunchTime = aws.Time(launched)
+	// A worker in a private subnet has no public IP
+	worker4 := fakeaws.NewInstance("i-0004", "worker4", types.InstanceStateNameRunning, "", "192.168.0.4")
+	worker4.Tags = append(worker4.Tags, types.Tag{Key: aws.String(RoleTag), Value: aws.String(RoleWorker)})
+	workers := []types.Instance{
+		worker1,
+		fakeaws.NewInstance("i-0002", "worker2", types.InstanceStateNameStopped, "", "192.168.0.2"),
+		fakeaws.NewInstance("i-0003", "worker3", types.InstanceStateNameRunning, "1.2.3.5", "192.168.0.3"),
+		worker4,
 	}
+	info1 := InstanceInfo{Name: "worker1", Id: "i-0001", PublicIP: "1.2.3.4", PrivateIP: "192.168.0.1",
+		State: types.InstanceStateNameRunning, InstanceType: "t3.micro", AvailabilityZone: "eu-west-1a", LaunchTime: launched}
+	info2 := InstanceInfo{Name: "worker2", Id: "i-0002", PrivateIP: "192.168.0.2", State: types.InstanceStateNameStopped}
+	info3 := InstanceInfo{Name: "worker3", Id: "i-0003", PublicIP: "1.2.3.5", PrivateIP: "192.168.0.3", State: types.InstanceStateNameRunning}
+	info4 := InstanceInfo{Name: "worker4", Id: "i-0004", PrivateIP: "192.168.0.4", State: types.InstanceStateNameRunning}
+	throttledOnce := fakeaws.NewEC2(workers...)
+	throttledOnce.Inject("DescribeInstances", fakeaws.Throttle(fakeaws.EC2ThrottlingCode, 1))
+	throttled := fakeaws.NewEC2(workers...)
+	throttled.Inject("DescribeInstances", fakeaws.Throttle(fakeaws.EC2ThrottlingCode, 0))
+	denied := fakeaws.NewEC2(workers...)
+	denied.Inject("DescribeInstances", fakeaws.Fail(&smithy.GenericAPIError{Code: "UnauthorizedOperation"}, 0))
 
-	// Set cred env variables
-	// fmt.Println("AWS_REGION:", myCfg.Region)
-	os.Setenv("AWS_REGION", myCfg.Region)
-	os.Setenv("AWS_ACCESS_KEY_ID", myCfg.AccessKeyID)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", myCfg.SecretAccessKey)
-	os.Setenv("AWS_SESSION_TOKEN", "")
-	// Load config from env variables
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		panic("configuration error, " + err.Error())
-	}
-	ec2client := ec2.NewFromConfig(cfg)
-	type args struct {
-		client *ec2.Client
-	}
 	tests := []struct {
-		name string
-		args args
-		want []InstanceInfo
+		name      string
+		client    *fakeaws.EC2
+		filter    InstanceFilter
+		want      []InstanceInfo
+		wantErr   error
+		wantCalls int
 	}{
 		{
-			name: "TestList",
-			args: args{
-				client: ec2client,
-			},
+			name:   "TestList",
+			client: fakeaws.NewEC2(workers...),
+			want:   []InstanceInfo{info1, info3, info4},
+		},
+		{
+			name:   "Workers",
+			client: fakeaws.NewEC2(workers...),
+			filter: WorkerFilter,
+			want:   []InstanceInfo{info1, info4},
+		},
+		{
+			name:   "States",
+			client: fakeaws.NewEC2(workers...),
+			filter: InstanceFilter{States: []types.InstanceStateName{types.InstanceStateNameStopped, types.InstanceStateNameRunning}},
+			want:   []InstanceInfo{info1, info2, info3, info4},
+		},
+		{
+			name:      "Pages",
+			client:    fakeaws.NewEC2(workers...),
+			filter:    InstanceFilter{PageSize: 2},
+			want:      []InstanceInfo{info1, info3, info4},
+			wantCalls: 2,
+		},
+		{
+			name:   "NoInstances",
+			client: fakeaws.NewEC2(),
+			want:   []InstanceInfo{},
+		},
+		{
+			name:      "ThrottledOnce",
+			client:    throttledOnce,
+			want:      []InstanceInfo{info1, info3, info4},
+			wantCalls: 2,
+		},
+		{
+			name:      "Throttled",
+			client:    throttled,
+			want:      nil,
+			wantErr:   ErrThrottled,
+			wantCalls: testRetryPolicy.MaxAttempts,
+		},
+		{
+			name:      "Denied",
+			client:    denied,
+			want:      nil,
+			wantErr:   ErrAccessDenied,
+			wantCalls: 1,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := ListEC2Instances(tt.args.client); got == nil {
-				t.Errorf("listEC2Instances() = %v, want not nil", got)
+			got, err := ListEC2Instances(context.TODO(), tt.client, tt.filter)
+			if calls := tt.client.Calls("DescribeInstances"); tt.wantCalls > 0 && calls != tt.wantCalls {
+				t.Errorf("listEC2Instances() made %d calls, want %d", calls, tt.wantCalls)
+			}
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t.Errorf("listEC2Instances() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listEC2Instances() = %#v, want %#v", got, tt.want)
 			}
 		})
 	}
 }
 
 func Test_submitJob(t *testing.T) {
-	// Read cfg from jsonFile
-	testPath := "../../config/config.json"
-	data, err := ioutil.ReadFile(testPath)
-	if err != nil {
-		fmt.Printf("Failed to read config file '%s':%v", testPath, err)
-	}
-	err = json.Unmarshal(data, &myCfg)
-	if err != nil {
-		fmt.Printf("Failed to prase config file '%s':%v", testPath, err)
-	}
-
-	// Set cred env variables
-	// fmt.Println("AWS_REGION:", myCfg.Region)
-	os.Setenv("AWS_REGION", myCfg.Region)
-	os.Setenv("AWS_ACCESS_KEY_ID", myCfg.AccessKeyID)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", myCfg.SecretAccessKey)
-	os.Setenv("AWS_SESSION_TOKEN", "")
-	// Load config from env variables
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	sqsclient := sqs.NewFromConfig(cfg)
+	throttledOnce := fakeaws.NewSQS("jobs")
+	throttledOnce.Inject("SendMessage", fakeaws.Throttle(fakeaws.SQSThrottlingCode, 1))
+	throttled := fakeaws.NewSQS("jobs")
+	throttled.Inject("SendMessage", fakeaws.Throttle(fakeaws.SQSThrottlingCode, 0))
+	timedOut := fakeaws.NewSQS("jobs")
+	timedOut.Inject("GetQueueUrl", fakeaws.Timeout(10*time.Millisecond, 0))
 
 	type args struct {
-		client    *sqs.Client
+		client    *fakeaws.SQS
 		queueName string
 		instance  InstanceInfo
-		fileKey   string
-		s3bucket  string
+		job       JobMessage
 	}
 	tests := []struct {
 		name string
 		args args
-		want bool
+		want error
 	}{
 		{
 			name: "TestSubmitJobToSqs",
 			args: args{
-				client:    sqsclient,
+				client:    fakeaws.NewSQS("jobs"),
 				queueName: "jobs",
 				instance: InstanceInfo{
 					Name:      "workerTest",
@@ -120,16 +168,208 @@ func Test_submitJob(t *testing.T) {
 					PublicIP:  "1.2.3.4",
 					PrivateIP: "192.168.0.1",
 				},
-				fileKey:  "fileKeyValue",
-				s3bucket: "s3bucketName",
+				job: JobMessage{
+					Bucket: "s3bucketName",
+					Key:    "file key value",
+				},
+			},
+			want: nil,
+		},
+		{
+			name: "FIFOQueue",
+			args: args{
+				client:    fakeaws.NewSQS("jobs.fifo"),
+				queueName: "jobs.fifo",
+				job:       JobMessage{Bucket: "s3bucketName", Key: "file key value", Tenant: "team"},
+			},
+			want: nil,
+		},
+		{
+			name: "MissingQueue",
+			args: args{
+				client:    fakeaws.NewSQS("results"),
+				queueName: "jobs",
+				job:       JobMessage{Bucket: "s3bucketName", Key: "file key value"},
+			},
+			want: ErrQueueNotFound,
+		},
+		{
+			name: "ThrottledOnce",
+			args: args{
+				client:    throttledOnce,
+				queueName: "jobs",
+				job:       JobMessage{Bucket: "s3bucketName", Key: "file key value"},
 			},
-			want: true,
+			want: nil,
+		},
+		{
+			name: "Throttled",
+			args: args{
+				client:    throttled,
+				queueName: "jobs",
+				job:       JobMessage{Bucket: "s3bucketName", Key: "file key value"},
+			},
+			want: ErrThrottled,
+		},
+		{
+			name: "TimedOut",
+			args: args{
+				client:    timedOut,
+				queueName: "jobs",
+				job:       JobMessage{Bucket: "s3bucketName", Key: "file key value"},
+			},
+			want: context.DeadlineExceeded,
+		},
+		{
+			name: "InvalidJob",
+			args: args{
+				client:    fakeaws.NewSQS("jobs"),
+				queueName: "jobs",
+				job:       JobMessage{Bucket: "s3bucketName"},
+			},
+			want: ErrMalformedMessage,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := SubmitJob(tt.args.client, tt.args.queueName, tt.args.instance, tt.args.fileKey, tt.args.s3bucket); got != tt.want {
-				t.Errorf("submitJob() = %v, want %v", got, tt.want)
+			id, err := SubmitJob(context.TODO(), tt.args.client, tt.args.queueName, tt.args.instance, tt.args.job)
+			if !errors.Is(err, tt.want) || (err != nil) != (tt.want != nil) {
+				t.Errorf("submitJob() error = %v, want %v", err, tt.want)
+			}
+			if !id.Valid() {
+				t.Errorf("submitJob() returned invalid job id '%s'", id)
+			}
+
+			msgs := tt.args.client.Messages(tt.args.queueName)
+			if tt.want != nil {
+				if len(msgs) != 0 {
+					t.Errorf("submitJob() failed but sent %d messages", len(msgs))
+				}
+				return
+			}
+			if len(msgs) != 1 {
+				t.Fatalf("submitJob() sent %d messages, want 1", len(msgs))
+			}
+			job, err := DecodeJob(*msgs[0].Body)
+			if err != nil {
+				t.Fatalf("submitJob() sent an invalid job: %v", err)
+			}
+			if job.JobID != id || job.Key != tt.args.job.Key || job.Bucket != tt.args.job.Bucket {
+				t.Errorf("submitJob() sent %+v, want job '%s' for %s/%s", job, id, tt.args.job.Bucket, tt.args.job.Key)
+			}
+			attrs := msgs[0].MessageAttributes
+			if *attrs["JobId"].StringValue != id.String() || *attrs["WorkerId"].StringValue != tt.args.instance.Id {
+				t.Errorf("submitJob() message attributes JobId = %s, WorkerId = %s", *attrs["JobId"].StringValue, *attrs["WorkerId"].StringValue)
+			}
+		})
+	}
+}
+
+func Test_submitJobFIFO(t *testing.T) {
+	client := fakeaws.NewSQS("jobs.fifo")
+	url := fakeaws.QueueURL("jobs.fifo")
+	first := JobMessage{JobID: NewJobID(), Bucket: "data", Key: "a.txt", Tenant: "team"}
+	second := JobMessage{JobID: NewJobID(), Bucket: "data", Key: "b.txt", Tenant: "team"}
+	other := JobMessage{JobID: NewJobID(), Bucket: "data", Key: "c.txt"}
+	for _, job := range []JobMessage{first, first, second, other} {
+		if _, err := SubmitJob(context.TODO(), client, "jobs.fifo", InstanceInfo{}, job); err != nil {
+			t.Fatalf("SubmitJob() error = %v", err)
+		}
+	}
+	if msgs := client.Messages("jobs.fifo"); len(msgs) != 3 {
+		t.Errorf("SubmitJob() sent %d messages, want 3 without the duplicate", len(msgs))
+	}
+
+	// The second job of the tenant waits for the first, the other job does not
+	var got []string
+	for {
+		resp, err := GetLPMessagesByURL(context.TODO(), client, url, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Messages) == 0 {
+			break
+		}
+		job, _ := DecodeJob(aws.ToString(resp.Messages[0].Body))
+		got = append(got, job.Key)
+	}
+	if want := []string{"a.txt", "c.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v while in flight, want %v", got, want)
+	}
+}
+
+func Test_receiveAndRemoveMessage(t *testing.T) {
+	client := fakeaws.NewSQS("jobs")
+	client.DuplicateNext(1)
+	ctx := context.TODO()
+	id, err := SubmitJob(ctx, client, "jobs", InstanceInfo{}, JobMessage{Bucket: "data", Key: "alice30.txt"})
+	if err != nil {
+		t.Fatalf("submitJob() error = %v", err)
+	}
+	// The job is sent with a delay
+	client.Now = func() time.Time { return time.Now().Add(time.Minute) }
+
+	url, err := GetQueueURLSimple(ctx, client, "jobs")
+	if err != nil || url != fakeaws.QueueURL("jobs") {
+		t.Fatalf("GetQueueURLSimple() = %q, %v, want %q", url, err, fakeaws.QueueURL("jobs"))
+	}
+	// The message is delivered twice, each copy must be deleted with its own receipt handle
+	for n := 0; n < 2; n++ {
+		resp, err := GetLPMessagesByURL(ctx, client, url, 1, 0)
+		if err != nil {
+			t.Fatalf("GetLPMessagesByURL() error = %v", err)
+		}
+		if len(resp.Messages) != 1 {
+			t.Fatalf("GetLPMessagesByURL() returned %d messages, want 1", len(resp.Messages))
+		}
+		msg := resp.Messages[0]
+		if *msg.MessageAttributes["JobId"].StringValue != id.String() {
+			t.Errorf("GetLPMessagesByURL() got job %s, want %s", *msg.MessageAttributes["JobId"].StringValue, id)
+		}
+		if msg.Attributes["SentTimestamp"] == "" {
+			t.Errorf("GetLPMessagesByURL() did not request the SentTimestamp attribute")
+		}
+		if err := RemoveMessageSimple(ctx, client, url, *msg.ReceiptHandle); err != nil {
+			t.Errorf("RemoveMessageSimple() error = %v", err)
+		}
+		// A receipt handle can only be used once
+		if err := RemoveMessageSimple(ctx, client, url, *msg.ReceiptHandle); !errors.Is(err, ErrInvalidReceiptHandle) {
+			t.Errorf("RemoveMessageSimple() twice error = %v, want %v", err, ErrInvalidReceiptHandle)
+		}
+	}
+	if msgs := client.Messages("jobs"); len(msgs) != 0 {
+		t.Errorf("RemoveMessageSimple() left %d messages", len(msgs))
+	}
+}
+
+func TestFetchCounts(t *testing.T) {
+	client := fakeaws.NewS3("results")
+	for key, body := range map[string]string{"results/ok.json": `{"the":2,"cat":1}`, "results/bad.json": `[1]`} {
+		if _, err := client.PutObject(context.TODO(), &s3.PutObjectInput{Bucket: aws.String("results"), Key: aws.String(key), Body: strings.NewReader(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		key     string
+		want    map[string]int
+		wantErr error
+	}{
+		{"Counts", "results/ok.json", map[string]int{"the": 2, "cat": 1}, nil},
+		{"Missing", "results/missing.json", nil, ErrObjectNotFound},
+		{"Malformed", "results/bad.json", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FetchCounts(context.TODO(), client, ResultMessage{ResultBucket: "results", ResultKey: tt.key})
+			if tt.want == nil {
+				if err == nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("FetchCounts() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FetchCounts() = %v, %v, want %v", got, err, tt.want)
 			}
 		})
 	}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"wordcounter/src/localaws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// Backends selected by Config.Backend
+const (
+	// BackendAWS uses Amazon SQS, S3 and EC2, it is the default.
+	BackendAWS = "aws"
+	// BackendLocal keeps the queues and buckets in the Config.LocalDir directory.
+	BackendLocal = "local"
+)
+
+// Config holds the settings shared by the client and the worker.
+// It is read from a JSON file such as config/config.json.
+type Config struct {
+	Backend            string
+	LocalDir           string
+	AccessKeyID        string
+	SecretAccessKey    string
+	Region             string
+	DataBucketName     string
+	ResultBucketName   string
+	JobQueueName       string
+	ResultQueueName    string
+	SubJobQueueName    string
+	SubResultQueueName string
+	// Tenant is set on the jobs submitted by the client. The queues whose
+	// names end with ".fifo" are FIFO queues, in which the jobs of a tenant
+	// are run one at a time in order, and the others in parallel.
+	Tenant string
+	// DeadLetterQueueName is the queue the workers move the job messages
+	// they fail to process to. Without it the failed jobs are retried forever.
+	DeadLetterQueueName string
+	// MaxReceiveCount is the number of times a job message is received before
+	// it is dead-lettered, DefaultMaxReceiveCount if zero.
+	MaxReceiveCount int
+	// Routing is how the jobs addressed to a worker reach it: RoutingAny,
+	// the default, RoutingQueue or RoutingClaim.
+	Routing string
+	// RoutingTimeout is the number of seconds after which any worker takes a
+	// job addressed to another one in the claim mode, DefaultRoutingTimeout if zero.
+	RoutingTimeout int
+	// Identity is the identity of the workers that cannot read it from the
+	// instance metadata service, such as those running off EC2.
+	Identity *Identity
+	// Launch is the template of the worker instances launched by the autoscaler.
+	Launch LaunchConfig
+	// RetryPolicies are the retry policies of the AWS operations, such as
+	// "SendMessage", or of all the others for "*".
+	RetryPolicies map[string]RetryPolicy
+}
+
+// LaunchConfig is the template of the worker instances.
+type LaunchConfig struct {
+	ImageID          string
+	InstanceType     string
+	KeyName          string
+	SecurityGroupIDs []string
+	SubnetID         string
+	// InstanceProfile is the name of the IAM instance profile granting the
+	// workers access to the queues and buckets.
+	InstanceProfile string
+	// Bootstrap is how the instances install and start the worker, they
+	// are launched without user data if nil.
+	Bootstrap *WorkerBootstrap
+}
+
+// LoadConfig reads and parses the JSON config file at path.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file '%s': %v", path, err)
+	}
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config file '%s': %v", path, err)
+	}
+	return cfg, nil
+}
+
+// NewAWSConfig exports the credentials of cfg as environment variables and
+// loads the default AWS config from them.
+func NewAWSConfig(cfg Config) (aws.Config, error) {
+	if cfg.Region != "" {
+		os.Setenv("AWS_REGION", cfg.Region)
+	}
+	if cfg.AccessKeyID != "" {
+		os.Setenv("AWS_ACCESS_KEY_ID", cfg.AccessKeyID)
+		os.Setenv("AWS_SECRET_ACCESS_KEY", cfg.SecretAccessKey)
+		os.Setenv("AWS_SESSION_TOKEN", "")
+	}
+	return config.LoadDefaultConfig(context.TODO())
+}
+
+// Services holds the clients of the backend selected by a Config.
+type Services struct {
+	SQS SQSAPI
+	S3  S3API
+	// EC2 is nil for the local backend, which has no instances.
+	EC2 EC2API
+}
+
+// NewServices sets the retry policies of cfg and returns the clients of its
+// backend. The local backend creates the queues and buckets named by cfg if
+// they do not exist yet.
+func NewServices(cfg Config) (Services, error) {
+	for op, policy := range cfg.RetryPolicies {
+		if err := SetRetryPolicy(op, policy); err != nil {
+			return Services{}, err
+		}
+	}
+	switch cfg.Backend {
+	case "", BackendAWS:
+		awsCfg, err := NewAWSConfig(cfg)
+		if err != nil {
+			return Services{}, fmt.Errorf("configuration error, %v", err)
+		}
+		// The wrappers retry the calls with the policies of cfg
+		awsCfg.Retryer = func() aws.Retryer { return aws.NopRetryer{} }
+		return Services{
+			SQS: sqs.NewFromConfig(awsCfg),
+			S3:  s3.NewFromConfig(awsCfg),
+			EC2: ec2.NewFromConfig(awsCfg),
+		}, nil
+	case BackendLocal:
+		return newLocalServices(cfg)
+	}
+	return Services{}, fmt.Errorf("unknown backend '%s'", cfg.Backend)
+}
+
+func newLocalServices(cfg Config) (Services, error) {
+	if cfg.LocalDir == "" {
+		return Services{}, fmt.Errorf("the local backend needs a LocalDir")
+	}
+	queues, err := localaws.NewQueues(filepath.Join(cfg.LocalDir, "sqs"))
+	if err != nil {
+		return Services{}, err
+	}
+	buckets, err := localaws.NewBuckets(filepath.Join(cfg.LocalDir, "s3"))
+	if err != nil {
+		return Services{}, err
+	}
+	for _, name := range []string{cfg.JobQueueName, cfg.ResultQueueName, cfg.SubJobQueueName, cfg.SubResultQueueName, cfg.DeadLetterQueueName} {
+		if name == "" {
+			continue
+		}
+		if _, err := queues.CreateQueue(context.TODO(), &sqs.CreateQueueInput{QueueName: aws.String(name)}); err != nil {
+			return Services{}, fmt.Errorf("failed to create queue '%s': %v", name, err)
+		}
+	}
+	for _, name := range []string{cfg.DataBucketName, cfg.ResultBucketName} {
+		if name == "" {
+			continue
+		}
+		if _, err := MakeBucket(context.TODO(), buckets, &s3.CreateBucketInput{Bucket: aws.String(name)}); err != nil {
+			return Services{}, fmt.Errorf("failed to create bucket '%s': %v", name, err)
+		}
+	}
+	return Services{SQS: queues, S3: buckets}, nil
+}
@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"context"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// DefaultMaxReceiveCount is the number of times a job message is received
+// before it is dead-lettered when Config.MaxReceiveCount is zero.
+const DefaultMaxReceiveCount = 5
+
+// Message attributes added to the dead-lettered messages
+const (
+	// AttrFailureReason is why the message was dead-lettered.
+	AttrFailureReason = "FailureReason"
+	// AttrSourceQueue is the name of the queue the message was taken from.
+	AttrSourceQueue = "SourceQueue"
+	// AttrReceiveCount is the number of times the job of the message was
+	// tried, see Attempts.
+	AttrReceiveCount = "ReceiveCount"
+)
+
+// maxReasonLength is the longest failure reason recorded, in bytes.
+const maxReasonLength = 1024
+
+// truncateReason returns the failure reason cut to maxReasonLength bytes at
+// most, at the start of a rune so that it stays valid UTF-8.
+func truncateReason(reason string) string {
+	if len(reason) <= maxReasonLength {
+		return reason
+	}
+	n := maxReasonLength
+	for n > 0 && !utf8.RuneStart(reason[n]) {
+		n--
+	}
+	return reason[:n]
+}
+
+// DeadLetter is a message of a dead-letter queue.
+type DeadLetter struct {
+	// JobID is the ID of the job of the message, empty if it has none.
+	JobID JobID
+	// MessageID is the ID of the message in the dead-letter queue.
+	MessageID     string
+	SourceQueue   string
+	Reason        string
+	ReceiveCount  int
+	Body          string
+	ReceiptHandle string
+	// Attributes are the message attributes of the original message.
+	Attributes map[string]types.MessageAttributeValue
+}
+
+// ReceiveCount returns the ApproximateReceiveCount attribute of msg, or 0 if
+// it was not received with it.
+func ReceiveCount(msg types.Message) int {
+	n, _ := strconv.Atoi(msg.Attributes["ApproximateReceiveCount"])
+	return n
+}
+
+// DeadLetterMessage moves msg, received from the queue named sourceQueue at
+// sourceURL, to the dead-letter queue at dlqURL, recording reason along with
+// its message attributes.
+func DeadLetterMessage(ctx context.Context, client SQSAPI, dlqURL string, sourceQueue string, sourceURL string, msg types.Message, reason string) error {
+	reason = truncateReason(reason)
+	attrs := make(map[string]types.MessageAttributeValue, len(msg.MessageAttributes)+3)
+	for name, value := range msg.MessageAttributes {
+		attrs[name] = value
+	}
+	attrs[AttrFailureReason] = stringAttribute(reason)
+	attrs[AttrSourceQueue] = stringAttribute(sourceQueue)
+	attrs[AttrReceiveCount] = types.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(Attempts(msg))),
+	}
+
+	input := &sqs.SendMessageInput{
+		MessageAttributes: attrs,
+		MessageBody:       msg.Body,
+		QueueUrl:          &dlqURL,
+	}
+	// Deduplicated by message rather than by job, so that a job redriven
+	// and failed again is dead-lettered again
+	messageID := aws.ToString(msg.MessageId)
+	SetFIFOParams(input, messageID, letterGroupID(msg.MessageAttributes, messageID))
+	_, err := SendMsg(ctx, client, input)
+	if err != nil {
+		return WrapError("SendMessage", dlqURL, err)
+	}
+	if err := RemoveMessageSimple(ctx, client, sourceURL, aws.ToString(msg.ReceiptHandle)); err != nil {
+		// The message is dead-lettered again once redelivered
+		return err
+	}
+	Log().Warn("dead-lettered message", LogKeyJobID, attributeString(msg.MessageAttributes, "JobId"),
+		LogKeyQueue, sourceQueue, "reason", reason)
+	return nil
+}
+
+// ReceiveDeadLetters receives all the messages of the dead-letter queue at
+// dlqURL and hides them for hide, until they are redriven or released.
+func ReceiveDeadLetters(ctx context.Context, client SQSAPI, dlqURL string, hide time.Duration) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	for {
+		resp, err := GetMessages(ctx, client, &sqs.ReceiveMessageInput{
+			QueueUrl:              &dlqURL,
+			AttributeNames:        []types.QueueAttributeName{"ApproximateReceiveCount"},
+			MaxNumberOfMessages:   10,
+			MessageAttributeNames: []string{"All"},
+			VisibilityTimeout:     int32(hide / time.Second),
+			// Long polling samples all the servers of the queue
+			WaitTimeSeconds: 1,
+		})
+		if err != nil {
+			return letters, WrapError("ReceiveMessage", dlqURL, err)
+		}
+		if len(resp.Messages) == 0 {
+			return letters, nil
+		}
+		for _, msg := range resp.Messages {
+			letters = append(letters, newDeadLetter(msg))
+		}
+	}
+}
+
+func newDeadLetter(msg types.Message) DeadLetter {
+	letter := DeadLetter{
+		JobID:         JobID(attributeString(msg.MessageAttributes, "JobId")),
+		MessageID:     aws.ToString(msg.MessageId),
+		SourceQueue:   attributeString(msg.MessageAttributes, AttrSourceQueue),
+		Reason:        attributeString(msg.MessageAttributes, AttrFailureReason),
+		Body:          aws.ToString(msg.Body),
+		ReceiptHandle: aws.ToString(msg.ReceiptHandle),
+		Attributes:    make(map[string]types.MessageAttributeValue),
+	}
+	letter.ReceiveCount, _ = strconv.Atoi(attributeString(msg.MessageAttributes, AttrReceiveCount))
+	if job, err := DecodeJob(letter.Body); letter.JobID == "" && err == nil {
+		letter.JobID = job.JobID
+	}
+	for name, value := range msg.MessageAttributes {
+		switch name {
+		// A redriven job starts over with no attempts
+		case AttrFailureReason, AttrSourceQueue, AttrReceiveCount, AttrAttempts:
+		default:
+			letter.Attributes[name] = value
+		}
+	}
+	return letter
+}
+
+// RedriveDeadLetter sends the message of letter back to its source queue and
+// deletes it from the dead-letter queue at dlqURL.
+func RedriveDeadLetter(ctx context.Context, client SQSAPI, dlqURL string, letter DeadLetter) error {
+	queueURL, err := GetQueueURLSimple(ctx, client, letter.SourceQueue)
+	if err != nil {
+		return err
+	}
+	input := &sqs.SendMessageInput{
+		MessageAttributes: letter.Attributes,
+		MessageBody:       &letter.Body,
+		QueueUrl:          &queueURL,
+	}
+	groupID := letterGroupID(letter.Attributes, letter.MessageID)
+	if job, err := DecodeJob(letter.Body); err == nil {
+		groupID = MessageGroupID(job)
+	}
+	SetFIFOParams(input, letter.MessageID, groupID)
+	_, err = SendMsg(ctx, client, input)
+	if err != nil {
+		return WrapError("SendMessage", letter.SourceQueue, err)
+	}
+	if err := RemoveMessageSimple(ctx, client, dlqURL, letter.ReceiptHandle); err != nil {
+		return err
+	}
+	Log().Info("redrove message", LogKeyJobID, letter.JobID, LogKeyQueue, letter.SourceQueue)
+	return nil
+}
+
+// letterGroupID returns the message group of a dead-lettered message in a FIFO
+// queue: that of its job, or else that of the message itself.
+func letterGroupID(attrs map[string]types.MessageAttributeValue, messageID string) string {
+	if jobID := attributeString(attrs, "JobId"); jobID != "" {
+		return jobID
+	}
+	return messageID
+}
+
+// ReleaseDeadLetter makes the message of letter visible again in the
+// dead-letter queue at dlqURL.
+func ReleaseDeadLetter(ctx context.Context, client SQSAPI, dlqURL string, letter DeadLetter) error {
+	return ChangeVisibilitySimple(ctx, client, dlqURL, letter.ReceiptHandle, 0)
+}
+
+func stringAttribute(value string) types.MessageAttributeValue {
+	return types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+}
+
+// attributeString returns the value of the message attribute name, or "".
+func attributeString(attrs map[string]types.MessageAttributeValue, name string) string {
+	return aws.ToString(attrs[name].StringValue)
+}
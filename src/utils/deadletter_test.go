@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"wordcounter/src/fakeaws"
+)
+
+func TestDeadLetter(t *testing.T) {
+	ctx := context.TODO()
+	client := fakeaws.NewSQS("jobs", "dead")
+	jobsURL, dlqURL := fakeaws.QueueURL("jobs"), fakeaws.QueueURL("dead")
+	id, err := SubmitJob(ctx, client, "jobs", InstanceInfo{Id: "i-0001"}, JobMessage{Bucket: "data", Key: "alice30.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The job is sent with a delay
+	client.Now = func() time.Time { return time.Now().Add(time.Minute) }
+
+	for n := 1; n <= 2; n++ {
+		resp, err := GetLPMessagesByURL(ctx, client, jobsURL, 1, 0)
+		if err != nil || len(resp.Messages) != 1 {
+			t.Fatalf("GetLPMessagesByURL() = %v, %v, want 1 message", resp, err)
+		}
+		msg := resp.Messages[0]
+		if got := ReceiveCount(msg); got != n {
+			t.Fatalf("ReceiveCount() = %d, want %d", got, n)
+		}
+		if n == 2 {
+			if err := DeadLetterMessage(ctx, client, dlqURL, "jobs", jobsURL, msg, "boom"); err != nil {
+				t.Fatalf("DeadLetterMessage() error = %v", err)
+			}
+			break
+		}
+		// Let the message be redelivered
+		if err := ChangeVisibilitySimple(ctx, client, jobsURL, *msg.ReceiptHandle, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msgs := client.Messages("jobs"); len(msgs) != 0 {
+		t.Errorf("DeadLetterMessage() left %d messages in the source queue", len(msgs))
+	}
+
+	letters, err := ReceiveDeadLetters(ctx, client, dlqURL, time.Minute)
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("ReceiveDeadLetters() = %v, %v, want 1 letter", letters, err)
+	}
+	letter := letters[0]
+	if letter.JobID != id || letter.SourceQueue != "jobs" || letter.Reason != "boom" || letter.ReceiveCount != 2 {
+		t.Errorf("ReceiveDeadLetters() = %+v, want job %s from 'jobs' received twice for 'boom'", letter, id)
+	}
+	if _, ok := letter.Attributes[AttrFailureReason]; ok || attributeString(letter.Attributes, "WorkerId") != "i-0001" {
+		t.Errorf("ReceiveDeadLetters() attributes = %v, want the original ones", letter.Attributes)
+	}
+
+	// Released letters are listed again
+	if err := ReleaseDeadLetter(ctx, client, dlqURL, letter); err != nil {
+		t.Fatalf("ReleaseDeadLetter() error = %v", err)
+	}
+	if letters, err = ReceiveDeadLetters(ctx, client, dlqURL, time.Minute); err != nil || len(letters) != 1 {
+		t.Fatalf("ReceiveDeadLetters() after release = %v, %v, want 1 letter", letters, err)
+	}
+
+	if err := RedriveDeadLetter(ctx, client, dlqURL, letters[0]); err != nil {
+		t.Fatalf("RedriveDeadLetter() error = %v", err)
+	}
+	if msgs := client.Messages("dead"); len(msgs) != 0 {
+		t.Errorf("RedriveDeadLetter() left %d messages in the dead-letter queue", len(msgs))
+	}
+	msgs := client.Messages("jobs")
+	if len(msgs) != 1 {
+		t.Fatalf("RedriveDeadLetter() sent %d messages to the source queue, want 1", len(msgs))
+	}
+	if job, err := DecodeJob(*msgs[0].Body); err != nil || job.JobID != id {
+		t.Errorf("RedriveDeadLetter() sent %v, %v, want job %s", job, err, id)
+	}
+	if _, ok := msgs[0].MessageAttributes[AttrFailureReason]; ok {
+		t.Errorf("RedriveDeadLetter() kept the failure reason")
+	}
+}
+
+func TestTruncateReason(t *testing.T) {
+	long := strings.Repeat("a", maxReasonLength)
+	tests := []struct {
+		name   string
+		reason string
+		want   string
+	}{
+		{"Short", "boom", "boom"},
+		{"Limit", long, long},
+		{"ASCII", long + "b", long},
+		// "é" takes two bytes, the limit falls between them
+		{"Multibyte", long[1:] + "éé", long[1:]},
+		{"ThreeBytes", long[3:] + "€", long[3:] + "€"},
+		{"ThreeBytesCut", long[1:] + "€", long[1:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateReason(tt.reason)
+			if got != tt.want || !utf8.ValidString(got) {
+				t.Errorf("truncateReason() = %d bytes ending with %q, want %d bytes", len(got), got[len(got)-3:], len(tt.want))
+			}
+		})
+	}
+
+	var s JobState
+	s.Set(StatusFailed, "", long[1:]+"é", time.Now())
+	if !utf8.ValidString(s.Reason) {
+		t.Errorf("JobState.Set() recorded an invalid UTF-8 reason ending with %q", s.Reason[len(s.Reason)-3:])
+	}
+}
@@ -3,12 +3,21 @@ package utils
 import (
 	"context"
 	"errors"
-	"fmt"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/smithy-go"
 )
 
+// EC2API defines the interface for the instance functions used by the client and the autoscaler.
+// It is implemented by the Amazon EC2 client.
+type EC2API interface {
+	EC2DescribeInstancesAPI
+	EC2CreateInstanceAPI
+	EC2StartInstancesAPI
+	EC2StopInstancesAPI
+}
+
 // EC2DescribeInstancesAPI defines the interface for the DescribeInstances function.
 // We use this interface to test the function using a mocked service.
 type EC2DescribeInstancesAPI interface {
@@ -26,7 +35,12 @@ type EC2DescribeInstancesAPI interface {
 //     If success, a DescribeInstancesOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to DescribeInstances.
 func GetInstances(c context.Context, api EC2DescribeInstancesAPI, input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
-	return api.DescribeInstances(c, input)
+	var out *ec2.DescribeInstancesOutput
+	err := Retry(c, "DescribeInstances", func(ctx context.Context) (err error) {
+		out, err = api.DescribeInstances(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // EC2MonitorInstancesAPI defines the interface for the MonitorInstances and UnmonitorInstances functions.
@@ -50,14 +64,22 @@ type EC2MonitorInstancesAPI interface {
 //     If success, a MonitorInstancesOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to MonitorInstances.
 func EnableMonitoring(c context.Context, api EC2MonitorInstancesAPI, input *ec2.MonitorInstancesInput) (*ec2.MonitorInstancesOutput, error) {
-	resp, err := api.MonitorInstances(c, input)
+	var resp *ec2.MonitorInstancesOutput
+	err := Retry(c, "MonitorInstances", func(ctx context.Context) (err error) {
+		resp, err = api.MonitorInstances(ctx, input)
+		return err
+	})
 
 	// Do we have a DryRunOperation error?
 	var apiErr smithy.APIError
 	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
-		fmt.Println("User has permission to enable monitoring.")
+		Log().Info("dry run succeeded, user has permission", "operation", "MonitorInstances")
 		input.DryRun = false
-		return api.MonitorInstances(c, input)
+		err = Retry(c, "MonitorInstances", func(ctx context.Context) (err error) {
+			resp, err = api.MonitorInstances(ctx, input)
+			return err
+		})
+		return resp, err
 	}
 
 	return resp, err
@@ -72,14 +94,22 @@ func EnableMonitoring(c context.Context, api EC2MonitorInstancesAPI, input *ec2.
 //     If success, a UnmonitorInstancesOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to UnmonitorInstances.
 func DisableMonitoring(c context.Context, api EC2MonitorInstancesAPI, input *ec2.UnmonitorInstancesInput) (*ec2.UnmonitorInstancesOutput, error) {
-	resp, err := api.UnmonitorInstances(c, input)
+	var resp *ec2.UnmonitorInstancesOutput
+	err := Retry(c, "UnmonitorInstances", func(ctx context.Context) (err error) {
+		resp, err = api.UnmonitorInstances(ctx, input)
+		return err
+	})
 
 	// Do we have a DryRunOperation error?
 	var apiErr smithy.APIError
 	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
-		fmt.Println("User has permission to disable monitoring.")
+		Log().Info("dry run succeeded, user has permission", "operation", "UnmonitorInstances")
 		input.DryRun = false
-		return api.UnmonitorInstances(c, input)
+		err = Retry(c, "UnmonitorInstances", func(ctx context.Context) (err error) {
+			resp, err = api.UnmonitorInstances(ctx, input)
+			return err
+		})
+		return resp, err
 	}
 
 	return resp, err
@@ -106,7 +136,16 @@ type EC2CreateInstanceAPI interface {
 //     If success, a RunInstancesOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to RunInstances.
 func MakeInstance(c context.Context, api EC2CreateInstanceAPI, input *ec2.RunInstancesInput) (*ec2.RunInstancesOutput, error) {
-	return api.RunInstances(c, input)
+	// A random client token makes the retries launch the instances once
+	if input.ClientToken == nil {
+		input.ClientToken = aws.String(NewJobID().String())
+	}
+	var out *ec2.RunInstancesOutput
+	err := Retry(c, "RunInstances", func(ctx context.Context) (err error) {
+		out, err = api.RunInstances(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // MakeTags creates tags for an Amazon Elastic Compute Cloud (Amazon EC2) instance.
@@ -118,7 +157,12 @@ func MakeInstance(c context.Context, api EC2CreateInstanceAPI, input *ec2.RunIns
 //     If success, a CreateTagsOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to CreateTags.
 func MakeTags(c context.Context, api EC2CreateInstanceAPI, input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
-	return api.CreateTags(c, input)
+	var out *ec2.CreateTagsOutput
+	err := Retry(c, "CreateTags", func(ctx context.Context) (err error) {
+		out, err = api.CreateTags(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // EC2RebootInstancesAPI defines the interface for the RebootInstances function.
@@ -138,13 +182,21 @@ type EC2RebootInstancesAPI interface {
 //     If success, a RebootInstancesOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to RebootInstances.
 func RebootInstance(c context.Context, api EC2RebootInstancesAPI, input *ec2.RebootInstancesInput) (*ec2.RebootInstancesOutput, error) {
-	resp, err := api.RebootInstances(c, input)
+	var resp *ec2.RebootInstancesOutput
+	err := Retry(c, "RebootInstances", func(ctx context.Context) (err error) {
+		resp, err = api.RebootInstances(ctx, input)
+		return err
+	})
 
 	var apiErr smithy.APIError
 	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
-		fmt.Println("User has permission to enable monitoring.")
+		Log().Info("dry run succeeded, user has permission", "operation", "RebootInstances")
 		input.DryRun = false
-		return api.RebootInstances(c, input)
+		err = Retry(c, "RebootInstances", func(ctx context.Context) (err error) {
+			resp, err = api.RebootInstances(ctx, input)
+			return err
+		})
+		return resp, err
 	}
 
 	return resp, err
@@ -167,13 +219,21 @@ type EC2StartInstancesAPI interface {
 //     If success, a StartInstancesOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to StartInstances.
 func StartInstance(c context.Context, api EC2StartInstancesAPI, input *ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error) {
-	resp, err := api.StartInstances(c, input)
+	var resp *ec2.StartInstancesOutput
+	err := Retry(c, "StartInstances", func(ctx context.Context) (err error) {
+		resp, err = api.StartInstances(ctx, input)
+		return err
+	})
 
 	var apiErr smithy.APIError
 	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
-		fmt.Println("User has permission to start an instance.")
+		Log().Info("dry run succeeded, user has permission", "operation", "StartInstances")
 		input.DryRun = false
-		return api.StartInstances(c, input)
+		err = Retry(c, "StartInstances", func(ctx context.Context) (err error) {
+			resp, err = api.StartInstances(ctx, input)
+			return err
+		})
+		return resp, err
 	}
 
 	return resp, err
@@ -196,13 +256,21 @@ type EC2StopInstancesAPI interface {
 //     If success, a StopInstancesOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to StopInstances.
 func StopInstance(c context.Context, api EC2StopInstancesAPI, input *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
-	resp, err := api.StopInstances(c, input)
+	var resp *ec2.StopInstancesOutput
+	err := Retry(c, "StopInstances", func(ctx context.Context) (err error) {
+		resp, err = api.StopInstances(ctx, input)
+		return err
+	})
 
 	var apiErr smithy.APIError
 	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
-		fmt.Println("User has permission to stop instances.")
+		Log().Info("dry run succeeded, user has permission", "operation", "StopInstances")
 		input.DryRun = false
-		return api.StopInstances(c, input)
+		err = Retry(c, "StopInstances", func(ctx context.Context) (err error) {
+			resp, err = api.StopInstances(ctx, input)
+			return err
+		})
+		return resp, err
 	}
 
 	return resp, err
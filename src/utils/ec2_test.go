@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"wordcounter/src/fakeaws"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+func TestStartInstanceDryRun(t *testing.T) {
+	client := fakeaws.NewEC2(fakeaws.NewInstance("i-0001", "worker1", types.InstanceStateNameStopped, "", "192.168.0.1"))
+	_, err := StartInstance(context.TODO(), client, &ec2.StartInstancesInput{
+		InstanceIds: []string{"i-0001"},
+		DryRun:      true,
+	})
+	if err != nil {
+		t.Fatalf("StartInstance() error = %v", err)
+	}
+	// The dry run succeeded, so the instance was started by a second call
+	if calls := client.Calls("StartInstances"); calls != 2 {
+		t.Errorf("StartInstances called %d times, want 2", calls)
+	}
+	if state := client.Instances()[0].State.Name; state != types.InstanceStateNameRunning {
+		t.Errorf("instance state = %s, want %s", state, types.InstanceStateNameRunning)
+	}
+}
+
+func TestStopInstanceDenied(t *testing.T) {
+	client := fakeaws.NewEC2(fakeaws.NewInstance("i-0001", "worker1", types.InstanceStateNameRunning, "", "192.168.0.1"))
+	client.Inject("StopInstances", fakeaws.Fail(&smithy.GenericAPIError{Code: "UnauthorizedOperation"}, 1))
+	_, err := StopInstance(context.TODO(), client, &ec2.StopInstancesInput{
+		InstanceIds: []string{"i-0001"},
+		DryRun:      true,
+	})
+	if err == nil {
+		t.Fatalf("StopInstance() without permission succeeded")
+	}
+	if state := client.Instances()[0].State.Name; state != types.InstanceStateNameRunning {
+		t.Errorf("instance state = %s, want %s", state, types.InstanceStateNameRunning)
+	}
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+)
+
+// Kinds of the errors returned by the utils functions, test them with errors.Is.
+var (
+	ErrQueueNotFound        = errors.New("queue not found")
+	ErrBucketNotFound       = errors.New("bucket not found")
+	ErrObjectNotFound       = errors.New("object not found")
+	ErrThrottled            = errors.New("request throttled")
+	ErrAccessDenied         = errors.New("access denied")
+	ErrInvalidReceiptHandle = errors.New("invalid receipt handle")
+	ErrMessageNotInFlight   = errors.New("message not in flight")
+	ErrMetadataNotFound     = errors.New("metadata not found")
+)
+
+// Error codes of the AWS services, by kind of error
+var (
+	throttlingCodes = map[string]bool{
+		"Throttling":                             true,
+		"ThrottlingException":                    true,
+		"ThrottledException":                     true,
+		"RequestThrottled":                       true,
+		"RequestThrottledException":              true,
+		"TooManyRequestsException":               true,
+		"ProvisionedThroughputExceededException": true,
+		"RequestLimitExceeded":                   true,
+		"BandwidthLimitExceeded":                 true,
+		"SlowDown":                               true,
+		"EC2ThrottledException":                  true,
+	}
+	accessDeniedCodes = map[string]bool{
+		"AccessDenied":                true,
+		"AccessDeniedException":       true,
+		"UnauthorizedOperation":       true,
+		"AuthFailure":                 true,
+		"InvalidAccessKeyId":          true,
+		"InvalidClientTokenId":        true,
+		"SignatureDoesNotMatch":       true,
+		"UnrecognizedClientException": true,
+		"ExpiredToken":                true,
+	}
+)
+
+// AWSError is the error of a call to an AWS service made by a utils function.
+// It wraps the error of the SDK, and matches its Kind with errors.Is.
+type AWSError struct {
+	// Op is the failed operation, such as "SendMessage".
+	Op string
+	// Resource is the queue, bucket or object of the operation, if any.
+	Resource string
+	// Kind is one of the Err values of the package, or nil if the error is of no known kind.
+	Kind error
+	// Err is the error returned by the service client.
+	Err error
+}
+
+func (e *AWSError) Error() string {
+	msg := e.Op
+	if e.Resource != "" {
+		msg += " " + e.Resource
+	}
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the service client.
+func (e *AWSError) Unwrap() error { return e.Err }
+
+// Is reports whether target is the kind of the error.
+func (e *AWSError) Is(target error) bool { return e.Kind != nil && target == e.Kind }
+
+// WrapError returns err in an AWSError of op on resource, classified by its
+// type or error code. A nil err stays nil.
+func WrapError(op string, resource string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &AWSError{Op: op, Resource: resource, Kind: errorKind(err), Err: err}
+}
+
+// errorKind returns the kind of the error of an AWS service, or nil.
+func errorKind(err error) error {
+	var (
+		queueNotFound *sqstypes.QueueDoesNotExist
+		invalidHandle *sqstypes.ReceiptHandleIsInvalid
+		notInFlight   *sqstypes.MessageNotInflight
+		noSuchBucket  *s3types.NoSuchBucket
+		noSuchKey     *s3types.NoSuchKey
+		notFound      *s3types.NotFound
+		apiErr        smithy.APIError
+	)
+	switch {
+	case errors.As(err, &queueNotFound):
+		return ErrQueueNotFound
+	case errors.As(err, &invalidHandle):
+		return ErrInvalidReceiptHandle
+	case errors.As(err, &notInFlight):
+		return ErrMessageNotInFlight
+	case errors.As(err, &noSuchBucket):
+		return ErrBucketNotFound
+	case errors.As(err, &noSuchKey), errors.As(err, &notFound):
+		return ErrObjectNotFound
+	case errors.As(err, &apiErr):
+		code := apiErr.ErrorCode()
+		switch {
+		case code == "AWS.SimpleQueueService.NonExistentQueue":
+			return ErrQueueNotFound
+		case throttlingCodes[code]:
+			return ErrThrottled
+		case accessDeniedCodes[code]:
+			return ErrAccessDenied
+		}
+	}
+	return nil
+}
+
+// ObjectName returns the name of an object for error messages.
+func ObjectName(bucket string, key string) string {
+	return fmt.Sprintf("s3://%s/%s", bucket, key)
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"wordcounter/src/fakeaws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+)
+
+func TestWrapError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "Throttling", err: &smithy.GenericAPIError{Code: "ThrottlingException"}, want: ErrThrottled},
+		{name: "SlowDown", err: fakeaws.ThrottlingError(fakeaws.S3ThrottlingCode), want: ErrThrottled},
+		{name: "AccessDenied", err: &smithy.GenericAPIError{Code: "AccessDenied"}, want: ErrAccessDenied},
+		{name: "Unauthorized", err: &smithy.GenericAPIError{Code: "UnauthorizedOperation"}, want: ErrAccessDenied},
+		{name: "NonExistentQueue", err: &smithy.GenericAPIError{Code: "AWS.SimpleQueueService.NonExistentQueue"}, want: ErrQueueNotFound},
+		{name: "NotInFlight", err: &sqstypes.MessageNotInflight{}, want: ErrMessageNotInFlight},
+		{name: "Unknown", err: &smithy.GenericAPIError{Code: "InternalError"}, want: nil},
+		{name: "Canceled", err: context.Canceled, want: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := WrapError("Op", "resource", &smithy.OperationError{ServiceID: "SQS", OperationName: "Op", Err: tt.err})
+			var awsErr *AWSError
+			if !errors.As(err, &awsErr) {
+				t.Fatalf("WrapError() = %v, want an AWSError", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("WrapError() = %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && awsErr.Kind != nil {
+				t.Errorf("WrapError() kind = %v, want none", awsErr.Kind)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("WrapError() does not wrap %v", tt.err)
+			}
+		})
+	}
+	if WrapError("Op", "resource", nil) != nil {
+		t.Errorf("WrapError(nil) != nil")
+	}
+}
+
+func TestDeleteObjectSimpleErrors(t *testing.T) {
+	client := fakeaws.NewS3("results")
+	ctx := context.TODO()
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("results"), Key: aws.String("k"), Body: strings.NewReader("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteObjectSimple(ctx, client, "k", "results"); err != nil {
+		t.Errorf("DeleteObjectSimple() error = %v", err)
+	}
+	if _, ok := client.Object("results", "k"); ok {
+		t.Errorf("DeleteObjectSimple() did not delete the object")
+	}
+	if err := DeleteObjectSimple(ctx, client, "k", "missing"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("DeleteObjectSimple() error = %v, want %v", err, ErrBucketNotFound)
+	}
+
+	client.Inject("DeleteObject", fakeaws.Fail(&smithy.GenericAPIError{Code: "AccessDenied"}, 1))
+	err := DeleteObjectSimple(ctx, client, "k", "results")
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("DeleteObjectSimple() error = %v, want %v", err, ErrAccessDenied)
+	}
+	if !strings.Contains(err.Error(), "s3://results/k") {
+		t.Errorf("DeleteObjectSimple() error = %q, want the object name", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := DeleteObjectSimple(cancelled, client, "k", "results"); !errors.Is(err, context.Canceled) {
+		t.Errorf("DeleteObjectSimple() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
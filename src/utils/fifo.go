@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// FIFOSuffix ends the names of the FIFO queues of Amazon SQS.
+const FIFOSuffix = ".fifo"
+
+// IsFIFOQueue reports whether queue, the name or the URL of a queue, is a FIFO
+// queue.
+func IsFIFOQueue(queue string) bool {
+	return strings.HasSuffix(queue, FIFOSuffix)
+}
+
+// DeduplicationID returns the deduplication ID of the messages of the job
+// jobID, or of its byte range rng if not nil. A FIFO queue drops the messages
+// sent with the ID of a message it got in the last five minutes.
+func DeduplicationID(jobID JobID, rng *ByteRange) string {
+	if rng == nil {
+		return jobID.String()
+	}
+	return jobID.String() + "_" + rng.String()
+}
+
+// DeliveryID identifies a delivery of a received message, by its message ID
+// and its receive count.
+func DeliveryID(msg types.Message) string {
+	return aws.ToString(msg.MessageId) + "-" + strconv.Itoa(ReceiveCount(msg))
+}
+
+// ReplyDeduplicationID returns the deduplication ID of the messages sent for
+// the job jobID, or its byte range rng if not nil, while a worker processes
+// the delivery of a job message, "" for none. The messages sent again for
+// another delivery, or another message, of the job are then not dropped as
+// duplicates of the messages sent for the first one.
+func ReplyDeduplicationID(jobID JobID, rng *ByteRange, delivery string) string {
+	id := DeduplicationID(jobID, rng)
+	if delivery != "" {
+		id += "_" + delivery
+	}
+	return id
+}
+
+// MessageGroupID returns the message group of job in a FIFO queue, in which
+// the messages of a group are received one at a time, in order. The jobs of a
+// tenant are in the group of the tenant, the others and the sub-jobs are in
+// a group of their own.
+func MessageGroupID(job JobMessage) string {
+	if job.Tenant != "" && job.Range == nil {
+		return job.Tenant
+	}
+	return DeduplicationID(job.JobID, job.Range)
+}
+
+// SetFIFOParams sets the deduplication ID and the message group of input if
+// its queue is a FIFO queue, and then clears its delay, which FIFO queues do
+// not allow per message.
+func SetFIFOParams(input *sqs.SendMessageInput, dedupID string, groupID string) {
+	if !IsFIFOQueue(aws.ToString(input.QueueUrl)) {
+		return
+	}
+	input.MessageDeduplicationId = aws.String(dedupID)
+	input.MessageGroupId = aws.String(groupID)
+	input.DelaySeconds = 0
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Heartbeat keeps a received message hidden from the other consumers of its
+// queue while it is processed, by extending its visibility timeout at regular
+// intervals until it is stopped.
+type Heartbeat struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// StartHeartbeat hides the message received with handle from the queue at
+// queueURL for timeout, and again every interval, until Stop is called. The
+// heartbeat gives up when the message is deleted or becomes visible again.
+// Its failures are logged to log, with the fields of log such as the identity
+// of the worker, or to Log() if log is nil.
+func StartHeartbeat(ctx context.Context, client SQSAPI, queueURL string, handle string, timeout time.Duration, interval time.Duration, log Logger) *Heartbeat {
+	if log == nil {
+		log = Log()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	h := &Heartbeat{cancel: cancel, done: make(chan struct{})}
+	go h.run(ctx, client, queueURL, handle, timeout, interval, log)
+	return h
+}
+
+func (h *Heartbeat) run(ctx context.Context, client SQSAPI, queueURL string, handle string, timeout time.Duration, interval time.Duration, log Logger) {
+	defer close(h.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := ChangeVisibilitySimple(ctx, client, queueURL, handle, timeout)
+		if ctx.Err() != nil {
+			return
+		}
+		h.mu.Lock()
+		h.err = err
+		h.mu.Unlock()
+		if errors.Is(err, ErrInvalidReceiptHandle) || errors.Is(err, ErrMessageNotInFlight) {
+			// Another consumer may have the message now, there is nothing to extend.
+			log.Warn("lost message visibility", LogKeyQueue, queueURL, LogKeyError, err)
+			return
+		}
+		if err != nil {
+			log.Warn("failed to extend message visibility", LogKeyQueue, queueURL, LogKeyError, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop ends the heartbeat and returns the error of its last extension of the
+// visibility timeout, if it failed.
+func (h *Heartbeat) Stop() error {
+	h.cancel()
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
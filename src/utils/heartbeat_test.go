@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"wordcounter/src/fakeaws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// sendAndReceive sends a message to the queue at url and returns the receipt handle of its delivery.
+func sendAndReceive(t *testing.T, client *fakeaws.SQS, url string) string {
+	t.Helper()
+	if _, err := SendMsg(context.TODO(), client, &sqs.SendMessageInput{QueueUrl: &url, MessageBody: aws.String("job")}); err != nil {
+		t.Fatalf("SendMsg() error = %v", err)
+	}
+	resp, err := GetLPMessagesByURL(context.TODO(), client, url, 1, 0)
+	if err != nil || len(resp.Messages) != 1 {
+		t.Fatalf("GetLPMessagesByURL() = %v, %v, want 1 message", resp, err)
+	}
+	return *resp.Messages[0].ReceiptHandle
+}
+
+func TestHeartbeat(t *testing.T) {
+	client := fakeaws.NewSQS("jobs")
+	url := fakeaws.QueueURL("jobs")
+	handle := sendAndReceive(t, client, url)
+
+	hb := StartHeartbeat(context.TODO(), client, url, handle, 10*time.Minute, 5*time.Millisecond, nil)
+	time.Sleep(50 * time.Millisecond)
+	if err := hb.Stop(); err != nil {
+		t.Errorf("Stop() error = %v", err)
+	}
+	calls := client.Calls("ChangeMessageVisibility")
+	if calls < 2 {
+		t.Errorf("heartbeat extended the visibility %d times, want at least 2", calls)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := client.Calls("ChangeMessageVisibility"); n != calls {
+		t.Errorf("heartbeat extended the visibility %d times after Stop", n-calls)
+	}
+
+	// The message stays hidden past the default visibility timeout of the queue
+	client.Now = func() time.Time { return time.Now().Add(fakeaws.DefaultVisibilityTimeout + time.Minute) }
+	resp, err := GetLPMessagesByURL(context.TODO(), client, url, 1, 0)
+	if err != nil || len(resp.Messages) != 0 {
+		t.Errorf("GetLPMessagesByURL() = %d messages, %v, want none", len(resp.Messages), err)
+	}
+}
+
+func TestHeartbeatErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault *fakeaws.Fault
+		lose  bool
+		want  error
+	}{
+		{
+			name:  "Throttled",
+			fault: &fakeaws.Fault{Err: fakeaws.ThrottlingError(fakeaws.SQSThrottlingCode), Times: 1},
+			want:  nil,
+		},
+		{
+			name: "Deleted",
+			lose: true,
+			want: ErrInvalidReceiptHandle,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fakeaws.NewSQS("jobs")
+			url := fakeaws.QueueURL("jobs")
+			handle := sendAndReceive(t, client, url)
+			if tt.fault != nil {
+				client.Inject("ChangeMessageVisibility", *tt.fault)
+			}
+			if tt.lose {
+				if err := RemoveMessageSimple(context.TODO(), client, url, handle); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var logs bytes.Buffer
+			log := NewJSONLogger(&logs, LevelWarn).With(LogKeyWorkerID, "w1", "instance_id", "i-0001")
+			hb := StartHeartbeat(context.TODO(), client, url, handle, time.Minute, 5*time.Millisecond, log)
+			time.Sleep(30 * time.Millisecond)
+			err := hb.Stop()
+			if !errors.Is(err, tt.want) || (err != nil) != (tt.want != nil) {
+				t.Errorf("Stop() error = %v, want %v", err, tt.want)
+			}
+			// The failures are logged with the identity of the worker
+			if tt.lose && !strings.Contains(logs.String(), `"worker_id":"w1","instance_id":"i-0001"`) {
+				t.Errorf("heartbeat logged %s, want records with the identity of the worker", logs.String())
+			}
+			// A lost message is not extended again
+			if calls := client.Calls("ChangeMessageVisibility"); tt.lose && calls != 1 {
+				t.Errorf("heartbeat extended a lost message %d times, want 1", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// MetadataAPI defines the interface for the GetMetadata function.
+// We use this interface to test the function using a fake metadata service.
+type MetadataAPI interface {
+	GetMetadata(ctx context.Context,
+		params *imds.GetMetadataInput,
+		optFns ...func(*imds.Options)) (*imds.GetMetadataOutput, error)
+}
+
+// NewMetadataClient returns a client of the instance metadata service at
+// endpoint, or of the instance it runs on if endpoint is empty and the
+// AWS_EC2_METADATA_SERVICE_ENDPOINT environment variable is not set.
+func NewMetadataClient(endpoint string) *imds.Client {
+	// The wrappers retry the calls with the policy of "GetMetadata"
+	return imds.New(imds.Options{Endpoint: endpoint, Retryer: aws.NopRetryer{}})
+}
+
+// GetMetadata retrieves a category of the metadata of the instance.
+// Inputs:
+//     c is the context of the method call.
+//     api is the interface that defines the method call.
+//     input defines the input arguments to the service call.
+// Output:
+//     If success, a GetMetadataOutput object containing the result of the service call and nil.
+//     Otherwise, nil and an error from the call to GetMetadata.
+func GetMetadata(c context.Context, api MetadataAPI, input *imds.GetMetadataInput) (*imds.GetMetadataOutput, error) {
+	var out *imds.GetMetadataOutput
+	err := Retry(c, "GetMetadata", func(ctx context.Context) (err error) {
+		out, err = api.GetMetadata(ctx, input)
+		return err
+	})
+	return out, err
+}
+
+// GetMetadataSimple returns the metadata of the instance at path, such as
+// "instance-id". The error is of kind ErrMetadataNotFound if there is none.
+func GetMetadataSimple(ctx context.Context, api MetadataAPI, path string) (string, error) {
+	out, err := GetMetadata(ctx, api, &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound {
+			return "", &AWSError{Op: "GetMetadata", Resource: path, Kind: ErrMetadataNotFound, Err: err}
+		}
+		return "", WrapError("GetMetadata", path, err)
+	}
+	defer out.Content.Close()
+	data, err := ioutil.ReadAll(out.Content)
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata '%s': %v", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SpotAction is the interruption notice of a spot instance, given about two
+// minutes before the instance is interrupted.
+type SpotAction struct {
+	// Action is "terminate", "stop" or "hibernate".
+	Action string `json:"action"`
+	// Time is when the instance is interrupted.
+	Time time.Time `json:"time"`
+}
+
+// SpotInterruption returns the interruption notice of the spot instance, or
+// nil if it has none.
+func SpotInterruption(ctx context.Context, api MetadataAPI) (*SpotAction, error) {
+	data, err := GetMetadataSimple(ctx, api, "spot/instance-action")
+	if errors.Is(err, ErrMetadataNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var action SpotAction
+	if err := json.Unmarshal([]byte(data), &action); err != nil {
+		return nil, fmt.Errorf("failed to parse spot interruption notice: %v", err)
+	}
+	return &action, nil
+}
+
+// WatchSpotInterruption checks for an interruption notice of the spot instance
+// every interval and returns it once there is one, or the error of ctx when it
+// is done first. The failed checks are logged and tried again.
+func WatchSpotInterruption(ctx context.Context, api MetadataAPI, interval time.Duration) (*SpotAction, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		action, err := SpotInterruption(ctx, api)
+		if action != nil {
+			return action, nil
+		}
+		if err != nil && ctx.Err() == nil {
+			Log().Warn("failed to check for a spot interruption", LogKeyError, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Identity is the instance a worker runs on, stamped on its results and
+// checkpoints.
+type Identity struct {
+	InstanceID       string `json:"instanceId,omitempty"`
+	PrivateIP        string `json:"privateIp,omitempty"`
+	PublicIP         string `json:"publicIp,omitempty"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	InstanceType     string `json:"instanceType,omitempty"`
+}
+
+// DiscoverIdentity returns the identity of the instance from its metadata.
+// The public IP of an instance without one is left empty.
+func DiscoverIdentity(ctx context.Context, api MetadataAPI) (Identity, error) {
+	var id Identity
+	fields := []struct {
+		path     string
+		value    *string
+		optional bool
+	}{
+		{"instance-id", &id.InstanceID, false},
+		{"local-ipv4", &id.PrivateIP, false},
+		{"public-ipv4", &id.PublicIP, true},
+		{"placement/availability-zone", &id.AvailabilityZone, false},
+		{"instance-type", &id.InstanceType, false},
+	}
+	for _, f := range fields {
+		value, err := GetMetadataSimple(ctx, api, f.path)
+		if err != nil && !(f.optional && errors.Is(err, ErrMetadataNotFound)) {
+			return Identity{}, err
+		}
+		*f.value = value
+	}
+	return id, nil
+}
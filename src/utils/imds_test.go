@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"wordcounter/src/fakeaws"
+)
+
+const spotNotice = `{"action": "terminate", "time": "2021-03-04T05:08:00Z"}`
+
+func TestSpotInterruption(t *testing.T) {
+	server := fakeaws.NewMetadataServer()
+	defer server.Close()
+	client := NewMetadataClient(server.URL)
+
+	if action, err := SpotInterruption(context.TODO(), client); action != nil || err != nil {
+		t.Errorf("SpotInterruption() without notice = %+v, %v, want nil, nil", action, err)
+	}
+	if _, err := GetMetadataSimple(context.TODO(), client, "instance-id"); !errors.Is(err, ErrMetadataNotFound) {
+		t.Errorf("GetMetadataSimple() of missing metadata error = %v, want %v", err, ErrMetadataNotFound)
+	}
+
+	server.Set("meta-data/spot/instance-action", spotNotice)
+	// A server fault is retried
+	server.Inject("meta-data/spot/instance-action", fakeaws.Fail(errors.New("unavailable"), 1))
+	action, err := SpotInterruption(context.TODO(), client)
+	want := SpotAction{Action: "terminate", Time: time.Date(2021, 3, 4, 5, 8, 0, 0, time.UTC)}
+	if err != nil || action == nil || *action != want {
+		t.Errorf("SpotInterruption() = %+v, %v, want %+v", action, err, want)
+	}
+	// The missing notice was not retried
+	if calls := server.Calls("meta-data/spot/instance-action"); calls != 3 {
+		t.Errorf("metadata requests = %d, want 3", calls)
+	}
+
+	server.Set("meta-data/spot/instance-action", "{")
+	if _, err := SpotInterruption(context.TODO(), client); err == nil {
+		t.Errorf("SpotInterruption() of a malformed notice succeeded")
+	}
+}
+
+func TestWatchSpotInterruption(t *testing.T) {
+	server := fakeaws.NewMetadataServer()
+	defer server.Close()
+	client := NewMetadataClient(server.URL)
+
+	time.AfterFunc(20*time.Millisecond, func() { server.Set("meta-data/spot/instance-action", spotNotice) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	action, err := WatchSpotInterruption(ctx, client, 5*time.Millisecond)
+	if err != nil || action == nil || action.Action != "terminate" {
+		t.Errorf("WatchSpotInterruption() = %+v, %v, want the notice", action, err)
+	}
+
+	server.Delete("meta-data/spot/instance-action")
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if action, err := WatchSpotInterruption(ctx, client, 5*time.Millisecond); action != nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WatchSpotInterruption() without notice = %+v, %v, want %v", action, err, context.DeadlineExceeded)
+	}
+}
+
+func TestDiscoverIdentity(t *testing.T) {
+	server := fakeaws.NewMetadataServer()
+	defer server.Close()
+	client := NewMetadataClient(server.URL)
+	server.Set("meta-data/instance-id", "i-0001")
+	server.Set("meta-data/local-ipv4", "10.0.0.1")
+	server.Set("meta-data/placement/availability-zone", "eu-west-1a")
+	server.Set("meta-data/instance-type", "t3.micro")
+
+	// An instance in a private subnet has no public IP
+	want := Identity{InstanceID: "i-0001", PrivateIP: "10.0.0.1", AvailabilityZone: "eu-west-1a", InstanceType: "t3.micro"}
+	if id, err := DiscoverIdentity(context.TODO(), client); err != nil || id != want {
+		t.Errorf("DiscoverIdentity() = %+v, %v, want %+v", id, err, want)
+	}
+
+	server.Set("meta-data/public-ipv4", "1.2.3.4")
+	want.PublicIP = "1.2.3.4"
+	if id, err := DiscoverIdentity(context.TODO(), client); err != nil || id != want {
+		t.Errorf("DiscoverIdentity() = %+v, %v, want %+v", id, err, want)
+	}
+
+	server.Delete("meta-data/instance-type")
+	if _, err := DiscoverIdentity(context.TODO(), client); !errors.Is(err, ErrMetadataNotFound) {
+		t.Errorf("DiscoverIdentity() without instance type error = %v, want %v", err, ErrMetadataNotFound)
+	}
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// JobID identifies a job from its submission to its result. It is a random
+// (version 4) UUID in its canonical form, such as "0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a".
+// The client generates it once and it is then carried by the job and result
+// messages, their JobId attribute and the keys of the result objects.
+type JobID string
+
+// NewJobID returns a new random JobID.
+func NewJobID() JobID {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("failed to generate job id: " + err.Error())
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	return JobID(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]))
+}
+
+// ParseJobID checks that s is a JobID in canonical form.
+func ParseJobID(s string) (JobID, error) {
+	id := JobID(s)
+	if !id.Valid() {
+		return "", fmt.Errorf("invalid job id '%s'", s)
+	}
+	return id, nil
+}
+
+// Valid reports whether id is a UUID in canonical lower case form.
+func (id JobID) Valid() bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (id JobID) String() string {
+	return string(id)
+}
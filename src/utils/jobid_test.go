@@ -0,0 +1,38 @@
+package utils
+
+import "testing"
+
+func TestNewJobID(t *testing.T) {
+	seen := make(map[JobID]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewJobID()
+		if !id.Valid() {
+			t.Fatalf("NewJobID() = '%s', not a valid job id", id)
+		}
+		if id[14] != '4' {
+			t.Errorf("NewJobID() = '%s', want a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("NewJobID() returned '%s' twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestParseJobID(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{id: "0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a"},
+		{id: "1617112345678", wantErr: true},
+		{id: "0B7FA8E2-6D3C-4C1E-9A55-3F0E2D1C4B6A", wantErr: true},
+		{id: "0b7fa8e2x6d3c-4c1e-9a55-3f0e2d1c4b6a", wantErr: true},
+		{id: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := ParseJobID(tt.id); (err != nil) != tt.wantErr {
+			t.Errorf("ParseJobID('%s') error = %v, wantErr %v", tt.id, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// JobStatus is the stage of a job in its life.
+type JobStatus string
+
+// Statuses of a job
+const (
+	// StatusSubmitted is a job about to be sent to the job queue.
+	StatusSubmitted JobStatus = "submitted"
+	// StatusQueued is a job waiting in the job queue, for the first time or
+	// to be tried again.
+	StatusQueued JobStatus = "queued"
+	// StatusRunning is a job taken by a worker.
+	StatusRunning JobStatus = "running"
+	// StatusSucceeded is a job with its result in the result bucket.
+	StatusSucceeded JobStatus = "succeeded"
+	// StatusFailed is a job given up on, it runs again if it is redriven.
+	StatusFailed JobStatus = "failed"
+	// StatusCancelled is a job cancelled by its submitter.
+	StatusCancelled JobStatus = "cancelled"
+	// StatusExpired is a job not done by its deadline.
+	StatusExpired JobStatus = "expired"
+)
+
+// Done reports whether a job of the status never runs again.
+func (s JobStatus) Done() bool {
+	return s == StatusSucceeded || s == StatusCancelled || s == StatusExpired
+}
+
+// JobState is the persistent state of a job, stored in the result bucket.
+type JobState struct {
+	JobID  JobID     `json:"jobId"`
+	Status JobStatus `json:"status"`
+	Bucket string    `json:"bucket,omitempty"`
+	Key    string    `json:"key,omitempty"`
+	// WorkerID is the worker running the job, or the last one that did.
+	WorkerID string `json:"workerId,omitempty"`
+	// Instance is the instance WorkerID runs on, if known.
+	Instance *Identity `json:"instance,omitempty"`
+	// Reason is why the job failed or was last tried again.
+	Reason string `json:"reason,omitempty"`
+	// ResultKey is the key of the counts of a succeeded job.
+	ResultKey string `json:"resultKey,omitempty"`
+	// SubJobs is the progress of the sub-jobs of a job split by a master.
+	SubJobs *SubJobProgress `json:"subJobs,omitempty"`
+	Updated time.Time       `json:"updated"`
+	// History lists the changes of status, oldest first.
+	History []StatusChange `json:"history"`
+}
+
+// SubJobProgress counts the sub-jobs of a job.
+type SubJobProgress struct {
+	Total int `json:"total"`
+	Done  int `json:"done"`
+	// Pending are the byte ranges of the sub-jobs not done yet, in order.
+	Pending []ByteRange `json:"pending,omitempty"`
+}
+
+// StatusChange is an entry of the history of a job.
+type StatusChange struct {
+	Status   JobStatus `json:"status"`
+	Time     time.Time `json:"time"`
+	WorkerID string    `json:"workerId,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// Set changes the status of the job at now, and reports whether it did. The
+// status of a job that is done does not change any more. Setting the status
+// again only records a new worker or reason.
+func (s *JobState) Set(status JobStatus, workerID string, reason string, now time.Time) bool {
+	if s.Status.Done() {
+		return false
+	}
+	reason = truncateReason(reason)
+	changed := s.Status != status || s.WorkerID != workerID && workerID != "" || s.Reason != reason
+	s.Status = status
+	if workerID != "" {
+		s.WorkerID = workerID
+	}
+	s.Reason = reason
+	s.Updated = now.UTC()
+	if changed {
+		s.History = append(s.History, StatusChange{Status: status, Time: s.Updated, WorkerID: workerID, Reason: reason})
+	}
+	return true
+}
+
+// JobStateKey returns the key of the state of the job jobID in the result bucket.
+func JobStateKey(jobID JobID) string {
+	return "state/" + jobID.String() + ".json"
+}
+
+// CancelKey returns the key of the object marking the job jobID as cancelled in
+// the result bucket. Unlike the state of the job, it is never overwritten by
+// a worker updating the state at the same time.
+func CancelKey(jobID JobID) string {
+	return "cancelled/" + jobID.String()
+}
+
+// CancelJob marks the job jobID, with its state stored in bucket, as
+// cancelled, unless it succeeded or expired already. A job without a state,
+// whose state was lost or not saved yet, is cancelled all the same. It returns
+// the state of the job.
+func CancelJob(ctx context.Context, client S3API, bucket string, jobID JobID, now time.Time) (JobState, error) {
+	state, err := LoadJobState(ctx, client, bucket, jobID)
+	if err != nil {
+		return JobState{}, err
+	}
+	if state == nil {
+		Log().Warn("job state not found, cancelling the job anyway", LogKeyJobID, jobID)
+		state = &JobState{JobID: jobID}
+	}
+	if state.Status.Done() && state.Status != StatusCancelled {
+		return *state, nil
+	}
+	key := CancelKey(jobID)
+	_, err = PutFile(ctx, client, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   bytes.NewReader([]byte(now.UTC().Format(time.RFC3339))),
+	})
+	if err != nil {
+		return *state, WrapError("PutObject", ObjectName(bucket, key), err)
+	}
+	return UpdateJobState(ctx, client, bucket, jobID, func(state *JobState) bool {
+		return state.Set(StatusCancelled, "", "cancelled by the client", now)
+	})
+}
+
+// JobCancelled reports whether the job jobID, with its state stored in
+// bucket, was cancelled.
+func JobCancelled(ctx context.Context, client S3HeadObjectAPI, bucket string, jobID JobID) (bool, error) {
+	return ObjectExists(ctx, client, CancelKey(jobID), bucket)
+}
+
+// LoadJobState returns the state of the job jobID stored in bucket, or nil if
+// there is none.
+func LoadJobState(ctx context.Context, client S3GetObjectAPI, bucket string, jobID JobID) (*JobState, error) {
+	key := JobStateKey(jobID)
+	obj, err := GetObject(ctx, client, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		err = WrapError("GetObject", ObjectName(bucket, key), err)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	data, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job state '%s': %v", key, err)
+	}
+	var state JobState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse job state '%s': %v", key, err)
+	}
+	return &state, nil
+}
+
+// SaveJobState stores state in bucket, replacing the previous state of the job.
+func SaveJobState(ctx context.Context, client S3PutObjectAPI, bucket string, state JobState) error {
+	key := JobStateKey(state.JobID)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = PutFile(ctx, client, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return WrapError("PutObject", ObjectName(bucket, key), err)
+	}
+	Log().Debug("saved job state", LogKeyJobID, state.JobID, "status", state.Status)
+	return nil
+}
+
+// UpdateJobState applies change to the state of the job jobID stored in
+// bucket, or to a new state if there is none, and stores it unless change
+// returns false. It returns the state after the change.
+//
+// The state is read and written without a lock, the last of two concurrent
+// updates wins.
+func UpdateJobState(ctx context.Context, client S3API, bucket string, jobID JobID, change func(*JobState) bool) (JobState, error) {
+	state, err := LoadJobState(ctx, client, bucket, jobID)
+	if err != nil {
+		return JobState{}, err
+	}
+	if state == nil {
+		state = &JobState{JobID: jobID}
+	}
+	if !change(state) {
+		return *state, nil
+	}
+	return *state, SaveJobState(ctx, client, bucket, *state)
+}
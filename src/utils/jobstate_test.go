@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"wordcounter/src/fakeaws"
+)
+
+func TestJobStateSet(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name        string
+		from        JobStatus
+		to          JobStatus
+		workerID    string
+		reason      string
+		want        bool
+		wantHistory int
+	}{
+		{"Start", StatusQueued, StatusRunning, "w1", "", true, 2},
+		{"SameWorker", StatusRunning, StatusRunning, "w0", "", true, 1},
+		{"OtherWorker", StatusRunning, StatusRunning, "w1", "", true, 2},
+		{"Retried", StatusRunning, StatusQueued, "w0", "throttled", true, 2},
+		{"Redriven", StatusFailed, StatusQueued, "", "redriven", true, 2},
+		{"Succeeded", StatusSucceeded, StatusRunning, "w1", "", false, 1},
+		{"Cancelled", StatusCancelled, StatusFailed, "w1", "boom", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := JobState{Status: tt.from, WorkerID: "w0", History: []StatusChange{{Status: tt.from}}}
+			if got := s.Set(tt.to, tt.workerID, tt.reason, now); got != tt.want {
+				t.Fatalf("Set() = %v, want %v", got, tt.want)
+			}
+			if len(s.History) != tt.wantHistory {
+				t.Errorf("Set() made a history of %d changes, want %d", len(s.History), tt.wantHistory)
+			}
+			if !tt.want {
+				if s.Status != tt.from {
+					t.Errorf("Set() changed the status of a done job to %s", s.Status)
+				}
+				return
+			}
+			if s.Status != tt.to || s.Reason != tt.reason || !s.Updated.Equal(now) {
+				t.Errorf("Set() = %+v", s)
+			}
+		})
+	}
+}
+
+func TestUpdateJobState(t *testing.T) {
+	client := fakeaws.NewS3("results")
+	id := NewJobID()
+	if state, err := LoadJobState(context.TODO(), client, "results", id); state != nil || err != nil {
+		t.Errorf("LoadJobState() of a new job = %+v, %v, want nil, nil", state, err)
+	}
+
+	update := func(status JobStatus) JobState {
+		t.Helper()
+		state, err := UpdateJobState(context.TODO(), client, "results", id, func(s *JobState) bool {
+			return s.Set(status, "w1", "", time.Now())
+		})
+		if err != nil {
+			t.Fatalf("UpdateJobState() error = %v", err)
+		}
+		return state
+	}
+	update(StatusRunning)
+	update(StatusCancelled)
+	if state := update(StatusSucceeded); state.Status != StatusCancelled {
+		t.Errorf("UpdateJobState() of a cancelled job = %s", state.Status)
+	}
+	state, err := LoadJobState(context.TODO(), client, "results", id)
+	if err != nil || state == nil || state.Status != StatusCancelled || len(state.History) != 2 {
+		t.Errorf("LoadJobState() = %+v, %v, want cancelled after running", state, err)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        JobStatus
+		wantStatus    JobStatus
+		wantCancelled bool
+		wantErr       bool
+	}{
+		{"NotFound", "", StatusCancelled, true, false},
+		{"Queued", StatusQueued, StatusCancelled, true, false},
+		{"Running", StatusRunning, StatusCancelled, true, false},
+		{"Failed", StatusFailed, StatusCancelled, true, false},
+		{"Succeeded", StatusSucceeded, StatusSucceeded, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fakeaws.NewS3("results")
+			id := NewJobID()
+			if tt.status != "" {
+				state := JobState{JobID: id}
+				state.Set(tt.status, "w1", "", time.Now())
+				if err := SaveJobState(context.TODO(), client, "results", state); err != nil {
+					t.Fatal(err)
+				}
+			}
+			state, err := CancelJob(context.TODO(), client, "results", id, time.Now())
+			if (err != nil) != tt.wantErr || state.Status != tt.wantStatus {
+				t.Errorf("CancelJob() = %s, %v, want %s", state.Status, err, tt.wantStatus)
+			}
+			cancelled, err := JobCancelled(context.TODO(), client, "results", id)
+			if err != nil || cancelled != tt.wantCancelled {
+				t.Errorf("JobCancelled() = %v, %v, want %v", cancelled, err, tt.wantCancelled)
+			}
+		})
+	}
+}
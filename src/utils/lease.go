@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Renewal of the leases of the workers
+const (
+	// LeaseInterval is the time between two renewals of the lease of a worker.
+	LeaseInterval = 30 * time.Second
+	// LeaseTTL is how long a lease lasts once renewed, a worker missing two
+	// renewals in a row is taken for dead.
+	LeaseTTL = 3 * LeaseInterval
+)
+
+// workerLeasePrefix is the prefix of the keys of the leases in the result bucket.
+const workerLeasePrefix = "workers/"
+
+// WorkerLease tells that a worker polls the queue of the jobs addressed to it.
+// The worker renews it while it polls the queue, the jobs are only routed to
+// the queue while the lease lasts. It is stored in the result bucket.
+type WorkerLease struct {
+	WorkerID string `json:"workerId"`
+	// Queue is the name of the queue of the worker.
+	Queue string `json:"queue"`
+	// Instance is the instance the worker runs on, if known.
+	Instance *Identity `json:"instance,omitempty"`
+	Renewed  time.Time `json:"renewed"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Alive reports whether the worker of the lease l is taken for alive at now.
+// A nil lease is not.
+func (l *WorkerLease) Alive(now time.Time) bool {
+	return l != nil && now.Before(l.Expires)
+}
+
+// WorkerLeaseKey returns the key of the lease of the worker polling the queue
+// named queueName in the result bucket.
+func WorkerLeaseKey(queueName string) string {
+	return workerLeasePrefix + queueName + ".json"
+}
+
+// SaveWorkerLease stores lease in bucket, replacing the previous one.
+func SaveWorkerLease(ctx context.Context, client S3PutObjectAPI, bucket string, lease WorkerLease) error {
+	key := WorkerLeaseKey(lease.Queue)
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	_, err = PutFile(ctx, client, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return WrapError("PutObject", ObjectName(bucket, key), err)
+	}
+	Log().Debug("saved worker lease", LogKeyWorkerID, lease.WorkerID, LogKeyQueue, lease.Queue, "expires", lease.Expires)
+	return nil
+}
+
+// LoadWorkerLease returns the lease of the worker polling the queue named
+// queueName stored in bucket, or nil if there is none.
+func LoadWorkerLease(ctx context.Context, client S3GetObjectAPI, bucket string, queueName string) (*WorkerLease, error) {
+	key := WorkerLeaseKey(queueName)
+	obj, err := GetObject(ctx, client, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		err = WrapError("GetObject", ObjectName(bucket, key), err)
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	data, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read worker lease '%s': %v", key, err)
+	}
+	var lease WorkerLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, fmt.Errorf("failed to parse worker lease '%s': %v", key, err)
+	}
+	return &lease, nil
+}
+
+// ListWorkerLeases returns the names of the queues with a lease stored in bucket.
+func ListWorkerLeases(ctx context.Context, client S3ListObjectsAPI, bucket string) ([]string, error) {
+	keys, err := ListObjectKeys(ctx, client, bucket, workerLeasePrefix)
+	if err != nil {
+		return nil, err
+	}
+	queues := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if name := strings.TrimSuffix(strings.TrimPrefix(key, workerLeasePrefix), ".json"); name != "" && !strings.Contains(name, "/") {
+			queues = append(queues, name)
+		}
+	}
+	return queues, nil
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is the leveled, structured logger used by the utils functions and the
+// binaries. Its methods take a message and alternating keys and values, as the
+// methods of *slog.Logger do, which therefore implements it.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Keys of the fields shared by the log records
+const (
+	LogKeyJobID    = "job_id"
+	LogKeyWorkerID = "worker_id"
+	LogKeyQueue    = "queue"
+	LogKeyBucket   = "bucket"
+	LogKeyKey      = "key"
+	LogKeyError    = "error"
+)
+
+// Level is the severity of a log record, with the values of slog.Level.
+type Level int
+
+// Levels of the log records
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLevel returns the level named s, such as "info" or "WARN".
+func ParseLevel(s string) (Level, error) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", s)
+}
+
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = NewJSONLogger(os.Stderr, LevelInfo)
+)
+
+// SetLogger makes the utils functions log to l, a nil l discards their logs.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = NewJSONLogger(ioutil.Discard, LevelError+1)
+	}
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+// Log returns the logger of the utils functions.
+func Log() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return logger
+}
+
+// JSONLogger writes the records at or above its level as JSON objects, one per
+// line, in the format of slog.JSONHandler.
+type JSONLogger struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level Level
+	attrs []byte // encoded fields added by With
+	// Now returns the time of the records, it can be replaced in tests.
+	Now func() time.Time
+}
+
+// NewJSONLogger returns a logger writing the records at or above level to w.
+func NewJSONLogger(w io.Writer, level Level) *JSONLogger {
+	return &JSONLogger{mu: new(sync.Mutex), w: w, level: level, Now: time.Now}
+}
+
+// With returns a logger adding the fields args to every record.
+func (l *JSONLogger) With(args ...interface{}) *JSONLogger {
+	child := *l
+	child.attrs = appendFields(append([]byte(nil), l.attrs...), args)
+	return &child
+}
+
+// Enabled reports whether records at level are written.
+func (l *JSONLogger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug logs msg and the fields args at LevelDebug.
+func (l *JSONLogger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+
+// Info logs msg and the fields args at LevelInfo.
+func (l *JSONLogger) Info(msg string, args ...interface{}) { l.log(LevelInfo, msg, args) }
+
+// Warn logs msg and the fields args at LevelWarn.
+func (l *JSONLogger) Warn(msg string, args ...interface{}) { l.log(LevelWarn, msg, args) }
+
+// Error logs msg and the fields args at LevelError.
+func (l *JSONLogger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
+
+func (l *JSONLogger) log(level Level, msg string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	buf := []byte(`{"time":`)
+	buf = appendJSON(buf, l.Now().Format(time.RFC3339Nano))
+	buf = append(buf, `,"level":`...)
+	buf = appendJSON(buf, level.String())
+	buf = append(buf, `,"msg":`...)
+	buf = appendJSON(buf, msg)
+	buf = append(buf, l.attrs...)
+	buf = appendFields(buf, args)
+	buf = append(buf, "}\n"...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf)
+}
+
+// appendFields appends the alternating keys and values of args as JSON
+// members. A value without a string key is logged with the key "!BADKEY".
+func appendFields(buf []byte, args []interface{}) []byte {
+	for len(args) > 0 {
+		var key string
+		var value interface{}
+		if k, ok := args[0].(string); ok && len(args) > 1 {
+			key, value, args = k, args[1], args[2:]
+		} else {
+			key, value, args = "!BADKEY", args[0], args[1:]
+		}
+		buf = append(buf, ',')
+		buf = appendJSON(buf, key)
+		buf = append(buf, ':')
+		buf = appendJSON(buf, value)
+	}
+	return buf
+}
+
+// appendJSON appends the JSON encoding of v. Errors, Stringers and values
+// that cannot be encoded are written as strings, nil pointers as null.
+func appendJSON(buf []byte, v interface{}) []byte {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return append(buf, "null"...)
+	}
+	switch x := v.(type) {
+	case json.Marshaler:
+	case error:
+		v = x.Error()
+	case fmt.Stringer:
+		v = x.String()
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		b.Reset()
+		enc.Encode(fmt.Sprint(v))
+	}
+	return append(buf, bytes.TrimRight(b.Bytes(), "\n")...)
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var _ Logger = (*JSONLogger)(nil)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewJSONLogger(&buf, LevelInfo)
+	log.Now = func() time.Time { return time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC) }
+	id := JobID("0b7e3c5c-4f1b-4bde-9b5e-0a4d8f7a6c21")
+
+	log.Debug("hidden")
+	log.With(LogKeyWorkerID, "w1").Info("counting job", LogKeyJobID, id, "words", 3, "range", &ByteRange{Start: 0, End: 10})
+	log.Info("counting job", "range", (*ByteRange)(nil))
+	log.Error("failed", LogKeyError, errors.New("boom <x>"), "dangling")
+
+	want := `{"time":"2021-03-04T05:06:07Z","level":"INFO","msg":"counting job","worker_id":"w1","job_id":"0b7e3c5c-4f1b-4bde-9b5e-0a4d8f7a6c21","words":3,"range":"0-10"}
+{"time":"2021-03-04T05:06:07Z","level":"INFO","msg":"counting job","range":null}
+{"time":"2021-03-04T05:06:07Z","level":"ERROR","msg":"failed","error":"boom <x>","!BADKEY":"dangling"}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("JSONLogger wrote\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Level
+		wantErr bool
+	}{
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{"Warn", LevelWarn, false},
+		{"error", LevelError, false},
+		{"verbose", LevelInfo, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	defer SetLogger(Log())
+	var buf bytes.Buffer
+	SetLogger(NewJSONLogger(&buf, LevelDebug))
+	Log().Debug("deleted message", LogKeyQueue, "jobs")
+	if !strings.Contains(buf.String(), `"queue":"jobs"`) {
+		t.Errorf("Log() wrote %q to another logger", buf.String())
+	}
+	SetLogger(nil)
+	Log().Error("discarded")
+	if strings.Contains(buf.String(), "discarded") {
+		t.Errorf("SetLogger(nil) did not discard the records")
+	}
+}
@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"wordcounter/src/counter"
+)
+
+// MessageVersion is the version of the message envelopes written by EncodeJob
+// and EncodeResult. It changes only when the older builds could not do the
+// jobs or use the results of the new envelopes right. The fields added within
+// a version are optional, and ignored by the builds that do not know them, so
+// that the workers and clients of a fleet can be upgraded one at a time.
+const MessageVersion = 1
+
+var (
+	// ErrMalformedMessage is returned when a message body is not a valid envelope.
+	ErrMalformedMessage = errors.New("malformed message")
+	// ErrUnknownVersion is returned when a message envelope has a version this build cannot read.
+	ErrUnknownVersion = errors.New("unknown message version")
+)
+
+// ByteRange is the range [Start, End) of the bytes of an object.
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// JobMessage is the body of the messages of the job and sub-job queues.
+type JobMessage struct {
+	Version int    `json:"version"`
+	JobID   JobID  `json:"jobId"`
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	// Range limits the job to a part of the object, nil counts the whole object.
+	Range   *ByteRange      `json:"range,omitempty"`
+	Options counter.Options `json:"options"`
+	// ReplyTo is the name of the queue the result is sent to,
+	// empty for the default result queue of the worker.
+	ReplyTo   string `json:"replyTo,omitempty"`
+	Submitter string `json:"submitter,omitempty"`
+	// Tenant is the team the job is run for, the jobs of a tenant are run in
+	// order when the job queue is a FIFO queue.
+	Tenant string `json:"tenant,omitempty"`
+	// Deadline is when the job is given up on if it is not done, nil for never.
+	// The sub-jobs of a job have its deadline.
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// Expired reports whether the deadline of the job has passed at now.
+func (m JobMessage) Expired(now time.Time) bool {
+	return m.Deadline != nil && !now.Before(*m.Deadline)
+}
+
+// Validate checks the fields of a job message.
+func (m JobMessage) Validate() error {
+	switch {
+	case m.Version != MessageVersion:
+		return fmt.Errorf("%w %d", ErrUnknownVersion, m.Version)
+	case !m.JobID.Valid():
+		return fmt.Errorf("%w: invalid job id '%s'", ErrMalformedMessage, m.JobID)
+	case m.Bucket == "":
+		return fmt.Errorf("%w: missing bucket", ErrMalformedMessage)
+	case m.Key == "":
+		return fmt.Errorf("%w: missing key", ErrMalformedMessage)
+	case m.Range != nil && (m.Range.Start < 0 || m.Range.End <= m.Range.Start):
+		return fmt.Errorf("%w: invalid byte range %s", ErrMalformedMessage, m.Range)
+	case m.Options.MinLength < 0 || m.Options.MaxWordBytes < 0:
+		return fmt.Errorf("%w: invalid counting options", ErrMalformedMessage)
+	}
+	return nil
+}
+
+// ResultMessage is the body of the messages of the result and sub-result queues.
+type ResultMessage struct {
+	Version int    `json:"version"`
+	JobID   JobID  `json:"jobId"`
+	Key     string `json:"key"`
+	// Range is the part of the object counted, nil for the whole object.
+	Range *ByteRange `json:"range,omitempty"`
+	// ResultBucket and ResultKey name the object holding the JSON word counts.
+	ResultBucket string `json:"resultBucket"`
+	ResultKey    string `json:"resultKey"`
+	WorkerID     string `json:"workerId,omitempty"`
+	// Instance is the instance the worker runs on, if known.
+	Instance *Identity `json:"instance,omitempty"`
+	// Error is why the job failed for good, the result names no counts then.
+	Error string `json:"error,omitempty"`
+}
+
+// ResultKey returns the key of the counts of the job jobID, or of its byte range
+// rng if not nil, in the result bucket. The key only depends on the job and
+// the range, so that a job delivered more than once overwrites its own counts.
+func ResultKey(jobID JobID, rng *ByteRange) string {
+	if rng == nil {
+		return "results/" + jobID.String() + ".json"
+	}
+	return PartialResultPrefix(jobID) + rng.String() + ".json"
+}
+
+// PartialResultPrefix returns the prefix of the keys of the counts of the byte
+// ranges of the job jobID.
+func PartialResultPrefix(jobID JobID) string {
+	return "results/" + jobID.String() + "/"
+}
+
+// Validate checks the fields of a result message.
+func (m ResultMessage) Validate() error {
+	switch {
+	case m.Version != MessageVersion:
+		return fmt.Errorf("%w %d", ErrUnknownVersion, m.Version)
+	case !m.JobID.Valid():
+		return fmt.Errorf("%w: invalid job id '%s'", ErrMalformedMessage, m.JobID)
+	case m.Error == "" && (m.ResultBucket == "" || m.ResultKey == ""):
+		return fmt.Errorf("%w: missing result object", ErrMalformedMessage)
+	case m.Range != nil && (m.Range.Start < 0 || m.Range.End <= m.Range.Start):
+		return fmt.Errorf("%w: invalid byte range %s", ErrMalformedMessage, m.Range)
+	}
+	return nil
+}
+
+// EncodeJob validates job and returns it as a message body.
+// A zero Version is set to MessageVersion.
+func EncodeJob(job JobMessage) (string, error) {
+	if job.Version == 0 {
+		job.Version = MessageVersion
+	}
+	if err := job.Validate(); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(job)
+	return string(data), err
+}
+
+// DecodeJob parses and validates a message body written by EncodeJob.
+// The error wraps ErrUnknownVersion or ErrMalformedMessage.
+func DecodeJob(body string) (JobMessage, error) {
+	var job JobMessage
+	if err := decodeEnvelope(body, &job); err != nil {
+		return job, err
+	}
+	return job, job.Validate()
+}
+
+// EncodeResult validates result and returns it as a message body.
+// A zero Version is set to MessageVersion.
+func EncodeResult(result ResultMessage) (string, error) {
+	if result.Version == 0 {
+		result.Version = MessageVersion
+	}
+	if err := result.Validate(); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(result)
+	return string(data), err
+}
+
+// DecodeResult parses and validates a message body written by EncodeResult.
+// The error wraps ErrUnknownVersion or ErrMalformedMessage.
+func DecodeResult(body string) (ResultMessage, error) {
+	var result ResultMessage
+	if err := decodeEnvelope(body, &result); err != nil {
+		return result, err
+	}
+	return result, result.Validate()
+}
+
+// decodeEnvelope checks the version of a message body before parsing it into
+// v. The fields unknown to v are ignored, they are optional fields added by a
+// newer build within the version.
+func decodeEnvelope(body string, v interface{}) error {
+	var header struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(body), &header); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	if header.Version == nil {
+		return fmt.Errorf("%w: missing version", ErrMalformedMessage)
+	}
+	if *header.Version != MessageVersion {
+		return fmt.Errorf("%w %d", ErrUnknownVersion, *header.Version)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader([]byte(body)))
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("%w: trailing data", ErrMalformedMessage)
+	}
+	return nil
+}
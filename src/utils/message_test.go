@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"wordcounter/src/counter"
+)
+
+func TestEncodeDecodeJob(t *testing.T) {
+	job := JobMessage{
+		JobID:     "0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a",
+		Bucket:    "data",
+		Key:       "my file with spaces.txt",
+		Range:     &ByteRange{Start: 10, End: 20},
+		Options:   counter.Options{SplitHyphens: true, MinLength: 2},
+		ReplyTo:   "results",
+		Submitter: "tester",
+	}
+	deadline := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	job.Deadline = &deadline
+	body, err := EncodeJob(job)
+	if err != nil {
+		t.Fatalf("EncodeJob() error = %v", err)
+	}
+	got, err := DecodeJob(body)
+	if err != nil {
+		t.Fatalf("DecodeJob() error = %v", err)
+	}
+	job.Version = MessageVersion
+	if !reflect.DeepEqual(got, job) {
+		t.Errorf("DecodeJob() = %+v, want %+v", got, job)
+	}
+}
+
+func TestJobMessageExpired(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	before, after := now.Add(-time.Second), now.Add(time.Second)
+	tests := []struct {
+		name     string
+		deadline *time.Time
+		want     bool
+	}{
+		{"NoDeadline", nil, false},
+		{"Passed", &before, true},
+		{"Now", &now, true},
+		{"Ahead", &after, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := JobMessage{Deadline: tt.deadline}
+			if got := job.Expired(now); got != tt.want {
+				t.Errorf("Expired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeJobRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{name: "LegacyBody", body: "fileKeyValue s3bucketName", want: ErrMalformedMessage},
+		{name: "NoVersion", body: `{"jobId":"0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a","bucket":"b","key":"k"}`, want: ErrMalformedMessage},
+		{name: "FutureVersion", body: `{"version":2,"jobId":"0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a","bucket":"b","key":"k"}`, want: ErrUnknownVersion},
+		{name: "NumericJobID", body: `{"version":1,"jobId":"1617112345678","bucket":"b","key":"k"}`, want: ErrMalformedMessage},
+		{name: "MissingKey", body: `{"version":1,"jobId":"0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a","bucket":"b"}`, want: ErrMalformedMessage},
+		{name: "EmptyRange", body: `{"version":1,"jobId":"0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a","bucket":"b","key":"k","range":{"start":5,"end":5}}`, want: ErrMalformedMessage},
+		{name: "WrongType", body: `{"version":1,"jobId":1,"bucket":"b","key":"k"}`, want: ErrMalformedMessage},
+		{name: "TrailingData", body: `{"version":1,"jobId":"0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a","bucket":"b","key":"k"} {}`, want: ErrMalformedMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeJob(tt.body); !errors.Is(err, tt.want) {
+				t.Errorf("DecodeJob() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeNewerFields(t *testing.T) {
+	// Written by a newer build, with fields added within the version
+	job, err := DecodeJob(`{"version":1,"jobId":"0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a","bucket":"b","key":"k","priority":3,"labels":{"team":"a"}}`)
+	want := JobMessage{Version: 1, JobID: "0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a", Bucket: "b", Key: "k"}
+	if err != nil || !reflect.DeepEqual(job, want) {
+		t.Errorf("DecodeJob() = %+v, %v, want %+v", job, err, want)
+	}
+	result, err := DecodeResult(`{"version":1,"jobId":"0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a","key":"k","resultBucket":"r","resultKey":"results/x.json","elapsed":1.5}`)
+	if err != nil || result.ResultKey != "results/x.json" {
+		t.Errorf("DecodeResult() = %+v, %v, want the result", result, err)
+	}
+}
+
+func TestEncodeDecodeResult(t *testing.T) {
+	result := ResultMessage{
+		JobID:        "0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a",
+		Key:          "file.txt",
+		Range:        &ByteRange{Start: 0, End: 100},
+		ResultBucket: "results",
+		ResultKey:    "results/0b7fa8e2-6d3c-4c1e-9a55-3f0e2d1c4b6a/0-100.json",
+		WorkerID:     "worker-1",
+	}
+	body, err := EncodeResult(result)
+	if err != nil {
+		t.Fatalf("EncodeResult() error = %v", err)
+	}
+	got, err := DecodeResult(body)
+	if err != nil {
+		t.Fatalf("DecodeResult() error = %v", err)
+	}
+	result.Version = MessageVersion
+	if !reflect.DeepEqual(got, result) {
+		t.Errorf("DecodeResult() = %+v, want %+v", got, result)
+	}
+
+	if _, err := EncodeResult(ResultMessage{JobID: NewJobID()}); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("EncodeResult() without result object error = %v, want %v", err, ErrMalformedMessage)
+	}
+	if _, err := EncodeResult(ResultMessage{JobID: NewJobID(), Error: "object not found"}); err != nil {
+		t.Errorf("EncodeResult() of a failure error = %v, want nil", err)
+	}
+}
+
+func TestResultKey(t *testing.T) {
+	id := JobID("0b7e3c5c-4f1b-4bde-9b5e-0a4d8f7a6c21")
+	rng := &ByteRange{Start: 10, End: 20}
+	if got, want := ResultKey(id, nil), "results/"+string(id)+".json"; got != want {
+		t.Errorf("ResultKey(nil) = %q, want %q", got, want)
+	}
+	got := ResultKey(id, rng)
+	if want := "results/" + string(id) + "/10-20.json"; got != want {
+		t.Errorf("ResultKey(%s) = %q, want %q", rng, got, want)
+	}
+	if !strings.HasPrefix(got, PartialResultPrefix(id)) {
+		t.Errorf("ResultKey(%s) = %q does not start with %q", rng, got, PartialResultPrefix(id))
+	}
+	if again := ResultKey(id, &ByteRange{Start: 10, End: 20}); again != got {
+		t.Errorf("ResultKey() is not deterministic: %q then %q", got, again)
+	}
+}
@@ -0,0 +1,286 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// RetryPolicy is how the AWS wrappers retry an operation. The delay before a
+// retry starts at InitialInterval and is multiplied by Multiplier after every
+// attempt, up to MaxInterval, and varied by up to Jitter times itself.
+type RetryPolicy struct {
+	// MaxAttempts is the most calls made, 1 disables retries.
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter is the fraction, between 0 and 1, of a delay chosen at random.
+	Jitter float64
+	// MaxElapsed is the longest time spent on an operation before a retry
+	// is given up, 0 for no limit.
+	MaxElapsed time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of the operations without one of
+// their own, unless another default is set with SetRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:     5,
+	InitialInterval: 100 * time.Millisecond,
+	MaxInterval:     5 * time.Second,
+	Multiplier:      2,
+	Jitter:          0.5,
+	MaxElapsed:      30 * time.Second,
+}
+
+// retryPolicyJSON is RetryPolicy with its durations as strings such as "1.5s".
+type retryPolicyJSON struct {
+	MaxAttempts     int
+	InitialInterval string
+	MaxInterval     string
+	Multiplier      float64
+	Jitter          float64
+	MaxElapsed      string
+}
+
+// UnmarshalJSON reads a policy with its durations written as strings such as
+// "100ms". The missing fields keep their values, or take those of
+// DefaultRetryPolicy if p is the zero policy.
+func (p *RetryPolicy) UnmarshalJSON(data []byte) error {
+	if *p == (RetryPolicy{}) {
+		*p = DefaultRetryPolicy
+	}
+	v := retryPolicyJSON{MaxAttempts: p.MaxAttempts, Multiplier: p.Multiplier, Jitter: p.Jitter}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	p.MaxAttempts, p.Multiplier, p.Jitter = v.MaxAttempts, v.Multiplier, v.Jitter
+	for _, d := range []struct {
+		s   string
+		dst *time.Duration
+	}{{v.InitialInterval, &p.InitialInterval}, {v.MaxInterval, &p.MaxInterval}, {v.MaxElapsed, &p.MaxElapsed}} {
+		if d.s == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.s)
+		if err != nil {
+			return fmt.Errorf("invalid retry policy: %v", err)
+		}
+		*d.dst = parsed
+	}
+	return nil
+}
+
+// Validate checks the fields of a policy.
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.MaxAttempts < 1:
+		return fmt.Errorf("invalid retry policy: MaxAttempts must be at least 1")
+	case p.InitialInterval < 0 || p.MaxInterval < p.InitialInterval:
+		return fmt.Errorf("invalid retry policy: intervals must not be negative or decreasing")
+	case p.Multiplier < 1:
+		return fmt.Errorf("invalid retry policy: Multiplier must be at least 1")
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("invalid retry policy: Jitter must be between 0 and 1")
+	case p.MaxElapsed < 0:
+		return fmt.Errorf("invalid retry policy: MaxElapsed must not be negative")
+	}
+	return nil
+}
+
+// delay returns the delay before the retry following attempt, counted from 1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.InitialInterval)
+	for i := 1; i < attempt && d < float64(p.MaxInterval); i++ {
+		d *= p.Multiplier
+	}
+	if d > float64(p.MaxInterval) {
+		d = float64(p.MaxInterval)
+	}
+	d += d * p.Jitter * (2*randFloat() - 1)
+	return time.Duration(d)
+}
+
+var (
+	retryMu       sync.RWMutex
+	retryPolicies = make(map[string]RetryPolicy)
+
+	randMu  sync.Mutex
+	randSrc = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func randFloat() float64 {
+	randMu.Lock()
+	defer randMu.Unlock()
+	return randSrc.Float64()
+}
+
+// SetRetryPolicy sets the retry policy of op, such as "SendMessage", or the
+// default policy if op is "*".
+func SetRetryPolicy(op string, policy RetryPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return fmt.Errorf("%s: %v", op, err)
+	}
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	retryPolicies[op] = policy
+	return nil
+}
+
+// RetryPolicyFor returns the retry policy of op.
+func RetryPolicyFor(op string) RetryPolicy {
+	retryMu.RLock()
+	defer retryMu.RUnlock()
+	if policy, ok := retryPolicies[op]; ok {
+		return policy
+	}
+	if policy, ok := retryPolicies["*"]; ok {
+		return policy
+	}
+	return DefaultRetryPolicy
+}
+
+// Error codes of the AWS services that a retry may fix, besides the
+// throttling codes and the server faults.
+var retryableCodes = map[string]bool{
+	"InternalError":               true,
+	"InternalFailure":             true,
+	"InternalServerError":         true,
+	"ServiceUnavailable":          true,
+	"ServiceUnavailableException": true,
+	"Unavailable":                 true,
+	"RequestTimeout":              true,
+	"RequestTimeoutException":     true,
+	"KMS.ThrottlingException":     true,
+}
+
+// Retryable reports whether the error of an AWS call may go away with a retry:
+// throttling, server faults and timeouts are retryable, missing resources,
+// denied access and the other client errors are not.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch errorKind(err) {
+	case ErrThrottled:
+		return true
+	case nil:
+	default:
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return retryableCodes[apiErr.ErrorCode()] || apiErr.ErrorFault() == smithy.FaultServer
+	}
+	// Services without error codes, such as the instance metadata service
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() >= 500 {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// RetryCount holds the counters of the calls of an operation.
+type RetryCount struct {
+	// Calls is the number of calls of the wrapper, Attempts the number of
+	// calls to the service, Retries the difference.
+	Calls    int64
+	Attempts int64
+	Retries  int64
+	// Exhausted is the number of calls given up on a retryable error.
+	Exhausted int64
+}
+
+var (
+	retryStatsMu sync.Mutex
+	retryStats   = make(map[string]*RetryCount)
+)
+
+// RetryMetrics returns the counters of the operations called so far, by name.
+func RetryMetrics() map[string]RetryCount {
+	retryStatsMu.Lock()
+	defer retryStatsMu.Unlock()
+	metrics := make(map[string]RetryCount, len(retryStats))
+	for op, count := range retryStats {
+		metrics[op] = *count
+	}
+	return metrics
+}
+
+// ResetRetryMetrics clears the counters of RetryMetrics.
+func ResetRetryMetrics() {
+	retryStatsMu.Lock()
+	defer retryStatsMu.Unlock()
+	retryStats = make(map[string]*RetryCount)
+}
+
+// LogRetryMetrics logs the counters of the operations that were retried.
+func LogRetryMetrics(l Logger) {
+	metrics := RetryMetrics()
+	ops := make([]string, 0, len(metrics))
+	for op, count := range metrics {
+		if count.Retries > 0 {
+			ops = append(ops, op)
+		}
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		count := metrics[op]
+		l.Info("retry metrics", "operation", op, "calls", count.Calls, "attempts", count.Attempts,
+			"retries", count.Retries, "exhausted", count.Exhausted)
+	}
+}
+
+func countCall(op string, attempts int, exhausted bool) {
+	retryStatsMu.Lock()
+	defer retryStatsMu.Unlock()
+	count, ok := retryStats[op]
+	if !ok {
+		count = new(RetryCount)
+		retryStats[op] = count
+	}
+	count.Calls++
+	count.Attempts += int64(attempts)
+	count.Retries += int64(attempts - 1)
+	if exhausted {
+		count.Exhausted++
+	}
+}
+
+// Retry calls attempt until it succeeds, fails with an error that is not
+// Retryable, or the retry policy of op gives up, and returns its last error.
+// It waits between the attempts as the policy says, and stops when ctx is done.
+func Retry(ctx context.Context, op string, attempt func(ctx context.Context) error) error {
+	policy := RetryPolicyFor(op)
+	start := time.Now()
+	for n := 1; ; n++ {
+		err := attempt(ctx)
+		if err == nil || !Retryable(err) || ctx.Err() != nil {
+			countCall(op, n, false)
+			return err
+		}
+		wait := policy.delay(n)
+		if n >= policy.MaxAttempts || policy.MaxElapsed > 0 && time.Since(start)+wait > policy.MaxElapsed {
+			countCall(op, n, true)
+			Log().Warn("gave up retrying", "operation", op, "attempts", n, LogKeyError, err)
+			return err
+		}
+		Log().Debug("retrying", "operation", op, "attempt", n, "delay", wait.String(), LogKeyError, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			countCall(op, n, false)
+			return err
+		case <-timer.C:
+		}
+	}
+}
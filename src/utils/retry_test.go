@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"wordcounter/src/fakeaws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "Throttled", err: fakeaws.ThrottlingError(fakeaws.SQSThrottlingCode), want: true},
+		{name: "ServerFault", err: &smithy.GenericAPIError{Code: "Whatever", Fault: smithy.FaultServer}, want: true},
+		{name: "ServiceUnavailable", err: &smithy.GenericAPIError{Code: "ServiceUnavailable"}, want: true},
+		{name: "Timeout", err: &fakeaws.TimeoutError{}, want: true},
+		{name: "AccessDenied", err: &smithy.GenericAPIError{Code: "AccessDenied", Fault: smithy.FaultClient}, want: false},
+		{name: "QueueNotFound", err: &sqstypes.QueueDoesNotExist{}, want: false},
+		{name: "DryRun", err: &smithy.GenericAPIError{Code: "DryRunOperation"}, want: false},
+		{name: "Canceled", err: context.Canceled, want: false},
+		{name: "Other", err: errors.New("boom"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := &smithy.OperationError{ServiceID: "SQS", OperationName: "Op", Err: tt.err}
+			if got := Retryable(err); got != tt.want {
+				t.Errorf("Retryable(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	throttled := fakeaws.ThrottlingError(fakeaws.SQSThrottlingCode)
+	denied := &smithy.GenericAPIError{Code: "AccessDenied"}
+	tests := []struct {
+		name         string
+		errs         []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{name: "Success", errs: nil, wantAttempts: 1},
+		{name: "Recovered", errs: []error{throttled, throttled}, wantAttempts: 3},
+		{name: "Exhausted", errs: []error{throttled, throttled, throttled, throttled}, wantErr: throttled, wantAttempts: 3},
+		{name: "Fatal", errs: []error{denied, throttled}, wantErr: denied, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ResetRetryMetrics()
+			attempts := 0
+			err := Retry(context.TODO(), "Op", func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr || attempts != tt.wantAttempts {
+				t.Errorf("Retry() = %v after %d attempts, want %v after %d", err, attempts, tt.wantErr, tt.wantAttempts)
+			}
+			got := RetryMetrics()["Op"]
+			want := RetryCount{Calls: 1, Attempts: int64(attempts), Retries: int64(attempts - 1)}
+			if tt.name == "Exhausted" {
+				want.Exhausted = 1
+			}
+			if got != want {
+				t.Errorf("RetryMetrics() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRetryStops(t *testing.T) {
+	throttled := fakeaws.ThrottlingError(fakeaws.SQSThrottlingCode)
+	slow := RetryPolicy{MaxAttempts: 100, InitialInterval: time.Hour, MaxInterval: time.Hour, Multiplier: 1}
+	if err := SetRetryPolicy("Slow", slow); err != nil {
+		t.Fatal(err)
+	}
+
+	// The context is done while waiting to retry
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := Retry(ctx, "Slow", func(ctx context.Context) error { return throttled }); err != throttled {
+		t.Errorf("Retry() = %v, want %v", err, throttled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Retry() returned after %v, after its context was done", elapsed)
+	}
+
+	// The next delay would exceed the maximum elapsed time
+	slow.MaxElapsed = time.Minute
+	if err := SetRetryPolicy("Slow", slow); err != nil {
+		t.Fatal(err)
+	}
+	attempts := 0
+	if err := Retry(context.TODO(), "Slow", func(ctx context.Context) error { attempts++; return throttled }); err != throttled || attempts != 1 {
+		t.Errorf("Retry() = %v after %d attempts, want %v after 1", err, attempts, throttled)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, InitialInterval: 100 * time.Millisecond, MaxInterval: time.Second, Multiplier: 2, Jitter: 0.5}
+	for attempt, base := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		base *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := p.delay(attempt + 1); d < base/2 || d > base*3/2 {
+				t.Fatalf("delay(%d) = %v, want %v ± 50%%", attempt+1, d, base)
+			}
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`{"MaxAttempts": 3, "InitialInterval": "50ms", "MaxElapsed": "1m"}`), &p); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	want := RetryPolicy{MaxAttempts: 3, InitialInterval: 50 * time.Millisecond, MaxInterval: time.Second, Multiplier: 2, Jitter: 0.5, MaxElapsed: time.Minute}
+	if p != want {
+		t.Errorf("json.Unmarshal() = %+v, want %+v", p, want)
+	}
+	var cfg Config
+	if err := json.Unmarshal([]byte(`{"RetryPolicies": {"SendMessage": {"MaxAttempts": 8}}}`), &cfg); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	want = DefaultRetryPolicy
+	want.MaxAttempts = 8
+	if got := cfg.RetryPolicies["SendMessage"]; got != want {
+		t.Errorf("json.Unmarshal() = %+v, want %+v", got, want)
+	}
+	if err := SetRetryPolicy("Op", RetryPolicy{MaxAttempts: 0}); err == nil {
+		t.Errorf("SetRetryPolicy() accepted an invalid policy")
+	}
+}
+
+// drainingS3 reads the body of the first object put and fails, as a request
+// throttled after it was sent.
+type drainingS3 struct {
+	*fakeaws.S3
+	failed bool
+}
+
+func (c *drainingS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if !c.failed {
+		c.failed = true
+		ioutil.ReadAll(params.Body)
+		return nil, fakeaws.ThrottlingError(fakeaws.S3ThrottlingCode)
+	}
+	return c.S3.PutObject(ctx, params, optFns...)
+}
+
+func TestPutFileRetry(t *testing.T) {
+	client := &drainingS3{S3: fakeaws.NewS3("results")}
+	_, err := PutFile(context.TODO(), client, &s3.PutObjectInput{
+		Bucket: aws.String("results"),
+		Key:    aws.String("k"),
+		Body:   strings.NewReader(`{"alice":1}`),
+	})
+	if err != nil {
+		t.Fatalf("PutFile() error = %v", err)
+	}
+	if got, _ := client.Object("results", "k"); string(got) != `{"alice":1}` {
+		t.Errorf("PutFile() stored %q after a retry", got)
+	}
+}
@@ -0,0 +1,303 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Routing modes of Config.Routing, which decide how a job reaches the worker
+// it is addressed to by SubmitJob
+const (
+	// RoutingAny lets any worker take any job, it is the default.
+	RoutingAny = "any"
+	// RoutingQueue sends the jobs addressed to a worker to a queue of its own,
+	// which the worker polls before the job queue.
+	RoutingQueue = "queue"
+	// RoutingClaim sends all the jobs to the job queue, the workers put back
+	// the jobs addressed to another worker until their routing timeout.
+	RoutingClaim = "claim"
+)
+
+// DefaultRoutingTimeout is how long a job addressed to a worker waits for it
+// in the claim mode when Config.RoutingTimeout is zero.
+const DefaultRoutingTimeout = 60 * time.Second
+
+// RoutingMode returns the routing mode of cfg, RoutingAny if it has none, or an
+// error if it is not a known mode.
+func RoutingMode(cfg Config) (string, error) {
+	switch cfg.Routing {
+	case "", RoutingAny:
+		return RoutingAny, nil
+	case RoutingQueue, RoutingClaim:
+		return cfg.Routing, nil
+	}
+	return "", errors.New("unknown routing mode '" + cfg.Routing + "', want any, queue or claim")
+}
+
+// RoutingTimeout returns how long a job addressed to a worker waits for it in
+// the claim mode of cfg.
+func RoutingTimeout(cfg Config) time.Duration {
+	if cfg.RoutingTimeout <= 0 {
+		return DefaultRoutingTimeout
+	}
+	return time.Duration(cfg.RoutingTimeout) * time.Second
+}
+
+// WorkerQueueName returns the name of the queue of the jobs of the queue named
+// queueName addressed to the worker workerID. It is a FIFO queue if the job
+// queue is one.
+func WorkerQueueName(queueName string, workerID string) string {
+	base := strings.TrimSuffix(queueName, FIFOSuffix)
+	// Queue names only allow alphanumeric characters, hyphens and underscores
+	id := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, workerID)
+	name := base + "-" + id
+	if IsFIFOQueue(queueName) {
+		name += FIFOSuffix
+	}
+	return name
+}
+
+// CreateWorkerQueue creates the queue of the jobs of the queue named queueName
+// addressed to the worker workerID, if it does not exist, and returns its name
+// and URL.
+func CreateWorkerQueue(ctx context.Context, client SQSAPI, queueName string, workerID string) (string, string, error) {
+	name := WorkerQueueName(queueName, workerID)
+	input := &sqs.CreateQueueInput{QueueName: &name}
+	if IsFIFOQueue(name) {
+		input.Attributes = map[string]string{string(types.QueueAttributeNameFifoQueue): "true"}
+	}
+	out, err := MakeQueue(ctx, client, input)
+	if err != nil {
+		return name, "", WrapError("CreateQueue", name, err)
+	}
+	return name, aws.ToString(out.QueueUrl), nil
+}
+
+// JobQueueFor returns the name of the queue to send the jobs addressed to
+// instance to with the routing mode of cfg: the queue of the worker if the jobs
+// are routed by queue and the worker has one and holds its lease, stored in
+// the result bucket, or else the job queue, where any worker can take them.
+func JobQueueFor(ctx context.Context, client SQSAPI, s3Client S3GetObjectAPI, cfg Config, instance InstanceInfo) (string, error) {
+	if cfg.Routing != RoutingQueue || instance.Id == "" {
+		return cfg.JobQueueName, nil
+	}
+	name := WorkerQueueName(cfg.JobQueueName, instance.Id)
+	_, err := GetQueueURLSimple(ctx, client, name)
+	if errors.Is(err, ErrQueueNotFound) {
+		Log().Info("worker has no queue, the job goes to any worker", LogKeyWorkerID, instance.Id, LogKeyQueue, name)
+		return cfg.JobQueueName, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	lease, err := LoadWorkerLease(ctx, s3Client, cfg.ResultBucketName, name)
+	if err != nil {
+		return "", err
+	}
+	if !lease.Alive(time.Now()) {
+		Log().Info("worker does not poll its queue, the job goes to any worker", LogKeyWorkerID, instance.Id, LogKeyQueue, name)
+		return cfg.JobQueueName, nil
+	}
+	return name, nil
+}
+
+// MoveJobs moves the job messages waiting in the queue fromURL to the queue
+// toURL, hiding them for hold while they are moved, and returns the number of
+// jobs moved. A job whose message fails to be deleted once moved is done twice.
+func MoveJobs(ctx context.Context, client SQSAPI, fromURL string, toURL string, hold time.Duration) (int, error) {
+	moved := 0
+	for {
+		resp, err := GetMessages(ctx, client, &sqs.ReceiveMessageInput{
+			QueueUrl:              &fromURL,
+			MaxNumberOfMessages:   10,
+			MessageAttributeNames: []string{"All"},
+			VisibilityTimeout:     int32(hold / time.Second),
+			// Long polling samples all the servers of the queue
+			WaitTimeSeconds: 1,
+		})
+		if err != nil {
+			return moved, WrapError("ReceiveMessage", fromURL, err)
+		}
+		if len(resp.Messages) == 0 {
+			return moved, nil
+		}
+		for _, msg := range resp.Messages {
+			input := &sqs.SendMessageInput{
+				MessageAttributes: msg.MessageAttributes,
+				MessageBody:       msg.Body,
+				QueueUrl:          &toURL,
+			}
+			groupID := aws.ToString(msg.MessageId)
+			if job, err := DecodeJob(aws.ToString(msg.Body)); err == nil {
+				groupID = MessageGroupID(job)
+			}
+			SetFIFOParams(input, aws.ToString(msg.MessageId), groupID)
+			if _, err := SendMsg(ctx, client, input); err != nil {
+				return moved, WrapError("SendMessage", toURL, err)
+			}
+			if err := RemoveMessageSimple(ctx, client, fromURL, aws.ToString(msg.ReceiptHandle)); err != nil {
+				Log().Warn("failed to delete moved message", LogKeyQueue, fromURL, LogKeyError, err)
+			}
+			moved++
+		}
+	}
+}
+
+// WorkerQueueSweepAPI defines the interface of the Amazon SQS operations of SweepWorkerQueues.
+type WorkerQueueSweepAPI interface {
+	SQSAPI
+	SQSGetQueueAttributesAPI
+}
+
+// sweepHold is how long SweepWorkerQueues hides the messages it moves.
+const sweepHold = 30 * time.Second
+
+// SweepWorkerQueues moves the jobs waiting in the queues of the workers whose
+// lease, stored in the result bucket of cfg, expired at now to the job queue
+// of cfg, where any worker takes them. It forgets the leases of the queues
+// left empty, jobs in progress included, and returns the number of jobs moved.
+// It goes on with the other queues after an error, and returns the last one.
+func SweepWorkerQueues(ctx context.Context, client WorkerQueueSweepAPI, s3Client S3API, cfg Config, now time.Time) (int, error) {
+	queues, err := ListWorkerLeases(ctx, s3Client, cfg.ResultBucketName)
+	if err != nil {
+		return 0, err
+	}
+	jobQueueURL, err := GetQueueURLSimple(ctx, client, cfg.JobQueueName)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	var lastErr error
+	for _, name := range queues {
+		lease, err := LoadWorkerLease(ctx, s3Client, cfg.ResultBucketName, name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if lease == nil || lease.Alive(now) {
+			continue
+		}
+		n, empty, err := sweepWorkerQueue(ctx, client, name, jobQueueURL)
+		moved += n
+		if n > 0 {
+			Log().Info("moved the jobs of a dead worker", LogKeyWorkerID, lease.WorkerID, LogKeyQueue, name, "jobs", n)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if empty {
+			if err := DeleteObjectSimple(ctx, s3Client, WorkerLeaseKey(name), cfg.ResultBucketName); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return moved, lastErr
+}
+
+// sweepWorkerQueue moves the jobs waiting in the queue named name to the queue
+// jobQueueURL, and reports whether the queue is left empty.
+func sweepWorkerQueue(ctx context.Context, client WorkerQueueSweepAPI, name string, jobQueueURL string) (int, bool, error) {
+	url, err := GetQueueURLSimple(ctx, client, name)
+	if errors.Is(err, ErrQueueNotFound) {
+		return 0, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	moved, err := MoveJobs(ctx, client, url, jobQueueURL, sweepHold)
+	if err != nil {
+		return moved, false, err
+	}
+	load, err := queueLoad(ctx, client, url)
+	if err != nil {
+		return moved, false, err
+	}
+	return moved, load.Waiting+load.InFlight == 0, nil
+}
+
+// JobTarget returns the ID of the worker the job of msg is addressed to, or an
+// empty string if any worker can take it.
+func JobTarget(msg types.Message) string {
+	return attributeString(msg.MessageAttributes, "WorkerId")
+}
+
+// Message attributes of the copies of the job messages put back in the claim mode
+const (
+	// AttrAttempts is the number of times the earlier copies of a job message
+	// were received by workers that tried the job, rather than put it back.
+	AttrAttempts = "Attempts"
+	// AttrSentAt is when the first copy of a job message was sent, in
+	// milliseconds since the epoch.
+	AttrSentAt = "SentAt"
+)
+
+// SentTime returns when the job of msg was first sent, or the zero time if msg
+// was not received with its SentTimestamp attribute.
+func SentTime(msg types.Message) time.Time {
+	sent := attributeString(msg.MessageAttributes, AttrSentAt)
+	if sent == "" {
+		sent = msg.Attributes["SentTimestamp"]
+	}
+	ms, err := strconv.ParseInt(sent, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// Attempts returns the number of times the job of msg was received by workers
+// that tried it: the receive count of msg, plus the attempts of the copies it
+// was put back from.
+func Attempts(msg types.Message) int {
+	n, _ := strconv.Atoi(attributeString(msg.MessageAttributes, AttrAttempts))
+	return n + ReceiveCount(msg)
+}
+
+// PutBackInput returns the input sending back to the queue at queueURL, after
+// delay, a copy of the job message msg received by a worker the job is not
+// addressed to, in the message group groupID if it is a FIFO queue. The copy
+// keeps the attempts of msg, but for its receive by this worker, and the time
+// the job was first sent, so that the put-backs count neither as attempts nor
+// towards the routing timeout.
+func PutBackInput(msg types.Message, queueURL string, groupID string, delay time.Duration) *sqs.SendMessageInput {
+	attrs := make(map[string]types.MessageAttributeValue, len(msg.MessageAttributes)+2)
+	for name, value := range msg.MessageAttributes {
+		attrs[name] = value
+	}
+	attempts := Attempts(msg) - 1
+	if attempts < 0 {
+		attempts = 0
+	}
+	attrs[AttrAttempts] = types.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(attempts)),
+	}
+	if sent := SentTime(msg); !sent.IsZero() {
+		attrs[AttrSentAt] = types.MessageAttributeValue{
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.FormatInt(sent.UnixNano()/int64(time.Millisecond), 10)),
+		}
+	}
+	input := &sqs.SendMessageInput{
+		DelaySeconds:      int32(delay / time.Second),
+		MessageAttributes: attrs,
+		MessageBody:       msg.Body,
+		QueueUrl:          &queueURL,
+	}
+	// Each copy is sent once, and has an ID of its own
+	SetFIFOParams(input, aws.ToString(msg.MessageId), groupID)
+	return input
+}
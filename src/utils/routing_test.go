@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"wordcounter/src/fakeaws"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+func TestWorkerQueueName(t *testing.T) {
+	tests := []struct {
+		queue    string
+		workerID string
+		want     string
+	}{
+		{"jobs", "i-0abc", "jobs-i-0abc"},
+		{"jobs", "ip-10-0-0-1.ec2.internal", "jobs-ip-10-0-0-1-ec2-internal"},
+		{"jobs.fifo", "i-0abc", "jobs-i-0abc.fifo"},
+	}
+	for _, tt := range tests {
+		if got := WorkerQueueName(tt.queue, tt.workerID); got != tt.want {
+			t.Errorf("WorkerQueueName(%q, %q) = %q, want %q", tt.queue, tt.workerID, got, tt.want)
+		}
+	}
+}
+
+func TestJobQueueFor(t *testing.T) {
+	client := fakeaws.NewSQS("jobs", "jobs-i-0001", "jobs-i-0003", "jobs-i-0004")
+	s3Client := fakeaws.NewS3("results")
+	now := time.Now()
+	for _, lease := range []WorkerLease{
+		{WorkerID: "i-0001", Queue: "jobs-i-0001", Expires: now.Add(LeaseTTL)},
+		{WorkerID: "i-0003", Queue: "jobs-i-0003", Expires: now.Add(-time.Second)},
+	} {
+		if err := SaveWorkerLease(context.TODO(), s3Client, "results", lease); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		routing  string
+		instance InstanceInfo
+		want     string
+	}{
+		{"Any", RoutingAny, InstanceInfo{Id: "i-0001"}, "jobs"},
+		{"Claim", RoutingClaim, InstanceInfo{Id: "i-0001"}, "jobs"},
+		{"Queue", RoutingQueue, InstanceInfo{Id: "i-0001"}, "jobs-i-0001"},
+		{"NoQueue", RoutingQueue, InstanceInfo{Id: "i-0002"}, "jobs"},
+		{"ExpiredLease", RoutingQueue, InstanceInfo{Id: "i-0003"}, "jobs"},
+		{"NoLease", RoutingQueue, InstanceInfo{Id: "i-0004"}, "jobs"},
+		{"NoWorker", RoutingQueue, InstanceInfo{}, "jobs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{JobQueueName: "jobs", ResultBucketName: "results", Routing: tt.routing}
+			got, err := JobQueueFor(context.TODO(), client, s3Client, cfg, tt.instance)
+			if err != nil || got != tt.want {
+				t.Errorf("JobQueueFor() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweepWorkerQueues(t *testing.T) {
+	ctx := context.TODO()
+	client := fakeaws.NewSQS("jobs", "jobs-i-0001", "jobs-i-0002", "jobs-i-0003")
+	s3Client := fakeaws.NewS3("results")
+	cfg := Config{JobQueueName: "jobs", ResultBucketName: "results", Routing: RoutingQueue}
+	now := time.Now()
+	leases := []WorkerLease{
+		{WorkerID: "i-0001", Queue: "jobs-i-0001", Expires: now.Add(LeaseTTL)},
+		{WorkerID: "i-0002", Queue: "jobs-i-0002", Expires: now.Add(-time.Second)},
+		{WorkerID: "i-0003", Queue: "jobs-i-0003", Expires: now.Add(-time.Second)},
+		// The queue of the worker was deleted
+		{WorkerID: "i-0004", Queue: "jobs-i-0004", Expires: now.Add(-time.Second)},
+	}
+	for _, lease := range leases {
+		if err := SaveWorkerLease(ctx, s3Client, "results", lease); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"jobs-i-0001", "jobs-i-0002", "jobs-i-0002", "jobs-i-0003"} {
+		body, _ := EncodeJob(JobMessage{JobID: NewJobID(), Bucket: "data", Key: name})
+		if _, err := client.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: aws.String(fakeaws.QueueURL(name)), MessageBody: &body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The dead worker i-0003 was doing a job, it comes back once its message is visible again
+	if _, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{QueueUrl: aws.String(fakeaws.QueueURL("jobs-i-0003"))}); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := SweepWorkerQueues(ctx, client, s3Client, cfg, now)
+	if err != nil || moved != 2 {
+		t.Fatalf("SweepWorkerQueues() = %d, %v, want 2 jobs moved", moved, err)
+	}
+	if n := len(client.Messages("jobs")); n != 2 {
+		t.Errorf("%d jobs in the job queue, want 2", n)
+	}
+	if n := len(client.Messages("jobs-i-0001")); n != 1 {
+		t.Errorf("%d jobs in the queue of the live worker, want 1", n)
+	}
+	// Only the leases of the queues left empty are forgotten
+	for _, tt := range []struct {
+		queue string
+		kept  bool
+	}{{"jobs-i-0001", true}, {"jobs-i-0002", false}, {"jobs-i-0003", true}, {"jobs-i-0004", false}} {
+		if _, ok := s3Client.Object("results", WorkerLeaseKey(tt.queue)); ok != tt.kept {
+			t.Errorf("lease of %s kept = %v, want %v", tt.queue, ok, tt.kept)
+		}
+	}
+}
+
+func TestRoutingMode(t *testing.T) {
+	for _, routing := range []string{"", RoutingAny, RoutingQueue, RoutingClaim} {
+		if _, err := RoutingMode(Config{Routing: routing}); err != nil {
+			t.Errorf("RoutingMode(%q) error = %v", routing, err)
+		}
+	}
+	if _, err := RoutingMode(Config{Routing: "random"}); err == nil {
+		t.Error("RoutingMode() of an unknown mode succeeded")
+	}
+}
@@ -2,11 +2,22 @@ package utils
 
 import (
 	"context"
+	"io"
 
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
+// S3API defines the interface for the object functions used by the client and the workers.
+// It is implemented by the Amazon S3 client and by the local directory backend.
+type S3API interface {
+	S3GetObjectAPI
+	S3HeadObjectAPI
+	S3PutObjectAPI
+	S3DeleteObjectAPI
+	S3ListObjectsAPI
+}
+
 // S3CopyObjectAPI defines the interface for the Amazon Simple Storage Service (Amazon S3) CopyObject function.
 // We use this interface to enable unit testing.
 type S3CopyObjectAPI interface {
@@ -24,7 +35,12 @@ type S3CopyObjectAPI interface {
 //     If success, a CopyObjectOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to CopyObject.
 func CopyItem(c context.Context, api S3CopyObjectAPI, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
-	return api.CopyObject(c, input)
+	var out *s3.CopyObjectOutput
+	err := Retry(c, "CopyObject", func(ctx context.Context) (err error) {
+		out, err = api.CopyObject(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // S3DeleteObjectAPI defines the interface for the DeleteObject function.
@@ -44,7 +60,12 @@ type S3DeleteObjectAPI interface {
 //     If success, a DeleteObjectOutput object containing the result of the service call and nil
 //     Otherwise, an error from the call to DeleteObject
 func DeleteItem(c context.Context, api S3DeleteObjectAPI, input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
-	return api.DeleteObject(c, input)
+	var out *s3.DeleteObjectOutput
+	err := Retry(c, "DeleteObject", func(ctx context.Context) (err error) {
+		out, err = api.DeleteObject(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // S3GetObjectAclAPI defines the interface for the GetObjectAcl function.
@@ -64,7 +85,12 @@ type S3GetObjectAclAPI interface {
 //     If success, a GetObjectAclOutput object containing the result of the service call and nil
 //     Otherwise, nil and an error from the call to GetObjectAcl
 func FindObjectAcl(c context.Context, api S3GetObjectAclAPI, input *s3.GetObjectAclInput) (*s3.GetObjectAclOutput, error) {
-	return api.GetObjectAcl(c, input)
+	var out *s3.GetObjectAclOutput
+	err := Retry(c, "GetObjectAcl", func(ctx context.Context) (err error) {
+		out, err = api.GetObjectAcl(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // S3ListObjectsAPI defines the interface for the ListObjectsV2 function.
@@ -88,11 +114,46 @@ type S3GetObjectAPI interface {
 //     If success, a ListObjectsV2Output object containing the result of the service call and nil
 //     Otherwise, nil and an error from the call to ListObjectsV2
 func GetObjects(c context.Context, api S3ListObjectsAPI, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
-	return api.ListObjectsV2(c, input)
+	var out *s3.ListObjectsV2Output
+	err := Retry(c, "ListObjectsV2", func(ctx context.Context) (err error) {
+		out, err = api.ListObjectsV2(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 func GetObject(c context.Context, api S3GetObjectAPI, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-	return api.GetObject(c, input)
+	var out *s3.GetObjectOutput
+	err := Retry(c, "GetObject", func(ctx context.Context) (err error) {
+		out, err = api.GetObject(ctx, input)
+		return err
+	})
+	return out, err
+}
+
+// S3HeadObjectAPI defines the interface for the HeadObject function.
+// We use this interface to test the function using a mocked service.
+type S3HeadObjectAPI interface {
+	HeadObject(ctx context.Context,
+		params *s3.HeadObjectInput,
+		optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+// GetObjectInfo retrieves the metadata, such as the size, of an Amazon Simple Storage Service (Amazon S3) object
+// Inputs:
+//     c is the context of the method call, which includes the AWS Region
+//     api is the interface that defines the method call
+//     input defines the input arguments to the service call.
+// Output:
+//     If success, a HeadObjectOutput object containing the result of the service call and nil
+//     Otherwise, nil and an error from the call to HeadObject
+func GetObjectInfo(c context.Context, api S3HeadObjectAPI, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	var out *s3.HeadObjectOutput
+	err := Retry(c, "HeadObject", func(ctx context.Context) (err error) {
+		out, err = api.HeadObject(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // S3PutObjectAPI defines the interface for the PutObject function.
@@ -112,7 +173,29 @@ type S3PutObjectAPI interface {
 //     If success, a PutObjectOutput object containing the result of the service call and nil
 //     Otherwise, nil and an error from the call to PutObject
 func PutFile(c context.Context, api S3PutObjectAPI, input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
-	return api.PutObject(c, input)
+	// The body is read again by every attempt, one that cannot be rewound is sent once
+	body, ok := input.Body.(io.Seeker)
+	if input.Body != nil && !ok {
+		return api.PutObject(c, input)
+	}
+	var start int64
+	if body != nil {
+		var err error
+		if start, err = body.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+	var out *s3.PutObjectOutput
+	err := Retry(c, "PutObject", func(ctx context.Context) (err error) {
+		if body != nil {
+			if _, err = body.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		out, err = api.PutObject(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // S3CreateBucketAPI defines the interface for the CreateBucket function.
@@ -132,7 +215,12 @@ type S3CreateBucketAPI interface {
 //     If success, a CreateBucketOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to CreateBucket.
 func MakeBucket(c context.Context, api S3CreateBucketAPI, input *s3.CreateBucketInput) (*s3.CreateBucketOutput, error) {
-	return api.CreateBucket(c, input)
+	var out *s3.CreateBucketOutput
+	err := Retry(c, "CreateBucket", func(ctx context.Context) (err error) {
+		out, err = api.CreateBucket(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // S3DeleteBucketAPI defines the interface for the DeleteBucket function.
@@ -152,7 +240,12 @@ type S3DeleteBucketAPI interface {
 //     If success, a DeleteBucketOutput object containing the result of the service call and nil
 //     Otherwise, an error from the call to CreateBucket
 func RemoveBucket(c context.Context, api S3DeleteBucketAPI, input *s3.DeleteBucketInput) (*s3.DeleteBucketOutput, error) {
-	return api.DeleteBucket(c, input)
+	var out *s3.DeleteBucketOutput
+	err := Retry(c, "DeleteBucket", func(ctx context.Context) (err error) {
+		out, err = api.DeleteBucket(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // S3PresignGetObjectAPI defines the interface for the PresignGetObject function.
@@ -193,7 +286,12 @@ type S3GetBucketAclAPI interface {
 //     If success, a GetBucketAclOutput object containing the result of the service call and nil
 //     Otherwise, nil and an error from the call to GetBucketAcl
 func FindBucketAcl(c context.Context, api S3GetBucketAclAPI, input *s3.GetBucketAclInput) (*s3.GetBucketAclOutput, error) {
-	return api.GetBucketAcl(c, input)
+	var out *s3.GetBucketAclOutput
+	err := Retry(c, "GetBucketAcl", func(ctx context.Context) (err error) {
+		out, err = api.GetBucketAcl(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // S3ListBucketsAPI defines the interface for the ListBuckets function.
@@ -213,5 +311,10 @@ type S3ListBucketsAPI interface {
 //     If success, a ListBucketsOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to ListBuckets.
 func GetAllBuckets(c context.Context, api S3ListBucketsAPI, input *s3.ListBucketsInput) (*s3.ListBucketsOutput, error) {
-	return api.ListBuckets(c, input)
+	var out *s3.ListBucketsOutput
+	err := Retry(c, "ListBuckets", func(ctx context.Context) (err error) {
+		out, err = api.ListBuckets(ctx, input)
+		return err
+	})
+	return out, err
 }
@@ -23,6 +23,14 @@ type SQSAPI interface {
 	SendMessage(ctx context.Context,
 		params *sqs.SendMessageInput,
 		optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+
+	ChangeMessageVisibility(ctx context.Context,
+		params *sqs.ChangeMessageVisibilityInput,
+		optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+
+	CreateQueue(ctx context.Context,
+		params *sqs.CreateQueueInput,
+		optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error)
 }
 
 // GetQueueURL gets the URL of an Amazon SQS queue.
@@ -34,7 +42,12 @@ type SQSAPI interface {
 //     If success, a GetQueueUrlOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to GetQueueUrl.
 func GetQueueURL(c context.Context, api SQSAPI, input *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
-	return api.GetQueueUrl(c, input)
+	var out *sqs.GetQueueUrlOutput
+	err := Retry(c, "GetQueueUrl", func(ctx context.Context) (err error) {
+		out, err = api.GetQueueUrl(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // RemoveMessage deletes a message from an Amazon SQS queue.
@@ -46,7 +59,12 @@ func GetQueueURL(c context.Context, api SQSAPI, input *sqs.GetQueueUrlInput) (*s
 //     If success, a DeleteMessageOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to DeleteMessage.
 func RemoveMessage(c context.Context, api SQSAPI, input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
-	return api.DeleteMessage(c, input)
+	var out *sqs.DeleteMessageOutput
+	err := Retry(c, "DeleteMessage", func(ctx context.Context) (err error) {
+		out, err = api.DeleteMessage(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // GetMessages gets the most recent message from an Amazon SQS queue.
@@ -58,7 +76,12 @@ func RemoveMessage(c context.Context, api SQSAPI, input *sqs.DeleteMessageInput)
 //     If success, a ReceiveMessageOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to ReceiveMessage.
 func GetMessages(c context.Context, api SQSAPI, input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
-	return api.ReceiveMessage(c, input)
+	var out *sqs.ReceiveMessageOutput
+	err := Retry(c, "ReceiveMessage", func(ctx context.Context) (err error) {
+		out, err = api.ReceiveMessage(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // GetLPMessages gets the messages from an Amazon SQS long polling queue.
@@ -70,7 +93,12 @@ func GetMessages(c context.Context, api SQSAPI, input *sqs.ReceiveMessageInput)
 //     If success, a ReceiveMessageOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to ReceiveMessage.
 func GetLPMessages(c context.Context, api SQSAPI, input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
-	return api.ReceiveMessage(c, input)
+	var out *sqs.ReceiveMessageOutput
+	err := Retry(c, "ReceiveMessage", func(ctx context.Context) (err error) {
+		out, err = api.ReceiveMessage(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // SendMsg sends a message to an Amazon SQS queue.
@@ -82,7 +110,47 @@ func GetLPMessages(c context.Context, api SQSAPI, input *sqs.ReceiveMessageInput
 //     If success, a SendMessageOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to SendMessage.
 func SendMsg(c context.Context, api SQSAPI, input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
-	return api.SendMessage(c, input)
+	var out *sqs.SendMessageOutput
+	err := Retry(c, "SendMessage", func(ctx context.Context) (err error) {
+		out, err = api.SendMessage(ctx, input)
+		return err
+	})
+	return out, err
+}
+
+// ChangeVisibility changes the visibility timeout of a message received from an Amazon SQS queue.
+// Inputs:
+//     c is the context of the method call, which includes the AWS Region.
+//     api is the interface that defines the method call.
+//     input defines the input arguments to the service call.
+// Output:
+//     If success, a ChangeMessageVisibilityOutput object containing the result of the service call and nil.
+//     Otherwise, nil and an error from the call to ChangeMessageVisibility.
+func ChangeVisibility(c context.Context, api SQSAPI, input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	var out *sqs.ChangeMessageVisibilityOutput
+	err := Retry(c, "ChangeMessageVisibility", func(ctx context.Context) (err error) {
+		out, err = api.ChangeMessageVisibility(ctx, input)
+		return err
+	})
+	return out, err
+}
+
+// MakeQueue creates an Amazon SQS queue, or returns the URL of the queue of the
+// same name and attributes if there is one.
+// Inputs:
+//     c is the context of the method call, which includes the AWS Region.
+//     api is the interface that defines the method call.
+//     input defines the input arguments to the service call.
+// Output:
+//     If success, a CreateQueueOutput object containing the result of the service call and nil.
+//     Otherwise, nil and an error from the call to CreateQueue.
+func MakeQueue(c context.Context, api SQSAPI, input *sqs.CreateQueueInput) (*sqs.CreateQueueOutput, error) {
+	var out *sqs.CreateQueueOutput
+	err := Retry(c, "CreateQueue", func(ctx context.Context) (err error) {
+		out, err = api.CreateQueue(ctx, input)
+		return err
+	})
+	return out, err
 }
 
 // SQSListQueuesAPI defines the interface for the ListQueues function.
@@ -102,5 +170,36 @@ type SQSListQueuesAPI interface {
 //     If success, a ListQueuesOutput object containing the result of the service call and nil.
 //     Otherwise, nil and an error from the call to ListQueues.
 func GetQueues(c context.Context, api SQSListQueuesAPI, input *sqs.ListQueuesInput) (*sqs.ListQueuesOutput, error) {
-	return api.ListQueues(c, input)
+	var out *sqs.ListQueuesOutput
+	err := Retry(c, "ListQueues", func(ctx context.Context) (err error) {
+		out, err = api.ListQueues(ctx, input)
+		return err
+	})
+	return out, err
+}
+
+// SQSGetQueueAttributesAPI defines the interface for the GetQueueAttributes function.
+// We use this interface to test the function using a mocked service.
+type SQSGetQueueAttributesAPI interface {
+	GetQueueAttributes(ctx context.Context,
+		params *sqs.GetQueueAttributesInput,
+		optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+}
+
+// GetQueueAttrs retrieves the attributes of an Amazon SQS queue, such as its
+// approximate number of messages.
+// Inputs:
+//     c is the context of the method call, which includes the AWS Region.
+//     api is the interface that defines the method call.
+//     input defines the input arguments to the service call.
+// Output:
+//     If success, a GetQueueAttributesOutput object containing the result of the service call and nil.
+//     Otherwise, nil and an error from the call to GetQueueAttributes.
+func GetQueueAttrs(c context.Context, api SQSGetQueueAttributesAPI, input *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	var out *sqs.GetQueueAttributesOutput
+	err := Retry(c, "GetQueueAttributes", func(ctx context.Context) (err error) {
+		out, err = api.GetQueueAttributes(ctx, input)
+		return err
+	})
+	return out, err
 }
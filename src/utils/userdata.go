@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// Defaults of a WorkerBootstrap
+const (
+	DefaultBinaryKey   = "bin/worker"
+	DefaultConfigKey   = "config/config.json"
+	DefaultInstallDir  = "/opt/wordcounter"
+	DefaultStopTimeout = 90
+)
+
+// DefaultUserDataTemplate is the shell script a WorkerBootstrap renders
+// without a template of its own. It runs the worker as a systemd service, so
+// that stopping the instance drains the worker with a SIGTERM.
+const DefaultUserDataTemplate = `#!/bin/bash
+# Bootstraps a wordcounter worker
+set -euo pipefail
+
+dir={{quote .InstallDir}}
+mkdir -p "$dir"
+aws s3 cp{{with .Region}} --region {{quote .}}{{end}} {{quote (s3url .Bucket .BinaryKey)}} "$dir/worker"
+aws s3 cp{{with .Region}} --region {{quote .}}{{end}} {{quote (s3url .Bucket .ConfigKey)}} "$dir/config.json"
+chmod 755 "$dir/worker"
+
+cat > /etc/systemd/system/wordcounter-worker.service <<UNIT
+[Unit]
+Description=wordcounter worker
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+WorkingDirectory=$dir
+ExecStart=$dir/worker -config $dir/config.json -role {{quote .Role}}{{range .Args}} {{quote .}}{{end}}
+Restart=on-failure
+TimeoutStopSec={{.StopTimeout}}
+
+[Install]
+WantedBy=multi-user.target
+UNIT
+
+systemctl daemon-reload
+systemctl enable --now wordcounter-worker.service
+`
+
+// WorkerBootstrap is how a new instance installs and starts a worker: the
+// user data of the instance downloads the worker binary and its config from
+// an S3 bucket and runs the worker as a systemd service.
+type WorkerBootstrap struct {
+	// Bucket holds the worker binary and its config.
+	Bucket string
+	// BinaryKey and ConfigKey are the keys of the worker binary and its
+	// config, DefaultBinaryKey and DefaultConfigKey if empty.
+	BinaryKey string
+	ConfigKey string
+	// Region is the region of the bucket. The client defaults it to the
+	// region of its config.
+	Region string
+	// Role is the role of the worker, "worker" if empty.
+	Role string
+	// Args are the other arguments of the worker, such as "-spot".
+	Args []string
+	// InstallDir is where the worker is installed, DefaultInstallDir if empty.
+	// It may not contain spaces.
+	InstallDir string
+	// StopTimeout is the number of seconds systemd waits for the worker to
+	// drain before killing it, DefaultStopTimeout if zero. It should exceed
+	// the -grace of the worker.
+	StopTimeout int
+	// Template is the path of a text/template file rendered instead of
+	// DefaultUserDataTemplate, with the bootstrap as its data.
+	Template string
+}
+
+// userDataFuncs are the functions of the user data templates.
+var userDataFuncs = template.FuncMap{
+	"quote": shellQuote,
+	"s3url": func(bucket, key string) string { return "s3://" + bucket + "/" + key },
+}
+
+// shellQuote quotes s for a shell, and for a systemd unit.
+func shellQuote(s string) string {
+	return "'" + s + "'"
+}
+
+// withDefaults returns the bootstrap with its defaults set.
+func (b WorkerBootstrap) withDefaults() WorkerBootstrap {
+	if b.BinaryKey == "" {
+		b.BinaryKey = DefaultBinaryKey
+	}
+	if b.ConfigKey == "" {
+		b.ConfigKey = DefaultConfigKey
+	}
+	if b.Role == "" {
+		b.Role = RoleWorker
+	}
+	if b.InstallDir == "" {
+		b.InstallDir = DefaultInstallDir
+	}
+	if b.StopTimeout == 0 {
+		b.StopTimeout = DefaultStopTimeout
+	}
+	return b
+}
+
+// Validate checks the fields of a bootstrap. The values are quoted in the
+// script and the systemd unit, so they must not contain characters that are
+// special there even when quoted.
+func (b WorkerBootstrap) Validate() error {
+	if b.Bucket == "" {
+		return fmt.Errorf("invalid worker bootstrap: no bucket")
+	}
+	if b.StopTimeout < 0 {
+		return fmt.Errorf("invalid worker bootstrap: negative stop timeout")
+	}
+	// The path is not quoted in the ExecStart line of the systemd unit
+	if strings.IndexFunc(b.InstallDir, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("invalid worker bootstrap: install dir %q contains a space", b.InstallDir)
+	}
+	values := append([]string{b.Bucket, b.BinaryKey, b.ConfigKey, b.Region, b.Role, b.InstallDir}, b.Args...)
+	for _, v := range values {
+		if i := strings.IndexAny(v, "'\"$`\\%\n"); i >= 0 {
+			return fmt.Errorf("invalid worker bootstrap: %q contains %q", v, v[i])
+		}
+	}
+	return nil
+}
+
+// Script renders the user data script of the bootstrap.
+func (b WorkerBootstrap) Script() (string, error) {
+	if err := b.Validate(); err != nil {
+		return "", err
+	}
+	text := DefaultUserDataTemplate
+	if b.Template != "" {
+		data, err := ioutil.ReadFile(b.Template)
+		if err != nil {
+			return "", fmt.Errorf("failed to read user data template '%s': %v", b.Template, err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("userdata").Funcs(userDataFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse user data template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, b.withDefaults()); err != nil {
+		return "", fmt.Errorf("failed to render user data template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// UserData renders the user data script of the bootstrap, base64 encoded as
+// RunInstancesInput.UserData expects it.
+func (b WorkerBootstrap) UserData() (string, error) {
+	script, err := b.Script()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString([]byte(script)), nil
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestWorkerBootstrapScript(t *testing.T) {
+	dir := t.TempDir()
+	custom := filepath.Join(dir, "userdata.tmpl")
+	if err := ioutil.WriteFile(custom, []byte("#cloud-config\nruncmd:\n  - [{{quote .InstallDir}}, {{quote .Role}}]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		bootstrap WorkerBootstrap
+		want      []string
+		wantErr   string
+	}{
+		{
+			name:      "defaults",
+			bootstrap: WorkerBootstrap{Bucket: "deploy"},
+			want: []string{
+				"#!/bin/bash\n",
+				"dir='/opt/wordcounter'\n",
+				`aws s3 cp 's3://deploy/bin/worker' "$dir/worker"`,
+				`aws s3 cp 's3://deploy/config/config.json' "$dir/config.json"`,
+				"ExecStart=$dir/worker -config $dir/config.json -role 'worker'\n",
+				"TimeoutStopSec=90\n",
+				"systemctl enable --now wordcounter-worker.service\n",
+			},
+		},
+		{
+			name: "all fields",
+			bootstrap: WorkerBootstrap{Bucket: "deploy", BinaryKey: "v2/worker", ConfigKey: "v2/master.json", Region: "eu-west-1",
+				Role: "master", Args: []string{"-chunk", "1048576"}, InstallDir: "/srv/wc", StopTimeout: 120},
+			want: []string{
+				"dir='/srv/wc'\n",
+				`aws s3 cp --region 'eu-west-1' 's3://deploy/v2/worker' "$dir/worker"`,
+				`aws s3 cp --region 'eu-west-1' 's3://deploy/v2/master.json' "$dir/config.json"`,
+				"-role 'master' '-chunk' '1048576'\n",
+				"TimeoutStopSec=120\n",
+			},
+		},
+		{
+			name:      "template",
+			bootstrap: WorkerBootstrap{Bucket: "deploy", Template: custom},
+			want:      []string{"runcmd:\n  - ['/opt/wordcounter', 'worker']\n"},
+		},
+		{
+			name:      "missing template",
+			bootstrap: WorkerBootstrap{Bucket: "deploy", Template: filepath.Join(dir, "missing.tmpl")},
+			wantErr:   "failed to read user data template",
+		},
+		{name: "no bucket", bootstrap: WorkerBootstrap{}, wantErr: "no bucket"},
+		{name: "quote", bootstrap: WorkerBootstrap{Bucket: "deploy", Args: []string{"-id", "it's"}}, wantErr: "contains"},
+		{name: "variable", bootstrap: WorkerBootstrap{Bucket: "deploy", InstallDir: "$HOME"}, wantErr: "contains"},
+		{name: "space", bootstrap: WorkerBootstrap{Bucket: "deploy", InstallDir: "/opt/word counter"}, wantErr: "contains a space"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.bootstrap.Script()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Script() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Script() error = %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("Script() = %s\nwant it to contain %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLaunchConfigRunInput(t *testing.T) {
+	launch := LaunchConfig{ImageID: "ami-0001", InstanceType: "t3.micro", InstanceProfile: "worker",
+		Bootstrap: &WorkerBootstrap{Bucket: "deploy"}}
+	input, err := launch.RunInput(2)
+	if err != nil {
+		t.Fatalf("RunInput() error = %v", err)
+	}
+	if input.MinCount != 2 || input.MaxCount != 2 || aws.ToString(input.ImageId) != "ami-0001" ||
+		aws.ToString(input.IamInstanceProfile.Name) != "worker" {
+		t.Errorf("RunInput() = %+v", input)
+	}
+	script, err := base64.StdEncoding.DecodeString(aws.ToString(input.UserData))
+	if err != nil {
+		t.Fatalf("user data is not base64: %v", err)
+	}
+	want, _ := launch.Bootstrap.Script()
+	if string(script) != want {
+		t.Errorf("user data = %s, want %s", script, want)
+	}
+
+	launch.Bootstrap.Bucket = ""
+	if _, err := launch.RunInput(1); err == nil {
+		t.Errorf("RunInput() with an invalid bootstrap succeeded")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"wordcounter/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Reasons of the jobs dropped before they are done
+const (
+	cancelledReason = "cancelled by the client"
+	expiredReason   = "deadline passed before the job was done"
+)
+
+// jobCancelled reports whether the job jobID was cancelled. A failed check
+// counts as not cancelled, the job is checked again while it runs.
+func (w *worker) jobCancelled(ctx context.Context, jobID utils.JobID) bool {
+	cancelled, err := utils.JobCancelled(ctx, w.s3Client, w.cfg.ResultBucketName, jobID)
+	if err != nil && ctx.Err() == nil {
+		w.log.Warn("failed to check for the cancellation of the job", utils.LogKeyJobID, jobID, utils.LogKeyError, err)
+	}
+	return cancelled
+}
+
+// watchCancel returns a context done with ctx, or as soon as the job jobID is
+// found cancelled, checking every cancelCheck. The returned function stops the
+// watch and reports whether the job was cancelled.
+func (w *worker) watchCancel(ctx context.Context, jobID utils.JobID) (context.Context, func() bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	var cancelled int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(w.cancelCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if w.jobCancelled(ctx, jobID) {
+				atomic.StoreInt32(&cancelled, 1)
+				cancel()
+				return
+			}
+		}
+	}()
+	return ctx, func() bool {
+		cancel()
+		<-done
+		return atomic.LoadInt32(&cancelled) == 1
+	}
+}
+
+// drop deletes the message of a job cancelled or expired before it was done,
+// along with the partial outputs of the job: its checkpoint and, on the
+// master, the partial counts and checkpoints of its sub-jobs, and records the
+// status of the job. The sub-jobs still queued are dropped by the sub workers
+// that receive them.
+func (w *worker) drop(ctx context.Context, from queue, msg types.Message, job utils.JobMessage, status utils.JobStatus, reason string) {
+	bucket := w.cfg.ResultBucketName
+	keys := []string{utils.CheckpointKey(job.JobID, job.Range)}
+	if w.role == roleMaster {
+		w.finish(job.JobID)
+		w.deletePartials(ctx, job.JobID, "")
+		found, err := utils.ListObjectKeys(ctx, w.s3Client, bucket, utils.PartialCheckpointPrefix(job.JobID))
+		if err != nil {
+			w.log.Warn("failed to list checkpoints", utils.LogKeyJobID, job.JobID, utils.LogKeyError, err)
+		}
+		keys = append(keys, found...)
+	}
+	for _, key := range keys {
+		if err := utils.DeleteObjectSimple(ctx, w.s3Client, key, bucket); err != nil {
+			w.log.Warn("failed to delete checkpoint", utils.LogKeyBucket, bucket, utils.LogKeyKey, key, utils.LogKeyError, err)
+		}
+	}
+	if err := utils.RemoveMessageSimple(ctx, w.sqsClient, from.url, aws.ToString(msg.ReceiptHandle)); err != nil {
+		w.log.Error("failed to delete message", utils.LogKeyJobID, job.JobID, utils.LogKeyQueue, from.name, utils.LogKeyError, err)
+	}
+	// Also repairs the state of a cancelled job overwritten meanwhile by a worker
+	w.setState(ctx, job, status, reason, nil)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"wordcounter/src/utils"
+)
+
+// identityTimeout bounds the discovery of the instance of the worker, the
+// instance metadata service may not answer at all off EC2.
+const identityTimeout = 5 * time.Second
+
+// discoverIdentity returns the instance the worker runs on, read from the
+// instance metadata service, or the identity configured in cfg when the
+// service cannot be reached or AWS_EC2_METADATA_DISABLED is true. It returns
+// nil if neither is known.
+func discoverIdentity(ctx context.Context, api utils.MetadataAPI, cfg utils.Config) *utils.Identity {
+	if os.Getenv("AWS_EC2_METADATA_DISABLED") != "true" {
+		ctx, cancel := context.WithTimeout(ctx, identityTimeout)
+		defer cancel()
+		id, err := utils.DiscoverIdentity(ctx, api)
+		if err == nil {
+			return &id
+		}
+		utils.Log().Info("instance metadata unavailable, using the configured identity", utils.LogKeyError, err)
+	}
+	return cfg.Identity
+}
+
+// resolveWorkerID returns the id of a worker given with the -id flag, or else
+// its instance ID, or else the host name.
+func resolveWorkerID(flagID string, identity *utils.Identity) string {
+	if flagID != "" {
+		return flagID
+	}
+	if identity != nil && identity.InstanceID != "" {
+		return identity.InstanceID
+	}
+	host, _ := os.Hostname()
+	return host
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"wordcounter/src/fakeaws"
+	"wordcounter/src/utils"
+)
+
+func Test_discoverIdentity(t *testing.T) {
+	server := fakeaws.NewMetadataServer()
+	defer server.Close()
+	client := utils.NewMetadataClient(server.URL)
+	configured := &utils.Identity{InstanceID: "laptop"}
+	cfg := testConfig()
+	cfg.Identity = configured
+
+	// The metadata service of a host that is not an instance has no instance ID
+	if got := discoverIdentity(context.TODO(), client, cfg); got != configured {
+		t.Errorf("discoverIdentity() off EC2 = %+v, want %+v", got, configured)
+	}
+	if got := resolveWorkerID("", configured); got != "laptop" {
+		t.Errorf("resolveWorkerID() = %s, want laptop", got)
+	}
+
+	server.Set("meta-data/instance-id", "i-0001")
+	server.Set("meta-data/local-ipv4", "10.0.0.1")
+	server.Set("meta-data/placement/availability-zone", "eu-west-1a")
+	server.Set("meta-data/instance-type", "t3.micro")
+	want := &utils.Identity{InstanceID: "i-0001", PrivateIP: "10.0.0.1", AvailabilityZone: "eu-west-1a", InstanceType: "t3.micro"}
+	got := discoverIdentity(context.TODO(), client, cfg)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverIdentity() = %+v, want %+v", got, want)
+	}
+	if id := resolveWorkerID("", got); id != "i-0001" {
+		t.Errorf("resolveWorkerID() = %s, want i-0001", id)
+	}
+	if id := resolveWorkerID("w1", got); id != "w1" {
+		t.Errorf("resolveWorkerID() with -id = %s, want w1", id)
+	}
+
+	// The metadata service is disabled
+	os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	defer os.Unsetenv("AWS_EC2_METADATA_DISABLED")
+	if got := discoverIdentity(context.TODO(), client, cfg); got != configured {
+		t.Errorf("discoverIdentity() disabled = %+v, want %+v", got, configured)
+	}
+}
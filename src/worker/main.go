@@ -0,0 +1,779 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"wordcounter/src/counter"
+	"wordcounter/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Roles of a worker process
+const (
+	// roleWorker counts whole objects from the job queue.
+	roleWorker = "worker"
+	// roleMaster splits the objects of the job queue into sub-jobs and reduces their counts.
+	roleMaster = "master"
+	// roleSub counts the byte ranges of the sub-job queue.
+	roleSub = "sub"
+)
+
+const (
+	// spotCheckInterval is how often the worker checks for a spot interruption notice.
+	spotCheckInterval = 5 * time.Second
+	// cancelCheckInterval is how often a worker checks whether the job in progress was cancelled.
+	cancelCheckInterval = 10 * time.Second
+	// readBufferSize is the size of the reads of the objects counted.
+	readBufferSize = 64 << 10
+	// releaseTimeout bounds the calls made for a job message once its job is over.
+	releaseTimeout = 10 * time.Second
+)
+
+// jobHandler does the job of a message.
+type jobHandler func(ctx context.Context, job utils.JobMessage) error
+
+// queue is a queue the worker receives jobs from.
+type queue struct {
+	name string
+	url  string
+}
+
+type worker struct {
+	cfg utils.Config
+	log utils.Logger
+	id  string
+	// identity is the instance the worker runs on, nil if unknown
+	identity  *utils.Identity
+	role      string
+	waitTime  int
+	chunkSize int64
+	// visibility is the visibility timeout kept on a job message while it is processed
+	visibility time.Duration
+	// grace is the time given to the job in progress to finish once the worker stops
+	grace time.Duration
+	// cancelCheck is the interval between the checks for the cancellation of the job in progress
+	cancelCheck time.Duration
+	// checkpointEvery is the interval between the checkpoints of a count, 0 disables them
+	checkpointEvery time.Duration
+	// maxReceives is the number of times a job message is received before it is dead-lettered
+	maxReceives int
+	sqsClient   utils.SQSAPI
+	s3Client    utils.S3API
+
+	in          queue  // queue the jobs are received from
+	outQueueURL string // queue the results are sent to
+	dlqURL      string // dead-letter queue of the failed jobs, if any
+
+	// routing is the routing mode of the jobs addressed to a worker
+	routing string
+	// own is the queue of the jobs addressed to the worker, when they are routed by queue
+	own queue
+	// routingTimeout is how long a job addressed to another worker is put back in the claim mode
+	routingTimeout time.Duration
+
+	// Sub-job queues used by the master
+	subJobQueueURL    string
+	subResultQueueURL string
+	// subJobTimeout is how long the master waits for the next sub-job result before failing the job, 0 waits forever
+	subJobTimeout time.Duration
+
+	// delivery is the delivery of the job message in progress, see utils.DeliveryID
+	delivery string
+
+	// URLs of the queues named by the ReplyTo field of the jobs
+	replyQueueURLs map[string]string
+	// IDs of the jobs reduced by the master and when, their late partial results are duplicates
+	finished map[utils.JobID]time.Time
+}
+
+func main() {
+	cfgPath := flag.String("config", "config/config.json", "path of the JSON config file")
+	workerID := flag.String("id", "", "id reported with every result (defaults to the instance ID, or the host name off EC2)")
+	role := flag.String("role", roleWorker, "role of the process: worker, master or sub")
+	waitTime := flag.Int("wait", 20, "long polling wait time in seconds")
+	chunkSize := flag.Int64("chunk", 64<<20, "size in bytes of the sub-jobs created by the master")
+	visibility := flag.Int("visibility", 60, "visibility timeout in seconds kept on a job message while it is processed")
+	grace := flag.Int("grace", 30, "seconds given to the job in progress to finish when the worker stops")
+	spot := flag.Bool("spot", false, "drain the worker when the spot instance it runs on is about to be interrupted")
+	checkpoint := flag.Int("checkpoint", 60, "seconds between the checkpoints saved while an object is counted, 0 disables them")
+	subTimeout := flag.Int("sub-timeout", 1800, "seconds the master waits for the next sub-job result before failing the job, 0 waits forever")
+	logLevel := flag.String("log-level", "info", "lowest level of the logged records: debug, info, warn or error")
+	flag.Parse()
+
+	level, err := utils.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	log := utils.NewJSONLogger(os.Stderr, level).With("role", *role)
+	utils.SetLogger(log)
+
+	myCfg, err := utils.LoadConfig(*cfgPath)
+	if err != nil {
+		log.Error("failed to load config", utils.LogKeyError, err)
+		os.Exit(1)
+	}
+	identity := discoverIdentity(context.Background(), utils.NewMetadataClient(""), myCfg)
+	*workerID = resolveWorkerID(*workerID, identity)
+	log = log.With(utils.LogKeyWorkerID, *workerID)
+	if identity != nil {
+		log = log.With("instance_id", identity.InstanceID, "instance_type", identity.InstanceType, "availability_zone", identity.AvailabilityZone,
+			"private_ip", identity.PrivateIP, "public_ip", identity.PublicIP)
+	}
+	utils.SetLogger(log)
+	services, err := utils.NewServices(myCfg)
+	if err != nil {
+		log.Error("failed to create service clients", utils.LogKeyError, err)
+		os.Exit(1)
+	}
+
+	w := &worker{
+		cfg:       myCfg,
+		log:       log,
+		id:        *workerID,
+		identity:  identity,
+		role:      *role,
+		waitTime:  *waitTime,
+		chunkSize: *chunkSize,
+
+		visibility:  time.Duration(*visibility) * time.Second,
+		grace:       time.Duration(*grace) * time.Second,
+		maxReceives: myCfg.MaxReceiveCount,
+		sqsClient:   services.SQS,
+		s3Client:    services.S3,
+
+		checkpointEvery: time.Duration(*checkpoint) * time.Second,
+		subJobTimeout:   time.Duration(*subTimeout) * time.Second,
+		cancelCheck:     cancelCheckInterval,
+
+		replyQueueURLs: make(map[string]string),
+		finished:       make(map[utils.JobID]time.Time),
+	}
+
+	// Drain on SIGTERM or Ctrl-C, a second signal kills the process
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		log.Info("received signal, draining", "signal", sig.String())
+		stop()
+	}()
+
+	var handle jobHandler = w.countJob
+	inQueue, outQueue := myCfg.JobQueueName, myCfg.ResultQueueName
+	switch w.role {
+	case roleWorker:
+	case roleSub:
+		inQueue, outQueue = myCfg.SubJobQueueName, myCfg.SubResultQueueName
+	case roleMaster:
+		if w.chunkSize <= 0 {
+			log.Error("the sub-job size must be positive", "chunk", w.chunkSize)
+			os.Exit(2)
+		}
+		if w.subJobQueueURL, err = utils.GetQueueURLSimple(ctx, w.sqsClient, myCfg.SubJobQueueName); err != nil {
+			log.Error("failed to get queue URL", utils.LogKeyQueue, myCfg.SubJobQueueName, utils.LogKeyError, err)
+			os.Exit(1)
+		}
+		if w.subResultQueueURL, err = utils.GetQueueURLSimple(ctx, w.sqsClient, myCfg.SubResultQueueName); err != nil {
+			log.Error("failed to get queue URL", utils.LogKeyQueue, myCfg.SubResultQueueName, utils.LogKeyError, err)
+			os.Exit(1)
+		}
+		handle = w.splitJob
+	default:
+		log.Error("unknown role")
+		os.Exit(2)
+	}
+	if w.visibility < 3*time.Second {
+		log.Error("the visibility timeout must be at least 3 seconds", "visibility", *visibility)
+		os.Exit(2)
+	}
+	if w.grace < 0 {
+		log.Error("the grace period must not be negative", "grace", *grace)
+		os.Exit(2)
+	}
+	if w.maxReceives <= 0 {
+		w.maxReceives = utils.DefaultMaxReceiveCount
+	}
+	if myCfg.DeadLetterQueueName != "" {
+		if w.dlqURL, err = utils.GetQueueURLSimple(ctx, w.sqsClient, myCfg.DeadLetterQueueName); err != nil {
+			log.Error("failed to get queue URL", utils.LogKeyQueue, myCfg.DeadLetterQueueName, utils.LogKeyError, err)
+			os.Exit(1)
+		}
+	}
+	w.in.name = inQueue
+	if w.in.url, err = utils.GetQueueURLSimple(ctx, w.sqsClient, inQueue); err != nil {
+		log.Error("failed to get queue URL", utils.LogKeyQueue, inQueue, utils.LogKeyError, err)
+		os.Exit(1)
+	}
+	if w.routing, err = utils.RoutingMode(myCfg); err != nil {
+		log.Error("invalid config", utils.LogKeyError, err)
+		os.Exit(2)
+	}
+	w.routingTimeout = utils.RoutingTimeout(myCfg)
+	// The sub-jobs are never addressed to a worker
+	if w.routing == utils.RoutingQueue && w.role != roleSub {
+		if w.own.name, w.own.url, err = utils.CreateWorkerQueue(ctx, w.sqsClient, inQueue, w.id); err != nil {
+			log.Error("failed to create the queue of the worker", utils.LogKeyQueue, w.own.name, utils.LogKeyError, err)
+			os.Exit(1)
+		}
+		w.saveLease(ctx, time.Now(), utils.LeaseTTL)
+		go w.keepLease(ctx)
+		log.Info("polling queue", utils.LogKeyQueue, w.own.name)
+	}
+	if w.outQueueURL, err = utils.GetQueueURLSimple(ctx, w.sqsClient, outQueue); err != nil {
+		log.Error("failed to get queue URL", utils.LogKeyQueue, outQueue, utils.LogKeyError, err)
+		os.Exit(1)
+	}
+
+	// Report the retries of the AWS calls now and then
+	go func() {
+		for range time.Tick(5 * time.Minute) {
+			utils.LogRetryMetrics(log)
+		}
+	}()
+
+	if *spot {
+		go func() {
+			action, err := utils.WatchSpotInterruption(ctx, utils.NewMetadataClient(""), spotCheckInterval)
+			if err != nil {
+				return
+			}
+			log.Warn("spot instance interruption notice, draining", "action", action.Action, "time", action.Time)
+			stop()
+		}()
+	}
+
+	log.Info("polling queue", utils.LogKeyQueue, inQueue)
+	w.run(ctx, handle)
+	if w.own.url != "" {
+		w.handOver()
+	}
+	utils.LogRetryMetrics(log)
+	log.Info("stopped")
+}
+
+// run receives the jobs of the queues of the worker and processes them with
+// handle, one at a time, until ctx is done.
+func (w *worker) run(ctx context.Context, handle jobHandler) {
+	for ctx.Err() == nil {
+		from, msgs, err := w.receive(ctx)
+		if ctx.Err() != nil {
+			for _, msg := range msgs {
+				w.release(from, msg, utils.JobID(""))
+			}
+			return
+		}
+		if err != nil {
+			w.log.Warn("failed to receive messages", utils.LogKeyQueue, from.name, utils.LogKeyError, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, msg := range msgs {
+			w.process(ctx, from, msg, handle)
+		}
+	}
+}
+
+// receive waits for a message of the job queue, once the queue of the jobs
+// addressed to the worker, if it has one, is found empty. It returns the
+// queue the messages were received from.
+func (w *worker) receive(ctx context.Context) (queue, []types.Message, error) {
+	if w.own.url != "" {
+		resp, err := utils.GetLPMessagesByURL(ctx, w.sqsClient, w.own.url, 1, 0)
+		if err != nil {
+			return w.own, nil, err
+		}
+		if len(resp.Messages) > 0 {
+			return w.own, resp.Messages, nil
+		}
+	}
+	resp, err := utils.GetLPMessagesByURL(ctx, w.sqsClient, w.in.url, 1, w.waitTime)
+	if err != nil {
+		return w.in, nil, err
+	}
+	return w.in, resp.Messages, nil
+}
+
+// process handles the job of a message and deletes the message once the job
+// is done. When ctx is done during the job, the job is given the grace period
+// of the worker to finish, after which it is abandoned and its message made
+// visible again for another worker.
+func (w *worker) process(ctx context.Context, from queue, msg types.Message, handle jobHandler) {
+	jobCtx, cancel := w.jobContext(ctx)
+	defer cancel()
+	job, err := utils.DecodeJob(aws.ToString(msg.Body))
+	if err != nil {
+		// The job can never succeed, take it out of the
+		// queue rather than have it redelivered forever.
+		w.log.Warn("rejected job message", "message_id", aws.ToString(msg.MessageId), utils.LogKeyError, err)
+		w.reject(jobCtx, from, msg, "malformed job message: "+err.Error())
+		return
+	}
+	if w.addressedElsewhere(from, msg) {
+		w.putBack(jobCtx, from, msg, job)
+		return
+	}
+	if n := utils.Attempts(msg); n > w.maxReceives && w.dlqURL != "" {
+		// The workers that received it before died or lost it
+		w.fail(jobCtx, from, msg, job, fmt.Errorf("received %d times without completing", n))
+		return
+	}
+	if job.Expired(time.Now()) {
+		w.log.Info("dropped expired job", utils.LogKeyJobID, job.JobID, "range", job.Range, "deadline", job.Deadline)
+		w.drop(jobCtx, from, msg, job, utils.StatusExpired, expiredReason)
+		return
+	}
+	if w.jobCancelled(jobCtx, job.JobID) {
+		w.log.Info("dropped cancelled job", utils.LogKeyJobID, job.JobID, "range", job.Range)
+		w.drop(jobCtx, from, msg, job, utils.StatusCancelled, cancelledReason)
+		return
+	}
+	// Keep the message hidden until the job is done, extending
+	// its visibility three times per timeout.
+	w.setState(jobCtx, job, utils.StatusRunning, "", nil)
+	hb := utils.StartHeartbeat(jobCtx, w.sqsClient, from.url, *msg.ReceiptHandle, w.visibility, w.visibility/3, w.log)
+	runCtx, stopWatch := w.watchCancel(jobCtx, job.JobID)
+	if job.Deadline != nil {
+		var cancelRun context.CancelFunc
+		runCtx, cancelRun = context.WithDeadline(runCtx, *job.Deadline)
+		defer cancelRun()
+	}
+	w.delivery = utils.DeliveryID(msg)
+	err = handle(runCtx, job)
+	w.delivery = ""
+	cancelled := stopWatch()
+	if err := hb.Stop(); err != nil {
+		w.log.Warn("job message may have been redelivered", utils.LogKeyJobID, job.JobID, utils.LogKeyError, err)
+	}
+
+	// The grace period must not cut short the calls made once the job is over
+	doneCtx, cancelDone := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancelDone()
+	if err != nil && cancelled {
+		w.log.Info("stopped cancelled job", utils.LogKeyJobID, job.JobID, "range", job.Range)
+		w.drop(doneCtx, from, msg, job, utils.StatusCancelled, cancelledReason)
+		return
+	}
+	if err != nil && job.Expired(time.Now()) {
+		w.log.Warn("stopped expired job", utils.LogKeyJobID, job.JobID, "range", job.Range, "deadline", job.Deadline, utils.LogKeyError, err)
+		w.drop(doneCtx, from, msg, job, utils.StatusExpired, expiredReason)
+		return
+	}
+	if err != nil && jobCtx.Err() != nil {
+		w.log.Warn("abandoned job at shutdown", utils.LogKeyJobID, job.JobID, "grace", w.grace.String(), utils.LogKeyError, err)
+		w.release(from, msg, job.JobID)
+		w.setState(doneCtx, job, utils.StatusQueued, "worker stopped before the job was done", nil)
+		return
+	}
+	if err != nil {
+		w.fail(doneCtx, from, msg, job, err)
+		return
+	}
+	if err := utils.RemoveMessageSimple(doneCtx, w.sqsClient, from.url, *msg.ReceiptHandle); err != nil {
+		// The job will be done again, its result replaces this one
+		w.log.Error("failed to delete message", utils.LogKeyJobID, job.JobID, utils.LogKeyQueue, from.name, utils.LogKeyError, err)
+	}
+	w.setState(doneCtx, job, utils.StatusSucceeded, "", func(state *utils.JobState) {
+		state.ResultKey = utils.ResultKey(job.JobID, job.Range)
+	})
+}
+
+// setState records a new status of a job in its persistent state, along with
+// the changes made by change if not nil. The sub workers leave the state of
+// the jobs to their master.
+func (w *worker) setState(ctx context.Context, job utils.JobMessage, status utils.JobStatus, reason string, change func(*utils.JobState)) {
+	if w.role == roleSub {
+		return
+	}
+	_, err := utils.UpdateJobState(ctx, w.s3Client, w.cfg.ResultBucketName, job.JobID, func(state *utils.JobState) bool {
+		if !state.Set(status, w.id, reason, time.Now()) {
+			return false
+		}
+		state.Instance = w.identity
+		if state.Bucket == "" {
+			state.Bucket, state.Key = job.Bucket, job.Key
+		}
+		if change != nil {
+			change(state)
+		}
+		return true
+	})
+	if err != nil {
+		w.log.Warn("failed to save job state", utils.LogKeyJobID, job.JobID, "status", status, utils.LogKeyError, err)
+	}
+}
+
+// jobContext returns the context of a job received while ctx was not done. It
+// is cancelled a grace period after ctx is done, or by the returned function.
+func (w *worker) jobContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	jobCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-jobCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		w.log.Info("shutting down, waiting for the job in progress", "grace", w.grace.String())
+		timer := time.NewTimer(w.grace)
+		defer timer.Stop()
+		select {
+		case <-jobCtx.Done():
+		case <-timer.C:
+			cancel()
+		}
+	}()
+	return jobCtx, cancel
+}
+
+// release makes a message the worker will not process visible again in the
+// input queue, for another worker to receive it without waiting for its
+// visibility timeout.
+func (w *worker) release(from queue, msg types.Message, jobID utils.JobID) {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	if err := utils.ChangeVisibilitySimple(ctx, w.sqsClient, from.url, aws.ToString(msg.ReceiptHandle), 0); err != nil {
+		// It becomes visible anyway once its visibility timeout expires
+		w.log.Warn("failed to release message", utils.LogKeyJobID, jobID, utils.LogKeyQueue, from.name, utils.LogKeyError, err)
+		return
+	}
+	w.log.Info("released message", utils.LogKeyJobID, jobID, utils.LogKeyQueue, from.name)
+}
+
+// fail handles a job that could not be done. Its message is left in the queue
+// to be redelivered once its visibility timeout expires, unless it was received
+// maxReceives times already and is moved to the dead-letter queue. The
+// put-backs of a job in the claim mode are not counted, see utils.Attempts.
+func (w *worker) fail(ctx context.Context, from queue, msg types.Message, job utils.JobMessage, err error) {
+	n := utils.Attempts(msg)
+	w.log.Error("failed to handle job", utils.LogKeyJobID, job.JobID, "receive_count", n, utils.LogKeyError, err)
+	if n < w.maxReceives || w.dlqURL == "" {
+		w.setState(ctx, job, utils.StatusQueued, err.Error(), nil)
+		return
+	}
+	// Once redriven, the job goes to any worker
+	if dlqErr := utils.DeadLetterMessage(ctx, w.sqsClient, w.dlqURL, w.in.name, from.url, msg, err.Error()); dlqErr != nil {
+		w.log.Error("failed to dead-letter message", utils.LogKeyJobID, job.JobID, utils.LogKeyError, dlqErr)
+		w.setState(ctx, job, utils.StatusQueued, err.Error(), nil)
+		return
+	}
+	w.setState(ctx, job, utils.StatusFailed, err.Error(), nil)
+	// The master of a sub-job would wait for its counts until it times out
+	if w.role == roleSub {
+		if err := w.reportFailure(ctx, job, err.Error()); err != nil {
+			w.log.Error("failed to report sub-job failure", utils.LogKeyJobID, job.JobID, "range", job.Range, utils.LogKeyError, err)
+		}
+	}
+}
+
+// reject removes a message that can never be processed from the queue, moving
+// it to the dead-letter queue if there is one.
+func (w *worker) reject(ctx context.Context, from queue, msg types.Message, reason string) {
+	var err error
+	if w.dlqURL != "" {
+		err = utils.DeadLetterMessage(ctx, w.sqsClient, w.dlqURL, w.in.name, from.url, msg, reason)
+	} else {
+		err = utils.RemoveMessageSimple(ctx, w.sqsClient, from.url, aws.ToString(msg.ReceiptHandle))
+	}
+	if err != nil {
+		w.log.Error("failed to remove message", utils.LogKeyQueue, from.name, utils.LogKeyError, err)
+	}
+}
+
+// countJob counts the words of the object, or of the byte range of it, named by
+// a job, stores the counts in the result bucket and announces them on the
+// result queue. The count resumes from the checkpoint of an earlier delivery
+// of the job, if any.
+func (w *worker) countJob(ctx context.Context, job utils.JobMessage) error {
+	resultKey := utils.ResultKey(job.JobID, job.Range)
+	if done, err := w.reportExisting(ctx, job, resultKey); done || err != nil {
+		return err
+	}
+	cpKey := utils.CheckpointKey(job.JobID, job.Range)
+	cp, err := utils.LoadCheckpoint(ctx, w.s3Client, w.cfg.ResultBucketName, cpKey)
+	if err != nil {
+		// Counting from the start is slower but as correct
+		w.log.Warn("failed to load checkpoint", utils.LogKeyJobID, job.JobID, utils.LogKeyKey, cpKey, utils.LogKeyError, err)
+	}
+	if cp != nil {
+		// A checkpoint may end where the job does, there is nothing left to get
+		end, version, err := w.objectEnd(ctx, job)
+		if err != nil {
+			return err
+		}
+		switch {
+		case version != cp.ETag:
+			w.log.Warn("object changed since the checkpoint, counting it again", utils.LogKeyJobID, job.JobID, utils.LogKeyKey, job.Key)
+			cp = nil
+		case cp.Offset >= end:
+			if err := w.publishResult(ctx, job, resultKey, cp.Counts); err != nil {
+				return err
+			}
+			w.log.Info("finished job from its checkpoint", utils.LogKeyJobID, job.JobID, "words", len(cp.Counts), "result", resultKey)
+			w.deleteCheckpoint(ctx, job, cpKey)
+			return nil
+		}
+	}
+
+	obj, err := w.getObject(ctx, job, cp)
+	if err != nil {
+		return err
+	}
+	if cp != nil && objectVersion(obj.ETag, obj.LastModified) != cp.ETag {
+		w.log.Warn("object changed since the checkpoint, counting it again", utils.LogKeyJobID, job.JobID, utils.LogKeyKey, job.Key)
+		obj.Body.Close()
+		cp = nil
+		if obj, err = w.getObject(ctx, job, nil); err != nil {
+			return err
+		}
+	}
+	start, base := int64(0), make(map[string]int)
+	if job.Range != nil {
+		start = job.Range.Start
+	}
+	if cp != nil {
+		start, base = cp.Offset, cp.Counts
+	}
+	w.log.Info("counting job", utils.LogKeyJobID, job.JobID, utils.LogKeyBucket, job.Bucket, utils.LogKeyKey, job.Key, "range", job.Range, "offset", start)
+
+	counts, saved, err := w.count(ctx, job, objectVersion(obj.ETag, obj.LastModified), obj.Body, start, base, cpKey)
+	obj.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if err = w.publishResult(ctx, job, resultKey, counts); err != nil {
+		return err
+	}
+	w.log.Info("finished job", utils.LogKeyJobID, job.JobID, "words", len(counts), "result", resultKey)
+	if cp != nil || saved {
+		w.deleteCheckpoint(ctx, job, cpKey)
+	}
+	return nil
+}
+
+// deleteCheckpoint deletes the checkpoint of a job done, the failures are
+// only logged.
+func (w *worker) deleteCheckpoint(ctx context.Context, job utils.JobMessage, cpKey string) {
+	if err := utils.DeleteObjectSimple(ctx, w.s3Client, cpKey, w.cfg.ResultBucketName); err != nil {
+		w.log.Warn("failed to delete checkpoint", utils.LogKeyJobID, job.JobID, utils.LogKeyKey, cpKey, utils.LogKeyError, err)
+	}
+}
+
+// objectEnd returns the offset at which the bytes of a job end in its object,
+// and the version of the object.
+func (w *worker) objectEnd(ctx context.Context, job utils.JobMessage) (int64, string, error) {
+	info, err := utils.GetObjectInfo(ctx, w.s3Client, &s3.HeadObjectInput{
+		Bucket: &job.Bucket,
+		Key:    &job.Key,
+	})
+	if err != nil {
+		return 0, "", utils.WrapError("HeadObject", utils.ObjectName(job.Bucket, job.Key), err)
+	}
+	end := info.ContentLength
+	if job.Range != nil && job.Range.End < end {
+		end = job.Range.End
+	}
+	return end, objectVersion(info.ETag, info.LastModified), nil
+}
+
+// getObject gets the object, or the byte range of it, named by a job, from the
+// offset of cp if not nil.
+func (w *worker) getObject(ctx context.Context, job utils.JobMessage, cp *utils.Checkpoint) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &job.Bucket,
+		Key:    &job.Key,
+	}
+	switch {
+	case job.Range != nil && cp != nil:
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", cp.Offset, job.Range.End-1))
+	case job.Range != nil:
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", job.Range.Start, job.Range.End-1))
+	case cp != nil:
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", cp.Offset))
+	}
+	obj, err := utils.GetObject(ctx, w.s3Client, input)
+	if err != nil {
+		return nil, utils.WrapError("GetObject", utils.ObjectName(job.Bucket, job.Key), err)
+	}
+	return obj, nil
+}
+
+// objectVersion identifies the version of an object by its ETag, or by its
+// modification time for the backends without ETags.
+func objectVersion(etag *string, modified *time.Time) string {
+	if etag := aws.ToString(etag); etag != "" {
+		return etag
+	}
+	return aws.ToTime(modified).UTC().Format(time.RFC3339Nano)
+}
+
+// count counts the words of body, the bytes of the object of a job from offset
+// start, and returns them added to base. Every checkpoint interval, and when
+// reading body fails, it saves its progress as cpKey in the result bucket,
+// and reports whether it did.
+func (w *worker) count(ctx context.Context, job utils.JobMessage, version string, body io.Reader, start int64, base map[string]int, cpKey string) (map[string]int, bool, error) {
+	c := counter.New(job.Options)
+	saved := false
+	savedAt := start
+	checkpoint := func(ctx context.Context) {
+		offset := start + c.Boundary()
+		if offset == savedAt {
+			return
+		}
+		counts := make(map[string]int, len(base)+len(c.Counts()))
+		counter.Merge(counts, base)
+		counter.Merge(counts, c.Counts())
+		err := utils.SaveCheckpoint(ctx, w.s3Client, w.cfg.ResultBucketName, cpKey, utils.Checkpoint{
+			JobID:    job.JobID,
+			Range:    job.Range,
+			ETag:     version,
+			Offset:   offset,
+			Counts:   counts,
+			WorkerID: w.id,
+			Instance: w.identity,
+			Time:     time.Now().UTC(),
+		})
+		if err != nil {
+			w.log.Warn("failed to save checkpoint", utils.LogKeyJobID, job.JobID, utils.LogKeyKey, cpKey, utils.LogKeyError, err)
+			return
+		}
+		saved, savedAt = true, offset
+	}
+
+	buf := make([]byte, readBufferSize)
+	last := time.Now()
+	for {
+		n, err := body.Read(buf)
+		c.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Keep what was counted for the next delivery of the job, even
+			// when the read failed because ctx is done.
+			saveCtx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+			checkpoint(saveCtx)
+			cancel()
+			return nil, saved, fmt.Errorf("failed to read object '%s': %v", job.Key, err)
+		}
+		if w.checkpointEvery > 0 && time.Since(last) >= w.checkpointEvery {
+			checkpoint(ctx)
+			last = time.Now()
+		}
+	}
+	c.Flush()
+	counter.Merge(base, c.Counts())
+	return base, saved, nil
+}
+
+// reportExisting reports the counts of a job already stored as resultKey by an
+// earlier delivery of the job, and returns whether there were any.
+func (w *worker) reportExisting(ctx context.Context, job utils.JobMessage, resultKey string) (bool, error) {
+	exists, err := utils.ObjectExists(ctx, w.s3Client, resultKey, w.cfg.ResultBucketName)
+	if err != nil || !exists {
+		return false, err
+	}
+	w.log.Info("job already done, reporting its result again", utils.LogKeyJobID, job.JobID, "range", job.Range, "result", resultKey)
+	return true, w.reportResult(ctx, job, resultKey)
+}
+
+// publishResult stores the counts of a job as resultKey in the result bucket
+// and sends a message naming it to the reply queue of the job.
+func (w *worker) publishResult(ctx context.Context, job utils.JobMessage, resultKey string, counts map[string]int) error {
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	_, err = utils.PutFile(ctx, w.s3Client, &s3.PutObjectInput{
+		Bucket: &w.cfg.ResultBucketName,
+		Key:    &resultKey,
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return utils.WrapError("PutObject", utils.ObjectName(w.cfg.ResultBucketName, resultKey), err)
+	}
+	return w.reportResult(ctx, job, resultKey)
+}
+
+// reportResult sends a message naming the counts of a job stored as resultKey
+// to the reply queue of the job. The consumers of the queue ignore the
+// duplicates of a report.
+func (w *worker) reportResult(ctx context.Context, job utils.JobMessage, resultKey string) error {
+	return w.sendResult(ctx, job, utils.ResultMessage{
+		ResultBucket: w.cfg.ResultBucketName,
+		ResultKey:    resultKey,
+	})
+}
+
+// reportFailure tells the reply queue of a job that the job failed for good
+// because of reason, so that its master stops waiting for its counts.
+func (w *worker) reportFailure(ctx context.Context, job utils.JobMessage, reason string) error {
+	return w.sendResult(ctx, job, utils.ResultMessage{Error: reason})
+}
+
+// sendResult fills in the job and the worker of result and sends it to the
+// reply queue of the job.
+func (w *worker) sendResult(ctx context.Context, job utils.JobMessage, result utils.ResultMessage) error {
+	result.JobID = job.JobID
+	result.Key = job.Key
+	result.Range = job.Range
+	result.WorkerID = w.id
+	result.Instance = w.identity
+	body, err := utils.EncodeResult(result)
+	if err != nil {
+		return err
+	}
+	queueURL, err := w.replyQueueURL(ctx, job.ReplyTo)
+	if err != nil {
+		return err
+	}
+	input := &sqs.SendMessageInput{
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"JobId": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(job.JobID.String()),
+			},
+		},
+		MessageBody: aws.String(body),
+		QueueUrl:    &queueURL,
+	}
+	utils.SetFIFOParams(input, utils.ReplyDeduplicationID(job.JobID, job.Range, w.delivery), utils.DeduplicationID(job.JobID, job.Range))
+	_, err = utils.SendMsg(ctx, w.sqsClient, input)
+	if err != nil {
+		return utils.WrapError("SendMessage", queueURL, err)
+	}
+	return nil
+}
+
+// replyQueueURL returns the URL of the queue named name, or of the result queue
+// of the worker if name is empty.
+func (w *worker) replyQueueURL(ctx context.Context, name string) (string, error) {
+	if name == "" {
+		return w.outQueueURL, nil
+	}
+	if url, ok := w.replyQueueURLs[name]; ok {
+		return url, nil
+	}
+	url, err := utils.GetQueueURLSimple(ctx, w.sqsClient, name)
+	if err != nil {
+		return "", err
+	}
+	w.replyQueueURLs[name] = url
+	return url, nil
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"wordcounter/src/counter"
+	"wordcounter/src/fakeaws"
+	"wordcounter/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+func TestMain(m *testing.M) {
+	utils.SetLogger(nil)
+	os.Exit(m.Run())
+}
+
+// newTestWorker returns a worker of role using the fake clients, with the
+// queues and buckets of testConfig.
+func newTestWorker(role string, sqsClient *fakeaws.SQS, s3Client *fakeaws.S3) *worker {
+	cfg := testConfig()
+	return &worker{
+		cfg:       cfg,
+		log:       utils.NewJSONLogger(ioutil.Discard, utils.LevelError+1),
+		id:        "test-" + role,
+		role:      role,
+		sqsClient: sqsClient,
+		s3Client:  s3Client,
+
+		visibility:  time.Minute,
+		grace:       50 * time.Millisecond,
+		maxReceives: utils.DefaultMaxReceiveCount,
+		cancelCheck: 10 * time.Millisecond,
+
+		in:                queue{name: cfg.JobQueueName, url: fakeaws.QueueURL(cfg.JobQueueName)},
+		outQueueURL:       fakeaws.QueueURL(cfg.ResultQueueName),
+		subJobQueueURL:    fakeaws.QueueURL(cfg.SubJobQueueName),
+		subResultQueueURL: fakeaws.QueueURL(cfg.SubResultQueueName),
+
+		replyQueueURLs: make(map[string]string),
+		finished:       make(map[utils.JobID]time.Time),
+	}
+}
+
+func testConfig() utils.Config {
+	return utils.Config{
+		DataBucketName:     "data",
+		ResultBucketName:   "results",
+		JobQueueName:       "jobs",
+		ResultQueueName:    "results",
+		SubJobQueueName:    "subjobs",
+		SubResultQueueName: "subresults",
+	}
+}
+
+// putCounts stores counts as key in bucket.
+func putCounts(t *testing.T, client *fakeaws.S3, bucket string, key string, counts map[string]int) {
+	t.Helper()
+	data, _ := json.Marshal(counts)
+	_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{Bucket: &bucket, Key: &key, Body: bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendResult sends the report of result to the queue named queue.
+func sendResult(t *testing.T, client *fakeaws.SQS, queue string, result utils.ResultMessage) {
+	t.Helper()
+	body, err := utils.EncodeResult(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.SendMessage(context.TODO(), &sqs.SendMessageInput{QueueUrl: aws.String(fakeaws.QueueURL(queue)), MessageBody: &body})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_countJobDuplicate(t *testing.T) {
+	sqsClient := fakeaws.NewSQS("results")
+	// The object is gone, the job can only be done from its stored counts
+	s3Client := fakeaws.NewS3("data", "results")
+	w := newTestWorker(roleWorker, sqsClient, s3Client)
+	w.identity = &utils.Identity{InstanceID: "i-0001", PrivateIP: "10.0.0.1"}
+	job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "alice30.txt", Range: &utils.ByteRange{Start: 0, End: 100}}
+	resultKey := utils.ResultKey(job.JobID, job.Range)
+	putCounts(t, s3Client, "results", resultKey, map[string]int{"alice": 1})
+
+	if err := w.countJob(context.TODO(), job); err != nil {
+		t.Fatalf("countJob() error = %v", err)
+	}
+	msgs := sqsClient.Messages("results")
+	if len(msgs) != 1 {
+		t.Fatalf("countJob() sent %d results, want 1", len(msgs))
+	}
+	result, err := utils.DecodeResult(*msgs[0].Body)
+	if err != nil || result.JobID != job.JobID || result.ResultKey != resultKey {
+		t.Errorf("countJob() reported %+v, %v, want %s", result, err, resultKey)
+	}
+	if !reflect.DeepEqual(result.Instance, w.identity) {
+		t.Errorf("countJob() reported instance %+v, want %+v", result.Instance, w.identity)
+	}
+}
+
+// receiveJob sends a job message to the input queue of w and receives it.
+func receiveJob(t *testing.T, w *worker, client *fakeaws.SQS, job utils.JobMessage) types.Message {
+	t.Helper()
+	body, err := utils.EncodeJob(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SendMessage(context.TODO(), &sqs.SendMessageInput{QueueUrl: &w.in.url, MessageBody: &body}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := utils.GetLPMessagesByURL(context.TODO(), client, w.in.url, 1, 0)
+	if err != nil || len(resp.Messages) != 1 {
+		t.Fatalf("GetLPMessagesByURL() = %v, %v, want 1 message", resp, err)
+	}
+	return resp.Messages[0]
+}
+
+func Test_processShutdown(t *testing.T) {
+	tests := []struct {
+		name string
+		// work is how long the job takes, unless its context is done first
+		work time.Duration
+		// requeued is whether the message is visible again after the job
+		requeued bool
+		status   utils.JobStatus
+	}{
+		{"FinishedInGrace", 10 * time.Millisecond, false, utils.StatusSucceeded},
+		{"Abandoned", time.Minute, true, utils.StatusQueued},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqsClient := fakeaws.NewSQS("jobs")
+			s3Client := fakeaws.NewS3("results")
+			w := newTestWorker(roleWorker, sqsClient, s3Client)
+			job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "alice30.txt"}
+			msg := receiveJob(t, w, sqsClient, job)
+
+			// The worker is stopping as the job starts
+			ctx, stop := context.WithCancel(context.Background())
+			stop()
+			start := time.Now()
+			w.process(ctx, w.in, msg, func(ctx context.Context, job utils.JobMessage) error {
+				select {
+				case <-time.After(tt.work):
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if elapsed := time.Since(start); elapsed > 10*w.grace {
+				t.Errorf("process() took %v with a grace period of %v", elapsed, w.grace)
+			}
+			resp, err := utils.GetLPMessagesByURL(context.TODO(), sqsClient, w.in.url, 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if requeued := len(resp.Messages) == 1; requeued != tt.requeued {
+				t.Errorf("message visible after process() = %v, want %v", requeued, tt.requeued)
+			}
+			state, err := utils.LoadJobState(context.TODO(), s3Client, "results", job.JobID)
+			if err != nil || state == nil || state.Status != tt.status || state.WorkerID != w.id {
+				t.Errorf("LoadJobState() = %+v, %v, want %s by %s", state, err, tt.status, w.id)
+			}
+		})
+	}
+}
+
+func Test_processCancelled(t *testing.T) {
+	tests := []struct {
+		name string
+		// before is whether the job is cancelled before it starts, rather than while it runs
+		before  bool
+		wantRan bool
+	}{
+		{"BeforeStart", true, false},
+		{"WhileRunning", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqsClient := fakeaws.NewSQS("jobs")
+			s3Client := fakeaws.NewS3("results")
+			w := newTestWorker(roleWorker, sqsClient, s3Client)
+			job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "alice30.txt"}
+			cpKey := utils.CheckpointKey(job.JobID, nil)
+			if err := utils.SaveCheckpoint(context.TODO(), s3Client, "results", cpKey, utils.Checkpoint{JobID: job.JobID}); err != nil {
+				t.Fatal(err)
+			}
+			state := utils.JobState{JobID: job.JobID}
+			state.Set(utils.StatusQueued, "", "", time.Now())
+			if err := utils.SaveJobState(context.TODO(), s3Client, "results", state); err != nil {
+				t.Fatal(err)
+			}
+			cancel := func() {
+				if _, err := utils.CancelJob(context.TODO(), s3Client, "results", job.JobID, time.Now()); err != nil {
+					t.Error(err)
+				}
+			}
+			if tt.before {
+				cancel()
+			}
+			msg := receiveJob(t, w, sqsClient, job)
+
+			ran := false
+			w.process(context.Background(), w.in, msg, func(ctx context.Context, job utils.JobMessage) error {
+				ran = true
+				cancel()
+				select {
+				case <-time.After(5 * time.Second):
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if ran != tt.wantRan {
+				t.Errorf("job ran = %v, want %v", ran, tt.wantRan)
+			}
+			if n := len(sqsClient.Messages("jobs")); n != 0 {
+				t.Errorf("%d messages left in the job queue, want 0", n)
+			}
+			if exists, _ := utils.ObjectExists(context.TODO(), s3Client, cpKey, "results"); exists {
+				t.Error("checkpoint of the cancelled job not deleted")
+			}
+			loaded, err := utils.LoadJobState(context.TODO(), s3Client, "results", job.JobID)
+			if err != nil || loaded == nil || loaded.Status != utils.StatusCancelled {
+				t.Errorf("LoadJobState() = %+v, %v, want cancelled", loaded, err)
+			}
+		})
+	}
+}
+
+func Test_processExpired(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		wantRan  bool
+	}{
+		{"BeforeStart", -time.Second, false},
+		{"WhileRunning", 50 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqsClient := fakeaws.NewSQS("jobs")
+			s3Client := fakeaws.NewS3("results")
+			w := newTestWorker(roleWorker, sqsClient, s3Client)
+			deadline := time.Now().Add(tt.deadline)
+			job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "alice30.txt", Deadline: &deadline}
+			msg := receiveJob(t, w, sqsClient, job)
+
+			ran := false
+			w.process(context.Background(), w.in, msg, func(ctx context.Context, job utils.JobMessage) error {
+				ran = true
+				select {
+				case <-time.After(5 * time.Second):
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if ran != tt.wantRan {
+				t.Errorf("job ran = %v, want %v", ran, tt.wantRan)
+			}
+			if n := len(sqsClient.Messages("jobs")); n != 0 {
+				t.Errorf("%d messages left in the job queue, want 0", n)
+			}
+			state, err := utils.LoadJobState(context.TODO(), s3Client, "results", job.JobID)
+			if err != nil || state == nil || state.Status != utils.StatusExpired {
+				t.Errorf("LoadJobState() = %+v, %v, want expired", state, err)
+			}
+		})
+	}
+}
+
+func Test_processClaim(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		timeout time.Duration
+		// attempts is the Attempts attribute of the message, if any
+		attempts string
+		fail     bool
+		wantRan  bool
+		wantDead bool
+	}{
+		{name: "Unaddressed", timeout: time.Minute, wantRan: true},
+		{name: "Addressed", target: "test-worker", timeout: time.Minute, wantRan: true},
+		{name: "Other", target: "other", timeout: time.Minute},
+		{name: "OtherGone", target: "other", timeout: time.Nanosecond, wantRan: true},
+		{name: "AddressedRetried", target: "test-worker", timeout: time.Minute, attempts: "0", fail: true, wantRan: true},
+		// The put-backs do not count, the attempts of the earlier copies do
+		{name: "AddressedPoison", target: "test-worker", timeout: time.Minute, attempts: "1", fail: true, wantRan: true, wantDead: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqsClient := fakeaws.NewSQS("jobs", "dlq")
+			w := newTestWorker(roleWorker, sqsClient, fakeaws.NewS3("results"))
+			w.routing, w.routingTimeout = utils.RoutingClaim, tt.timeout
+			w.dlqURL, w.maxReceives = fakeaws.QueueURL("dlq"), 2
+			job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "alice30.txt"}
+			body, err := utils.EncodeJob(job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attrs := map[string]types.MessageAttributeValue{
+				"WorkerId": {DataType: aws.String("String"), StringValue: aws.String(tt.target)},
+			}
+			if tt.attempts != "" {
+				attrs[utils.AttrAttempts] = types.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String(tt.attempts)}
+			}
+			_, err = sqsClient.SendMessage(context.TODO(), &sqs.SendMessageInput{
+				QueueUrl:          &w.in.url,
+				MessageBody:       &body,
+				MessageAttributes: attrs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := utils.GetLPMessagesByURL(context.TODO(), sqsClient, w.in.url, 1, 0)
+			if err != nil || len(resp.Messages) != 1 {
+				t.Fatalf("GetLPMessagesByURL() = %v, %v, want 1 message", resp, err)
+			}
+			sent := utils.SentTime(resp.Messages[0])
+
+			ran := false
+			w.process(context.Background(), w.in, resp.Messages[0], func(ctx context.Context, job utils.JobMessage) error {
+				ran = true
+				if tt.fail {
+					return errors.New("boom")
+				}
+				return nil
+			})
+			if ran != tt.wantRan {
+				t.Errorf("job ran = %v, want %v", ran, tt.wantRan)
+			}
+			if dead := len(sqsClient.Messages("dlq")) == 1; dead != tt.wantDead {
+				t.Errorf("job dead-lettered = %v, want %v", dead, tt.wantDead)
+			}
+			// The job done or dead-lettered is deleted, the others are left
+			left := sqsClient.Messages("jobs")
+			if len(left) == 0 != (tt.wantRan && !tt.fail || tt.wantDead) {
+				t.Errorf("%d messages left in the job queue", len(left))
+			}
+			// The copy put back keeps the attempts and the send time of the job
+			if !tt.wantRan && len(left) == 1 {
+				put := left[0]
+				if got := utils.Attempts(put); got != 0 {
+					t.Errorf("Attempts() of the copy put back = %d, want 0", got)
+				}
+				if got := utils.SentTime(put); !got.Equal(sent.Truncate(time.Millisecond)) {
+					t.Errorf("SentTime() of the copy put back = %v, want %v", got, sent)
+				}
+			}
+		})
+	}
+}
+
+func Test_runOwnQueue(t *testing.T) {
+	sqsClient := fakeaws.NewSQS("jobs", "jobs-test-worker")
+	w := newTestWorker(roleWorker, sqsClient, fakeaws.NewS3("results"))
+	w.routing = utils.RoutingQueue
+	w.own = queue{name: "jobs-test-worker", url: fakeaws.QueueURL("jobs-test-worker")}
+	for _, q := range []queue{w.in, w.own} {
+		body, err := utils.EncodeJob(utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: q.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sqsClient.SendMessage(context.TODO(), &sqs.SendMessageInput{QueueUrl: &q.url, MessageBody: &body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The job addressed to the worker comes first
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	var got []string
+	w.run(ctx, func(ctx context.Context, job utils.JobMessage) error {
+		got = append(got, job.Key)
+		if len(got) == 2 {
+			stop()
+		}
+		return nil
+	})
+	if want := []string{"jobs-test-worker", "jobs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("run() did the jobs of %v, want %v", got, want)
+	}
+
+	// The jobs left are handed over to the other workers
+	body, _ := utils.EncodeJob(utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "left"})
+	if _, err := sqsClient.SendMessage(context.TODO(), &sqs.SendMessageInput{QueueUrl: &w.own.url, MessageBody: &body}); err != nil {
+		t.Fatal(err)
+	}
+	s3Client := w.s3Client
+	w.saveLease(context.TODO(), time.Now(), utils.LeaseTTL)
+	w.handOver()
+	if lease, err := utils.LoadWorkerLease(context.TODO(), s3Client, "results", w.own.name); err != nil || lease == nil || lease.Alive(time.Now()) {
+		t.Errorf("lease after handOver() = %+v, %v, want an expired lease", lease, err)
+	}
+	if n := len(sqsClient.Messages(w.own.name)); n != 0 {
+		t.Errorf("%d messages left in the queue of the worker after handOver()", n)
+	}
+	if msgs := sqsClient.Messages("jobs"); len(msgs) != 1 || aws.ToString(msgs[0].Body) != body {
+		t.Errorf("job queue after handOver() = %v, want the job left", msgs)
+	}
+}
+
+func Test_runStops(t *testing.T) {
+	sqsClient := fakeaws.NewSQS("jobs")
+	w := newTestWorker(roleWorker, sqsClient, fakeaws.NewS3())
+	w.waitTime = 20
+	ctx, stop := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		w.run(ctx, func(ctx context.Context, job utils.JobMessage) error { return nil })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run() did not return once its context was done")
+	}
+}
+
+// failingS3 fails the reads of the objects it gets after failAfter bytes, once.
+type failingS3 struct {
+	*fakeaws.S3
+	failAfter int64
+	failed    bool
+}
+
+func (c *failingS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	out, err := c.S3.GetObject(ctx, params, optFns...)
+	if err != nil || c.failed {
+		return out, err
+	}
+	c.failed = true
+	out.Body = ioutil.NopCloser(io.MultiReader(io.LimitReader(out.Body, c.failAfter), errReader{}))
+	return out, nil
+}
+
+// errReader fails every read, like a connection reset.
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) { return 0, errors.New("connection reset by peer") }
+
+func Test_countJobResume(t *testing.T) {
+	text, err := ioutil.ReadFile("../../alice30.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(text))
+	tests := []struct {
+		name string
+		rng  *utils.ByteRange
+	}{
+		{"WholeObject", nil},
+		{"Range", &utils.ByteRange{Start: 1000, End: size - 1000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3Client := fakeaws.NewS3("data", "results")
+			if _, err := s3Client.PutObject(context.TODO(), &s3.PutObjectInput{Bucket: aws.String("data"), Key: aws.String("alice30.txt"), Body: bytes.NewReader(text)}); err != nil {
+				t.Fatal(err)
+			}
+			failing := &failingS3{S3: s3Client, failAfter: size / 2}
+			w := newTestWorker(roleWorker, fakeaws.NewSQS("results"), s3Client)
+			w.s3Client = failing
+			w.checkpointEvery = time.Nanosecond
+			job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "alice30.txt", Range: tt.rng}
+			cpKey := utils.CheckpointKey(job.JobID, job.Range)
+
+			if err := w.countJob(context.TODO(), job); err == nil {
+				t.Fatal("countJob() of a failing read succeeded")
+			}
+			cp, err := utils.LoadCheckpoint(context.TODO(), s3Client, "results", cpKey)
+			if err != nil || cp == nil {
+				t.Fatalf("LoadCheckpoint() = %v, %v, want a checkpoint", cp, err)
+			}
+			failedAt := size / 2
+			if tt.rng != nil {
+				failedAt += tt.rng.Start
+			}
+			if cp.Offset > failedAt || cp.Offset < failedAt-100 {
+				t.Errorf("checkpoint offset = %d, want the last word boundary before %d", cp.Offset, failedAt)
+			}
+
+			if err := w.countJob(context.TODO(), job); err != nil {
+				t.Fatalf("countJob() after the checkpoint error = %v", err)
+			}
+			part := text
+			if tt.rng != nil {
+				part = text[tt.rng.Start:tt.rng.End]
+			}
+			want, _ := counter.Count(bytes.NewReader(part), job.Options)
+			var got map[string]int
+			data, _ := s3Client.Object("results", utils.ResultKey(job.JobID, job.Range))
+			if err := json.Unmarshal(data, &got); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("resumed counts differ from the counts of the whole text (%d words, want %d)", len(got), len(want))
+			}
+			if _, ok := s3Client.Object("results", cpKey); ok {
+				t.Errorf("checkpoint %s left after the job", cpKey)
+			}
+		})
+	}
+}
+
+func Test_countJobStaleCheckpoint(t *testing.T) {
+	s3Client := fakeaws.NewS3("data", "results")
+	if _, err := s3Client.PutObject(context.TODO(), &s3.PutObjectInput{Bucket: aws.String("data"), Key: aws.String("a.txt"), Body: strings.NewReader("the cat and the hat")}); err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWorker(roleWorker, fakeaws.NewSQS("results"), s3Client)
+	job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "a.txt"}
+	// A checkpoint of another version of the object
+	cp := utils.Checkpoint{JobID: job.JobID, ETag: `"stale"`, Offset: 8, Counts: map[string]int{"dog": 2}}
+	if err := utils.SaveCheckpoint(context.TODO(), s3Client, "results", utils.CheckpointKey(job.JobID, nil), cp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.countJob(context.TODO(), job); err != nil {
+		t.Fatalf("countJob() error = %v", err)
+	}
+	var got map[string]int
+	data, _ := s3Client.Object("results", utils.ResultKey(job.JobID, nil))
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"the": 2, "cat": 1, "and": 1, "hat": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("countJob() counted %v, want %v", got, want)
+	}
+}
+
+func Test_countJobCheckpointAtEnd(t *testing.T) {
+	text := "the cat and the hat "
+	tests := []struct {
+		name string
+		rng  *utils.ByteRange
+		end  int64
+	}{
+		// The text ends with a space, so the last boundary is its end
+		{"WholeObject", nil, int64(len(text))},
+		{"Range", &utils.ByteRange{Start: 0, End: 8}, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3Client := fakeaws.NewS3("data", "results")
+			if _, err := s3Client.PutObject(context.TODO(), &s3.PutObjectInput{Bucket: aws.String("data"), Key: aws.String("a.txt"), Body: strings.NewReader(text)}); err != nil {
+				t.Fatal(err)
+			}
+			info, err := s3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{Bucket: aws.String("data"), Key: aws.String("a.txt")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := newTestWorker(roleWorker, fakeaws.NewSQS("results"), s3Client)
+			job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "a.txt", Range: tt.rng}
+			cpKey := utils.CheckpointKey(job.JobID, job.Range)
+			counts := map[string]int{"the": 1, "cat": 1}
+			cp := utils.Checkpoint{JobID: job.JobID, Range: job.Range, ETag: aws.ToString(info.ETag), Offset: tt.end, Counts: counts}
+			if err := utils.SaveCheckpoint(context.TODO(), s3Client, "results", cpKey, cp); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := w.countJob(context.TODO(), job); err != nil {
+				t.Fatalf("countJob() error = %v", err)
+			}
+			var got map[string]int
+			data, _ := s3Client.Object("results", utils.ResultKey(job.JobID, job.Range))
+			if err := json.Unmarshal(data, &got); err != nil || !reflect.DeepEqual(got, counts) {
+				t.Errorf("countJob() counted %v, %v, want the counts of the checkpoint %v", got, err, counts)
+			}
+			if _, ok := s3Client.Object("results", cpKey); ok {
+				t.Errorf("checkpoint %s left after the job", cpKey)
+			}
+		})
+	}
+}
+
+func Test_reportResultRedelivered(t *testing.T) {
+	sqsClient := fakeaws.NewSQS("results.fifo")
+	w := newTestWorker(roleSub, sqsClient, fakeaws.NewS3("results"))
+	w.outQueueURL = fakeaws.QueueURL("results.fifo")
+	job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "a.txt", Range: &utils.ByteRange{Start: 0, End: 8}}
+	resultKey := utils.ResultKey(job.JobID, job.Range)
+
+	deliveries := []struct {
+		delivery string
+		want     int
+	}{
+		{"m1-1", 1},
+		// The same delivery reports once
+		{"m1-1", 1},
+		// The job redelivered, or sent again by a redelivered master
+		{"m1-2", 2},
+		{"m2-1", 3},
+	}
+	for _, d := range deliveries {
+		w.delivery = d.delivery
+		if err := w.reportResult(context.TODO(), job, resultKey); err != nil {
+			t.Fatalf("reportResult() error = %v", err)
+		}
+		if got := len(sqsClient.Messages("results.fifo")); got != d.want {
+			t.Errorf("after the report of delivery %s, %d results queued, want %d", d.delivery, got, d.want)
+		}
+	}
+}
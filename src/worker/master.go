@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"wordcounter/src/counter"
+	"wordcounter/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// minSnapWindow is the number of bytes first read to find a word boundary.
+	minSnapWindow = 4 << 10
+	// maxSnapWindow is the most bytes read to find a word boundary, the
+	// master looks further on when there is none in that window.
+	maxSnapWindow = 1 << 20
+	// finishedTTL is how long the master drops the late partial results of a
+	// job it reduced, those arriving later go back to the queue.
+	finishedTTL = time.Hour
+)
+
+// fetchFunc reads length bytes of an object from offset.
+type fetchFunc func(offset int64, length int64) ([]byte, error)
+
+// splitJob splits the object, or the byte range of it, named by a job into
+// smaller ranges, has them counted as sub-jobs by the sub workers, and
+// publishes the sum of their counts as the result of the job.
+func (w *worker) splitJob(ctx context.Context, job utils.JobMessage) error {
+	resultKey := utils.ResultKey(job.JobID, job.Range)
+	if done, err := w.reportExisting(ctx, job, resultKey); done || err != nil {
+		return err
+	}
+	whole := utils.ByteRange{}
+	if job.Range != nil {
+		whole = *job.Range
+	} else {
+		info, err := utils.GetObjectInfo(ctx, w.s3Client, &s3.HeadObjectInput{
+			Bucket: &job.Bucket,
+			Key:    &job.Key,
+		})
+		if err != nil {
+			return utils.WrapError("HeadObject", utils.ObjectName(job.Bucket, job.Key), err)
+		}
+		whole.End = info.ContentLength
+	}
+	ranges, err := splitRanges(whole, w.chunkSize, func(offset int64, length int64) ([]byte, error) {
+		return w.fetchBytes(ctx, job.Bucket, job.Key, offset, length)
+	})
+	if err != nil {
+		return err
+	}
+	w.log.Info("splitting job", utils.LogKeyJobID, job.JobID, utils.LogKeyBucket, job.Bucket, utils.LogKeyKey, job.Key, "range", whole, "sub_jobs", len(ranges))
+
+	pending := make(map[utils.ByteRange]bool, len(ranges))
+	for _, rng := range ranges {
+		sub := job
+		sub.Range = &utils.ByteRange{Start: rng.Start, End: rng.End}
+		sub.ReplyTo = w.cfg.SubResultQueueName
+		sub.Submitter = w.id
+		body, err := utils.EncodeJob(sub)
+		if err != nil {
+			return err
+		}
+		input := &sqs.SendMessageInput{
+			MessageAttributes: map[string]types.MessageAttributeValue{
+				"JobId": {
+					DataType:    aws.String("String"),
+					StringValue: aws.String(job.JobID.String()),
+				},
+			},
+			MessageBody: aws.String(body),
+			QueueUrl:    &w.subJobQueueURL,
+		}
+		utils.SetFIFOParams(input, utils.ReplyDeduplicationID(sub.JobID, sub.Range, w.delivery), utils.MessageGroupID(sub))
+		_, err = utils.SendMsg(ctx, w.sqsClient, input)
+		if err != nil {
+			return utils.WrapError("SendMessage", w.subJobQueueURL, err)
+		}
+		pending[rng] = true
+	}
+	w.setState(ctx, job, utils.StatusRunning, "", func(state *utils.JobState) {
+		state.SubJobs = &utils.SubJobProgress{Total: len(ranges), Pending: ranges}
+	})
+
+	total, err := w.reduce(ctx, job, pending)
+	if err != nil {
+		return err
+	}
+	if err = w.publishResult(ctx, job, resultKey, total); err != nil {
+		return err
+	}
+	w.log.Info("finished job", utils.LogKeyJobID, job.JobID, "words", len(total), "result", resultKey)
+	w.finish(job.JobID)
+	w.deletePartials(ctx, job.JobID, resultKey)
+	return nil
+}
+
+// reduce collects the partial counts of the pending sub-jobs of a job from the
+// sub-result queue and returns their sum, recording the progress in the state
+// of the job. Every range is added once, however many times its sub-job was
+// delivered and reported.
+func (w *worker) reduce(ctx context.Context, job utils.JobMessage, pending map[utils.ByteRange]bool) (map[string]int, error) {
+	jobID := job.JobID
+	subJobs := len(pending)
+	total := make(map[string]int)
+	added := make(map[utils.ByteRange]bool, len(pending))
+	var deadline time.Time
+	if w.subJobTimeout > 0 {
+		deadline = time.Now().Add(w.subJobTimeout)
+	}
+	for len(pending) > 0 {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, fmt.Errorf("no sub-job result within %s, %d of %d sub-jobs left", w.subJobTimeout, len(pending), subJobs)
+		}
+		// A batch, so that the results released for the other masters do
+		// not keep those of the job from the master
+		resp, err := utils.GetLPMessagesByURL(ctx, w.sqsClient, w.subResultQueueURL, 10, w.waitTime)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			w.log.Warn("failed to receive messages", utils.LogKeyQueue, w.cfg.SubResultQueueName, utils.LogKeyError, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, msg := range resp.Messages {
+			result, err := utils.DecodeResult(aws.ToString(msg.Body))
+			if err == nil && (w.reduced(result.JobID) || result.JobID == jobID && result.Range != nil && added[*result.Range]) {
+				w.log.Debug("dropped duplicate partial result", utils.LogKeyJobID, result.JobID, "range", result.Range)
+				if err := utils.RemoveMessageSimple(ctx, w.sqsClient, w.subResultQueueURL, *msg.ReceiptHandle); err != nil {
+					w.log.Error("failed to delete message", utils.LogKeyQueue, w.cfg.SubResultQueueName, utils.LogKeyError, err)
+				}
+				continue
+			}
+			if err != nil {
+				// It becomes visible again once its visibility timeout expires
+				w.log.Warn("dropped malformed partial result", utils.LogKeyQueue, w.cfg.SubResultQueueName, utils.LogKeyError, err)
+				continue
+			}
+			if result.JobID != jobID || result.Range == nil || !pending[*result.Range] {
+				// Partial result of the job of another master, it is made
+				// visible again for that master to receive it now
+				if err := utils.ChangeVisibilitySimple(ctx, w.sqsClient, w.subResultQueueURL, *msg.ReceiptHandle, 0); err != nil {
+					w.log.Warn("failed to release message", utils.LogKeyJobID, result.JobID, utils.LogKeyQueue, w.cfg.SubResultQueueName, utils.LogKeyError, err)
+				}
+				continue
+			}
+			if result.Error != "" {
+				if err := utils.RemoveMessageSimple(ctx, w.sqsClient, w.subResultQueueURL, *msg.ReceiptHandle); err != nil {
+					w.log.Error("failed to delete message", utils.LogKeyQueue, w.cfg.SubResultQueueName, utils.LogKeyError, err)
+				}
+				return nil, fmt.Errorf("sub-job %s failed: %s", result.Range, result.Error)
+			}
+			counts, err := utils.FetchCounts(ctx, w.s3Client, result)
+			if err != nil {
+				w.log.Error("failed to fetch partial counts", utils.LogKeyJobID, jobID, "range", result.Range, utils.LogKeyError, err)
+				continue
+			}
+			counter.Merge(total, counts)
+			delete(pending, *result.Range)
+			added[*result.Range] = true
+			w.log.Info("got sub-job result", utils.LogKeyJobID, jobID, "range", result.Range, "from", result.WorkerID, "left", len(pending))
+			if !deadline.IsZero() {
+				deadline = time.Now().Add(w.subJobTimeout)
+			}
+			w.setState(ctx, job, utils.StatusRunning, "", func(state *utils.JobState) {
+				state.SubJobs = &utils.SubJobProgress{Total: subJobs, Done: subJobs - len(pending), Pending: sortedRanges(pending)}
+			})
+			if err := utils.RemoveMessageSimple(ctx, w.sqsClient, w.subResultQueueURL, *msg.ReceiptHandle); err != nil {
+				w.log.Error("failed to delete message", utils.LogKeyQueue, w.cfg.SubResultQueueName, utils.LogKeyError, err)
+			}
+		}
+	}
+	return total, nil
+}
+
+// finish records that the master is done with the job jobID, and forgets the
+// jobs it was done with more than finishedTTL ago.
+func (w *worker) finish(jobID utils.JobID) {
+	now := time.Now()
+	for id, at := range w.finished {
+		if now.Sub(at) > finishedTTL {
+			delete(w.finished, id)
+		}
+	}
+	w.finished[jobID] = now
+}
+
+// reduced reports whether the master was done with the job jobID within
+// finishedTTL.
+func (w *worker) reduced(jobID utils.JobID) bool {
+	at, ok := w.finished[jobID]
+	return ok && time.Since(at) <= finishedTTL
+}
+
+// sortedRanges returns the ranges of pending in order.
+func sortedRanges(pending map[utils.ByteRange]bool) []utils.ByteRange {
+	ranges := make([]utils.ByteRange, 0, len(pending))
+	for rng := range pending {
+		ranges = append(ranges, rng)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	return ranges
+}
+
+// deletePartials deletes the partial counts of the sub-jobs of a job once it is
+// done, including those written by duplicate deliveries of the sub-jobs, but
+// not its result stored as resultKey.
+func (w *worker) deletePartials(ctx context.Context, jobID utils.JobID, resultKey string) {
+	bucket := w.cfg.ResultBucketName
+	keys, err := utils.ListObjectKeys(ctx, w.s3Client, bucket, utils.PartialResultPrefix(jobID))
+	if err != nil {
+		w.log.Warn("failed to list partial counts", utils.LogKeyJobID, jobID, utils.LogKeyError, err)
+	}
+	for _, key := range keys {
+		if key == resultKey {
+			continue
+		}
+		if err := utils.DeleteObjectSimple(ctx, w.s3Client, key, bucket); err != nil {
+			w.log.Warn("failed to delete partial counts", utils.LogKeyBucket, bucket, utils.LogKeyKey, key, utils.LogKeyError, err)
+		}
+	}
+}
+
+// fetchBytes reads length bytes of an object from offset.
+func (w *worker) fetchBytes(ctx context.Context, bucket string, key string, offset int64, length int64) ([]byte, error) {
+	obj, err := utils.GetObject(ctx, w.s3Client, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, utils.WrapError("GetObject", fmt.Sprintf("%s bytes %d-%d", utils.ObjectName(bucket, key), offset, offset+length), err)
+	}
+	defer obj.Body.Close()
+	return ioutil.ReadAll(obj.Body)
+}
+
+// splitRanges cuts the range whole of an object into ranges of about chunkSize
+// bytes. Every cut is moved forward to the next word boundary, so that the counts
+// of the ranges add up to the counts of the whole range.
+func splitRanges(whole utils.ByteRange, chunkSize int64, fetch fetchFunc) ([]utils.ByteRange, error) {
+	var ranges []utils.ByteRange
+	start := whole.Start
+	for start < whole.End {
+		end := whole.End
+		for next := start + chunkSize; next < whole.End; next += chunkSize {
+			boundary, err := snapBoundary(next, whole.End, fetch)
+			if err != nil {
+				return nil, err
+			}
+			if boundary >= 0 {
+				end = boundary
+				break
+			}
+		}
+		ranges = append(ranges, utils.ByteRange{Start: start, End: end})
+		start = end
+	}
+	return ranges, nil
+}
+
+// snapBoundary returns the first word boundary at or after offset and before
+// end, reading up to maxSnapWindow bytes, or -1 if there is none.
+func snapBoundary(offset int64, end int64, fetch fetchFunc) (int64, error) {
+	for window := int64(minSnapWindow); window <= maxSnapWindow; window *= 2 {
+		length := window
+		if offset+length > end {
+			length = end - offset
+		}
+		p, err := fetch(offset, length)
+		if err != nil {
+			return -1, err
+		}
+		if i := counter.NextBoundary(p); i >= 0 {
+			return offset + int64(i), nil
+		}
+		if offset+length >= end {
+			break
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"wordcounter/src/counter"
+	"wordcounter/src/fakeaws"
+	"wordcounter/src/utils"
+)
+
+func Test_splitRanges(t *testing.T) {
+	text, err := ioutil.ReadFile("../../alice30.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(text))
+	fetch := func(offset int64, length int64) ([]byte, error) {
+		return text[offset : offset+length], nil
+	}
+	want, _ := counter.Count(bytes.NewReader(text), counter.Options{})
+
+	tests := []struct {
+		name      string
+		chunkSize int64
+		wantMin   int
+	}{
+		{name: "WholeObject", chunkSize: size * 2, wantMin: 1},
+		{name: "ExactSize", chunkSize: size, wantMin: 1},
+		{name: "SmallChunks", chunkSize: 10000, wantMin: 14},
+		{name: "TinyChunks", chunkSize: 7, wantMin: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := splitRanges(utils.ByteRange{End: size}, tt.chunkSize, fetch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ranges) < tt.wantMin {
+				t.Errorf("splitRanges() returned %d ranges, want at least %d", len(ranges), tt.wantMin)
+			}
+			got := make(map[string]int)
+			start := int64(0)
+			for _, rng := range ranges {
+				if rng.Start != start || rng.End <= rng.Start {
+					t.Fatalf("range %s does not follow offset %d", rng, start)
+				}
+				part, _ := counter.Count(bytes.NewReader(text[rng.Start:rng.End]), counter.Options{})
+				counter.Merge(got, part)
+				start = rng.End
+			}
+			if start != size {
+				t.Errorf("ranges end at %d, want %d", start, size)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("counts of the ranges differ from the counts of the whole object")
+			}
+		})
+	}
+}
+
+func Test_splitRangesWithoutBoundary(t *testing.T) {
+	text := bytes.Repeat([]byte("x"), 3*maxSnapWindow)
+	fetch := func(offset int64, length int64) ([]byte, error) {
+		return text[offset : offset+length], nil
+	}
+	ranges, err := splitRanges(utils.ByteRange{End: int64(len(text))}, maxSnapWindow/2, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []utils.ByteRange{{Start: 0, End: int64(len(text))}}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("splitRanges() = %v, want %v", ranges, want)
+	}
+}
+
+func Test_reduceDuplicates(t *testing.T) {
+	sqsClient := fakeaws.NewSQS("subresults")
+	s3Client := fakeaws.NewS3("results")
+	w := newTestWorker(roleMaster, sqsClient, s3Client)
+	ctx := context.TODO()
+
+	jobID := utils.NewJobID()
+	ranges := []utils.ByteRange{{Start: 0, End: 10}, {Start: 10, End: 20}}
+	parts := []map[string]int{{"alice": 1, "rabbit": 2}, {"alice": 3}}
+	pending := make(map[utils.ByteRange]bool)
+	for i := range ranges {
+		rng := ranges[i]
+		pending[rng] = true
+		key := utils.ResultKey(jobID, &rng)
+		putCounts(t, s3Client, "results", key, parts[i])
+		result := utils.ResultMessage{JobID: jobID, Range: &rng, ResultBucket: "results", ResultKey: key}
+		// Each sub-job is reported twice, and the first report delivered twice
+		if i == 0 {
+			sqsClient.DuplicateNext(1)
+		}
+		sendResult(t, sqsClient, "subresults", result)
+		sendResult(t, sqsClient, "subresults", result)
+	}
+
+	total, err := w.reduce(ctx, utils.JobMessage{JobID: jobID, Bucket: "data", Key: "alice30.txt"}, pending)
+	if err != nil {
+		t.Fatalf("reduce() error = %v", err)
+	}
+	if want := map[string]int{"alice": 4, "rabbit": 2}; !reflect.DeepEqual(total, want) {
+		t.Errorf("reduce() = %v, want %v", total, want)
+	}
+	state, err := utils.LoadJobState(ctx, s3Client, "results", jobID)
+	if err != nil || state == nil || state.SubJobs == nil || !reflect.DeepEqual(*state.SubJobs, utils.SubJobProgress{Total: 2, Done: 2}) {
+		t.Errorf("LoadJobState() = %+v, %v, want 2 sub-jobs done", state, err)
+	}
+
+	// The late duplicates are dropped once the job is finished
+	w.finish(jobID)
+	w.deletePartials(ctx, jobID, utils.ResultKey(jobID, nil))
+	if keys, _ := utils.ListObjectKeys(ctx, s3Client, "results", utils.PartialResultPrefix(jobID)); len(keys) != 0 {
+		t.Errorf("deletePartials() left %v", keys)
+	}
+	other := utils.NewJobID()
+	rng := utils.ByteRange{Start: 0, End: 10}
+	putCounts(t, s3Client, "results", utils.ResultKey(other, &rng), map[string]int{"queen": 1})
+	sendResult(t, sqsClient, "subresults", utils.ResultMessage{JobID: other, Range: &rng, ResultBucket: "results", ResultKey: utils.ResultKey(other, &rng)})
+	sqsClient.Now = func() time.Time { return time.Now().Add(time.Minute) }
+	if _, err := w.reduce(ctx, utils.JobMessage{JobID: other}, map[utils.ByteRange]bool{rng: true}); err != nil {
+		t.Fatalf("reduce() error = %v", err)
+	}
+	if msgs := sqsClient.Messages("subresults"); len(msgs) != 0 {
+		t.Errorf("reduce() left %d duplicate results in the queue", len(msgs))
+	}
+}
+
+func Test_reduceOtherJob(t *testing.T) {
+	sqsClient := fakeaws.NewSQS("subresults")
+	s3Client := fakeaws.NewS3("results")
+	w := newTestWorker(roleMaster, sqsClient, s3Client)
+	jobID, other := utils.NewJobID(), utils.NewJobID()
+	rng := utils.ByteRange{Start: 0, End: 10}
+	for _, id := range []utils.JobID{other, jobID} {
+		key := utils.ResultKey(id, &rng)
+		putCounts(t, s3Client, "results", key, map[string]int{"alice": 1})
+		sendResult(t, sqsClient, "subresults", utils.ResultMessage{JobID: id, Range: &rng, ResultBucket: "results", ResultKey: key})
+	}
+
+	if _, err := w.reduce(context.TODO(), utils.JobMessage{JobID: jobID}, map[utils.ByteRange]bool{rng: true}); err != nil {
+		t.Fatalf("reduce() error = %v", err)
+	}
+	// The result of the other job is visible again at once
+	resp, err := utils.GetLPMessagesByURL(context.TODO(), sqsClient, fakeaws.QueueURL("subresults"), 10, 0)
+	if err != nil || len(resp.Messages) != 1 {
+		t.Fatalf("GetLPMessagesByURL() = %v, %v, want the result of the other job", resp, err)
+	}
+	if result, err := utils.DecodeResult(*resp.Messages[0].Body); err != nil || result.JobID != other {
+		t.Errorf("DecodeResult() = %+v, %v, want the result of %s", result, err, other)
+	}
+}
+
+func Test_reduceFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// failure is the error reported for the first range, none if empty
+		failure string
+		wantErr string
+	}{
+		{name: "SubJobFailed", failure: "object not found", wantErr: "failed: object not found"},
+		{name: "TimedOut", timeout: 50 * time.Millisecond, wantErr: "no sub-job result within"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqsClient := fakeaws.NewSQS("subresults")
+			w := newTestWorker(roleMaster, sqsClient, fakeaws.NewS3("results"))
+			w.subJobTimeout = tt.timeout
+			jobID := utils.NewJobID()
+			rng := utils.ByteRange{Start: 0, End: 10}
+			if tt.failure != "" {
+				sendResult(t, sqsClient, "subresults", utils.ResultMessage{JobID: jobID, Range: &rng, Error: tt.failure})
+			}
+
+			pending := map[utils.ByteRange]bool{rng: true, {Start: 10, End: 20}: true}
+			_, err := w.reduce(context.TODO(), utils.JobMessage{JobID: jobID}, pending)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("reduce() error = %v, want %q", err, tt.wantErr)
+			}
+			if msgs := sqsClient.Messages("subresults"); len(msgs) != 0 {
+				t.Errorf("reduce() left %d results in the queue", len(msgs))
+			}
+		})
+	}
+}
+
+func Test_failSubJob(t *testing.T) {
+	sqsClient := fakeaws.NewSQS("subjobs", "subresults", "dlq")
+	w := newTestWorker(roleSub, sqsClient, fakeaws.NewS3("results"))
+	w.in = queue{name: "subjobs", url: fakeaws.QueueURL("subjobs")}
+	w.dlqURL, w.maxReceives = fakeaws.QueueURL("dlq"), 1
+	job := utils.JobMessage{JobID: utils.NewJobID(), Bucket: "data", Key: "alice30.txt", Range: &utils.ByteRange{Start: 0, End: 10}, ReplyTo: "subresults"}
+	msg := receiveJob(t, w, sqsClient, job)
+
+	w.fail(context.TODO(), w.in, msg, job, errors.New("object not found"))
+	if len(sqsClient.Messages("dlq")) != 1 {
+		t.Errorf("fail() did not dead-letter the sub-job")
+	}
+	msgs := sqsClient.Messages("subresults")
+	if len(msgs) != 1 {
+		t.Fatalf("fail() sent %d results, want 1", len(msgs))
+	}
+	result, err := utils.DecodeResult(*msgs[0].Body)
+	if err != nil || result.JobID != job.JobID || !reflect.DeepEqual(result.Range, job.Range) || result.Error != "object not found" {
+		t.Errorf("fail() reported %+v, %v, want the failure of the sub-job", result, err)
+	}
+}
+
+func Test_finish(t *testing.T) {
+	w := newTestWorker(roleMaster, fakeaws.NewSQS(), fakeaws.NewS3())
+	old, recent := utils.NewJobID(), utils.NewJobID()
+	w.finished[old] = time.Now().Add(-finishedTTL - time.Minute)
+	w.finished[recent] = time.Now().Add(-time.Minute)
+	if w.reduced(old) || !w.reduced(recent) {
+		t.Errorf("reduced() = %v, %v, want false, true", w.reduced(old), w.reduced(recent))
+	}
+
+	jobID := utils.NewJobID()
+	w.finish(jobID)
+	if _, ok := w.finished[old]; ok || len(w.finished) != 2 || !w.reduced(jobID) {
+		t.Errorf("finish() left %v, want %s and %s", w.finished, recent, jobID)
+	}
+}
+
+func Test_sortedRanges(t *testing.T) {
+	pending := map[utils.ByteRange]bool{{Start: 20, End: 30}: true, {Start: 0, End: 10}: true, {Start: 10, End: 20}: true}
+	want := []utils.ByteRange{{Start: 0, End: 10}, {Start: 10, End: 20}, {Start: 20, End: 30}}
+	if got := sortedRanges(pending); !reflect.DeepEqual(got, want) {
+		t.Errorf("sortedRanges() = %v, want %v", got, want)
+	}
+}
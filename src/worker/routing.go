@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"wordcounter/src/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// putBackDelay is how long a job addressed to another worker is hidden once put
+// back in the claim mode, so that the worker does not receive it again at once.
+// FIFO queues do not delay messages, the worker waits instead.
+const putBackDelay = time.Second
+
+// addressedElsewhere reports whether, in the claim mode, the job of msg
+// received from the job queue is addressed to another worker which may still
+// take it before its routing timeout.
+func (w *worker) addressedElsewhere(from queue, msg types.Message) bool {
+	if w.routing != utils.RoutingClaim || from != w.in || w.role == roleSub {
+		return false
+	}
+	target := utils.JobTarget(msg)
+	if target == "" || target == w.id {
+		return false
+	}
+	sent := utils.SentTime(msg)
+	return !sent.IsZero() && time.Since(sent) < w.routingTimeout
+}
+
+// putBack sends the message of a job addressed to another worker back to the
+// queue as a new message visible after putBackDelay, so that the put-back does
+// not count as an attempt at the job, and deletes the message received.
+func (w *worker) putBack(ctx context.Context, from queue, msg types.Message, job utils.JobMessage) {
+	input := utils.PutBackInput(msg, from.url, utils.MessageGroupID(job), putBackDelay)
+	if _, err := utils.SendMsg(ctx, w.sqsClient, input); err != nil {
+		// It becomes visible anyway once its visibility timeout expires
+		w.log.Warn("failed to put back message", utils.LogKeyJobID, job.JobID, utils.LogKeyQueue, from.name,
+			utils.LogKeyError, utils.WrapError("SendMessage", from.name, err))
+		return
+	}
+	if err := utils.RemoveMessageSimple(ctx, w.sqsClient, from.url, aws.ToString(msg.ReceiptHandle)); err != nil {
+		// Both copies are put back, the job may be done twice
+		w.log.Warn("failed to delete message", utils.LogKeyJobID, job.JobID, utils.LogKeyQueue, from.name, utils.LogKeyError, err)
+	}
+	w.log.Debug("put back job addressed to another worker", utils.LogKeyJobID, job.JobID, "target", utils.JobTarget(msg))
+	if utils.IsFIFOQueue(from.name) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(putBackDelay):
+		}
+	}
+}
+
+// handOver moves the jobs left in the queue of the worker to the job queue, so
+// that the other workers take them while it is stopped, and ends the lease of
+// the worker so that no more jobs are routed to its queue.
+func (w *worker) handOver() {
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	w.saveLease(ctx, time.Now(), 0)
+	moved, err := utils.MoveJobs(ctx, w.sqsClient, w.own.url, w.in.url, releaseTimeout)
+	if err != nil {
+		w.log.Warn("failed to hand over jobs", utils.LogKeyQueue, w.own.name, utils.LogKeyError, err)
+	}
+	if moved > 0 {
+		w.log.Info("handed over jobs", utils.LogKeyQueue, w.in.name, "jobs", moved)
+	}
+}
+
+// keepLease renews the lease of the worker on its queue every
+// utils.LeaseInterval until ctx is done, when the worker stops polling it.
+func (w *worker) keepLease(ctx context.Context) {
+	ticker := time.NewTicker(utils.LeaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.saveLease(ctx, time.Now(), utils.LeaseTTL)
+		}
+	}
+}
+
+// saveLease stores the lease of the worker on its queue renewed at now for ttl.
+// The jobs addressed to the worker go to any worker while it fails.
+func (w *worker) saveLease(ctx context.Context, now time.Time, ttl time.Duration) {
+	lease := utils.WorkerLease{
+		WorkerID: w.id,
+		Queue:    w.own.name,
+		Instance: w.identity,
+		Renewed:  now,
+		Expires:  now.Add(ttl),
+	}
+	if err := utils.SaveWorkerLease(ctx, w.s3Client, w.cfg.ResultBucketName, lease); err != nil {
+		w.log.Warn("failed to save the lease of the worker", utils.LogKeyQueue, w.own.name, utils.LogKeyError, err)
+	}
+}